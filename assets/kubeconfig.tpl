@@ -1,5 +1,6 @@
 apiVersion: v1
 clusters:
+{{- range .Clusters }}
 - cluster:
 {{- if eq .SkipTLSVerify true }}
     insecure-skip-tls-verify: true
@@ -7,21 +8,54 @@ clusters:
     certificate-authority-data: {{ .Certificate }}
 {{- end}}
     server: {{ .APIServer }}
-  name: helm
+  name: {{ .Name }}
+{{- end }}
 contexts:
+{{- range .Clusters }}
 - context:
-    cluster: helm
+    cluster: {{ .Name }}
 {{- if .Namespace }}
     namespace: {{ .Namespace }}
 {{- end }}
-    user: {{ .ServiceAccount }}
-  name: helm
-current-context: "helm"
+    user: {{ .User }}
+  name: {{ .Name }}
+{{- end }}
+current-context: {{ printf "%q" .CurrentContext }}
 kind: Config
 preferences: {}
 users:
-- name: {{ .ServiceAccount }}
+{{- range .Clusters }}
+- name: {{ .User }}
   user:
 {{- if .Token }}
     token: {{ .Token }}
 {{- end }}
+{{- if .TokenFile }}
+    tokenFile: {{ printf "%q" .TokenFile }}
+{{- end }}
+{{- with .Exec }}
+    exec:
+      apiVersion: {{ .APIVersion }}
+      command: {{ printf "%q" .Command }}
+{{- if .Args }}
+      args:
+{{- range .Args }}
+      - {{ printf "%q" . }}
+{{- end }}
+{{- end }}
+{{- if .Env }}
+      env:
+{{- range .Env }}
+      - name: {{ printf "%q" .Name }}
+        value: {{ printf "%q" .Value }}
+{{- end }}
+{{- end }}
+{{- if eq .APIVersion "client.authentication.k8s.io/v1" }}
+      interactiveMode: Never
+{{- end }}
+{{- end }}
+{{- if .ClientCertificate }}
+    client-certificate-data: {{ .ClientCertificate }}
+    client-key-data: {{ .ClientKey }}
+{{- end }}
+{{- end }}
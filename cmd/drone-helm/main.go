@@ -20,7 +20,8 @@ func main() {
 	// Make the plan
 	plan, err := helm.NewPlan(*cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		fmt.Fprintf(cfg.Stderr, "%s\n", err.Error())
+		cfg.Flush()
 		os.Exit(1)
 	}
 
@@ -29,8 +30,10 @@ func main() {
 
 	// Expect the plan to go off the rails
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		fmt.Fprintf(cfg.Stderr, "%s\n", err.Error())
+		cfg.Flush()
 		// Throw away the plan
 		os.Exit(1)
 	}
+	cfg.Flush()
 }
@@ -0,0 +1,36 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// A Cluster is one of several Kubernetes clusters to put in the kubeconfig. Its name is also the name of
+// its context, which releases select with kube_context.
+type Cluster struct {
+	Name          string `json:"name" yaml:"name"`                       // Name of the cluster and its context
+	APIServer     string `json:"api_server" yaml:"api_server"`           // The cluster's API endpoint
+	Token         string `json:"token" yaml:"token" secret:"true"`       // Authentication token for the cluster
+	Certificate   string `json:"certificate" yaml:"certificate"`         // The cluster CA's self-signed certificate (must be base64-encoded)
+	SkipTLSVerify bool   `json:"skip_tls_verify" yaml:"skip_tls_verify"` // Connect to the cluster without checking its TLS certificate
+}
+
+// Clusters is the list of clusters given in the `clusters` setting.
+type Clusters []Cluster
+
+// Decode implements envconfig.Decoder, reading the JSON list that drone generates from the `clusters` setting.
+func (c *Clusters) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), c); err != nil {
+		return fmt.Errorf("could not parse clusters: %w", err)
+	}
+	return nil
+}
+
+// Names returns the set of cluster names.
+func (c Clusters) Names() map[string]bool {
+	names := make(map[string]bool, len(c))
+	for _, cluster := range c {
+		names[cluster.Name] = true
+	}
+	return names
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
 
@@ -26,47 +27,86 @@ var (
 // not have the `PLUGIN_` prefix.
 type Config struct {
 	// Configuration for drone-helm itself
-	Command             string   `envconfig:"mode"`                   // Helm command to run
-	DroneEvent          string   `envconfig:"drone_build_event"`      // Drone event that invoked this plugin.
-	UpdateDependencies  bool     `split_words:"true"`                 // [Deprecated] Call `helm dependency update` before the main command (deprecated, use dependencies_action: update instead)
-	DependenciesAction  string   `split_words:"true"`                 // Call `helm dependency build` or `helm dependency update` before the main command
-	AddRepos            []string `split_words:"true"`                 // Call `helm repo add` before the main command
-	RepoCertificate     string   `envconfig:"repo_certificate"`       // The Helm chart repository's self-signed certificate (must be base64-encoded)
-	RepoCACertificate   string   `envconfig:"repo_ca_certificate"`    // The Helm chart repository CA's self-signed certificate (must be base64-encoded)
-	Debug               bool     ``                                   // Generate debug output and pass --debug to all helm commands
-	Values              string   ``                                   // Argument to pass to --set in applicable helm commands
-	StringValues        string   `split_words:"true"`                 // Argument to pass to --set-string in applicable helm commands
-	ValuesFiles         []string `split_words:"true"`                 // Arguments to pass to --values in applicable helm commands
-	Namespace           string   ``                                   // Kubernetes namespace for all helm commands
-	CreateNamespace     bool     `split_words:"true"`                 // Pass --create-namespace to `helm upgrade`
-	KubeToken           string   `split_words:"true"`                 // Kubernetes authentication token to put in .kube/config
-	SkipKubeconfig      bool     `envconfig:"skip_kubeconfig"`        // Skip kubeconfig creation
-	SkipTLSVerify       bool     `envconfig:"skip_tls_verify"`        // Put insecure-skip-tls-verify in .kube/config
-	Certificate         string   `envconfig:"kube_certificate"`       // The Kubernetes cluster CA's self-signed certificate (must be base64-encoded)
-	APIServer           string   `envconfig:"kube_api_server"`        // The Kubernetes cluster's API endpoint
-	ServiceAccount      string   `envconfig:"kube_service_account"`   // Account to use for connecting to the Kubernetes cluster
-	ChartVersion        string   `split_words:"true"`                 // Specific chart version to use in `helm upgrade`
-	DryRun              bool     `split_words:"true"`                 // Pass --dry-run to applicable helm commands
-	Wait                bool     `envconfig:"wait_for_upgrade"`       // Pass --wait to applicable helm commands
-	ReuseValues         bool     `split_words:"true"`                 // Pass --reuse-values to `helm upgrade`
-	KeepHistory         bool     `split_words:"true"`                 // Pass --keep-history to `helm uninstall`
-	HistoryMax          int      `split_words:"true"`                 // Pass --history-max option
-	Timeout             string   ``                                   // Argument to pass to --timeout in applicable helm commands
-	Chart               string   ``                                   // Chart argument to use in applicable helm commands
-	Release             string   ``                                   // Release argument to use in applicable helm commands
-	Force               bool     `envconfig:"force_upgrade"`          // Pass --force to applicable helm commands
-	AtomicUpgrade       bool     `split_words:"true"`                 // Pass --atomic to `helm upgrade`
-	CleanupOnFail       bool     `envconfig:"cleanup_failed_upgrade"` // Pass --cleanup-on-fail to `helm upgrade`
-	LintStrictly        bool     `split_words:"true"`                 // Pass --strict to `helm lint`
-	SkipCrds            bool     `split_words:"true"`                 // Pass --skip-crds to `helm upgrade`
-	DisableV2Conversion bool     `split_words:"true"`                 // Whether or not to use 2to3 convert to migrate Releases from v2 to v3
-	DeleteV2Releases    bool     `split_words:"true"`                 // Pass --delete-v2-releases option for 2to3 convert command
-	MaxReleaseVersions  int      `split_words:"true"`                 // Pass --release-versions-max option for 2to3 convert command
-	TillerNS            string   `envconfig:"tiller_ns"`              // Tiller namespace (--tiller-ns) for 2to3 convert command
-	TillerLabel         string   `split_words:"true"`                 // Tiller label selector (--label) for 2to3 convert command
+	Command               string   `envconfig:"mode"`                           // Helm command to run
+	DroneEvent            string   `envconfig:"drone_build_event"`              // Drone event that invoked this plugin.
+	UpdateDependencies    bool     `split_words:"true"`                         // [Deprecated] Call `helm dependency update` before the main command (deprecated, use dependencies_action: update instead)
+	DependenciesAction    string   `split_words:"true"`                         // Call `helm dependency build` or `helm dependency update` before the main command
+	AddRepos              []string `split_words:"true"`                         // Call `helm repo add` before the main command
+	Repos                 Repos    ``                                           // Call `helm repo add` with credentials or certificates before the main command
+	RepoCertificate       string   `envconfig:"repo_certificate" secret:"true"` // The Helm chart repository's self-signed certificate (must be base64-encoded)
+	RepoCACertificate     string   `envconfig:"repo_ca_certificate"`            // The Helm chart repository CA's self-signed certificate (must be base64-encoded)
+	RegistryLoginHost     string   `split_words:"true"`                         // Call `helm registry login` for this OCI registry before the main command
+	RegistryLoginUsername string   `split_words:"true"`                         // Username for `helm registry login`
+	RegistryLoginPassword string   `split_words:"true" secret:"true"`           // Password for `helm registry login`
+	RegistryLoginInsecure bool     `split_words:"true"`                         // Pass --insecure to `helm registry login`
+	Debug                 bool     ``                                           // Generate debug output and pass --debug to all helm commands
+	Values                Values   ``                                           // Arguments to pass to --set in applicable helm commands
+	StringValues          Values   `split_words:"true"`                         // Arguments to pass to --set-string in applicable helm commands
+	FileValues            Values   `split_words:"true"`                         // Arguments to pass to --set-file in applicable helm commands
+	JSONValues            Values   `envconfig:"json_values"`                    // Arguments to pass to --set-json in applicable helm commands
+	ValuesFiles           []string `split_words:"true"`                         // Arguments to pass to --values in applicable helm commands
+	InterpolateFiles      bool     `envconfig:"interpolate_values_files"`       // Substitute environment variables into the values_files before passing them to helm
+	InterpolateStrict     bool     `split_words:"true"`                         // Fail when a values file refers to an unset environment variable that has no default
+	ValuesYAML            string   `envconfig:"values_yaml"`                    // YAML map of values to pass to --values after the values_files
+	SopsAgeKey            string   `split_words:"true" secret:"true"`           // age identities to decrypt SOPS-encrypted values_files with
+	SopsPGPKey            string   `envconfig:"sops_pgp_key" secret:"true"`     // ASCII-armored PGP private keys to decrypt SOPS-encrypted values_files with
+	SopsPassphrase        string   `split_words:"true" secret:"true"`           // Passphrase for the sops_pgp_key
+	Namespace             string   ``                                           // Kubernetes namespace for all helm commands
+	CreateNamespace       bool     `split_words:"true"`                         // Pass --create-namespace to `helm upgrade`
+	KubeToken             string   `split_words:"true" secret:"true"`           // Kubernetes authentication token to put in .kube/config
+	KubeTokenFile         string   `split_words:"true"`                         // File containing a Kubernetes authentication token, e.g. a projected service account token
+	KubeExec              KubeExec `split_words:"true"`                         // Exec credential plugin to put in .kube/config
+	KubeClientCertificate string   `split_words:"true" secret:"true"`           // Kubernetes client certificate to put in .kube/config (must be base64-encoded)
+	KubeClientKey         string   `split_words:"true" secret:"true"`           // Key for the Kubernetes client certificate (must be base64-encoded)
+	AuthProvider          string   `split_words:"true"`                         // Cloud provider (eks, gke or aks) to get a Kubernetes token from
+	ClusterName           string   `split_words:"true"`                         // Name of the cloud-managed cluster
+	ClusterRegion         string   `split_words:"true"`                         // Region (eks) or location (gke) of the cloud-managed cluster
+	ClusterProject        string   `split_words:"true"`                         // Project of the cloud-managed cluster (gke)
+	SkipKubeconfig        bool     `envconfig:"skip_kubeconfig"`                // Skip kubeconfig creation
+	Preflight             bool     `envconfig:"preflight"`                      // Check the cluster connection and permissions before `helm upgrade`
+	KubeConfig            string   `split_words:"true" secret:"true"`           // A complete kubeconfig (raw or base64-encoded) to use instead of the template
+	KubeContext           string   `split_words:"true"`                         // Context to select in the kube_config or clusters
+	Clusters              Clusters `envconfig:"clusters"`                       // Several clusters to put in .kube/config
+	SkipTLSVerify         bool     `envconfig:"skip_tls_verify"`                // Put insecure-skip-tls-verify in .kube/config
+	Certificate           string   `envconfig:"kube_certificate"`               // The Kubernetes cluster CA's self-signed certificate (must be base64-encoded)
+	APIServer             string   `envconfig:"kube_api_server"`                // The Kubernetes cluster's API endpoint
+	ServiceAccount        string   `envconfig:"kube_service_account"`           // Account to use for connecting to the Kubernetes cluster
+	ChartVersion          string   `split_words:"true"`                         // Specific chart version to use in `helm upgrade`
+	DryRun                bool     `split_words:"true"`                         // Pass --dry-run to applicable helm commands
+	Wait                  bool     `envconfig:"wait_for_upgrade"`               // Pass --wait to applicable helm commands
+	ReuseValues           bool     `split_words:"true"`                         // Pass --reuse-values to `helm upgrade`
+	KeepHistory           bool     `split_words:"true"`                         // Pass --keep-history to `helm uninstall`
+	HistoryMax            int      `split_words:"true"`                         // Pass --history-max option
+	Timeout               string   ``                                           // Argument to pass to --timeout in applicable helm commands
+	Chart                 string   ``                                           // Chart argument to use in applicable helm commands
+	Release               string   ``                                           // Release argument to use in applicable helm commands
+	Releases              Releases ``                                           // Several releases to deploy with `helm upgrade`, each with its own chart and values
+	MaxParallel           int      `split_words:"true"`                         // Number of releases to deploy concurrently
+	DeployFile            string   `split_words:"true"`                         // YAML file describing the repositories, releases and values to deploy
+	DeployEnvironment     string   `split_words:"true"`                         // Environment whose overrides to apply from the deploy file (defaults to $DRONE_DEPLOY_TO)
+	Revision              int      ``                                           // Revision to pass to `helm rollback`; the previous revision is used when unset
+	Force                 bool     `envconfig:"force_upgrade"`                  // Pass --force to applicable helm commands
+	AtomicUpgrade         bool     `split_words:"true"`                         // Pass --atomic to `helm upgrade`
+	CleanupOnFail         bool     `envconfig:"cleanup_failed_upgrade"`         // Pass --cleanup-on-fail to `helm upgrade`
+	LintStrictly          bool     `split_words:"true"`                         // Pass --strict to `helm lint`
+	SkipCrds              bool     `split_words:"true"`                         // Pass --skip-crds to `helm upgrade`
+	TemplateOutput        string   `split_words:"true"`                         // File to write the manifests rendered by `helm template` to
+	ReportFile            string   `split_words:"true"`                         // File to write a JSON report of the plan's outcome to
+	ReleaseEnvFile        string   `split_words:"true"`                         // File to append each upgraded release's revision, status and notes to
+	RunTests              bool     `split_words:"true"`                         // Call `helm test` after `helm upgrade`
+	TestTimeout           string   `split_words:"true"`                         // Argument to pass to --timeout in `helm test`
+	TestLogs              bool     `split_words:"true"`                         // Pass --logs to `helm test`
+	TestFilter            []string `split_words:"true"`                         // Arguments to pass to --filter in `helm test`
+	DisableV2Conversion   bool     `split_words:"true"`                         // Whether or not to use 2to3 convert to migrate Releases from v2 to v3
+	DeleteV2Releases      bool     `split_words:"true"`                         // Pass --delete-v2-releases option for 2to3 convert command
+	MaxReleaseVersions    int      `split_words:"true"`                         // Pass --release-versions-max option for 2to3 convert command
+	TillerNS              string   `envconfig:"tiller_ns"`                      // Tiller namespace (--tiller-ns) for 2to3 convert command
+	TillerLabel           string   `split_words:"true"`                         // Tiller label selector (--label) for 2to3 convert command
 
 	Stdout io.Writer `ignored:"true"`
 	Stderr io.Writer `ignored:"true"`
+
+	interpolated []string // values of the environment variables interpolated into the settings
 }
 
 // NewConfig creates a Config and reads environment variables into it, accounting for several possible formats.
@@ -105,16 +145,34 @@ func NewConfig(stdout, stderr io.Writer) (*Config, error) {
 	}
 
 	if cfg.SkipKubeconfig {
-		if cfg.KubeToken != "" || cfg.Certificate != "" || cfg.APIServer != "" || cfg.ServiceAccount != "" || cfg.SkipTLSVerify {
-			fmt.Fprintf(cfg.Stderr, "Warning: skip_kubeconfig is set. The following kubeconfig-related settings will be ignored: kube_config, kube_certificate, kube_api_server, kube_service_account, skip_tls_verify.")
+		if cfg.KubeToken != "" || cfg.Certificate != "" || cfg.APIServer != "" || cfg.ServiceAccount != "" || cfg.SkipTLSVerify || cfg.KubeConfig != "" || cfg.KubeClientCertificate != "" || cfg.KubeClientKey != "" || cfg.KubeTokenFile != "" || cfg.KubeExec.Command != "" || cfg.AuthProvider != "" || len(cfg.Clusters) > 0 {
+			fmt.Fprintf(cfg.Stderr, "Warning: skip_kubeconfig is set. The following kubeconfig-related settings will be ignored: kube_config, clusters, kube_token, kube_token_file, kube_exec, kube_client_certificate, kube_client_key, auth_provider, kube_certificate, kube_api_server, kube_service_account, skip_tls_verify.")
 		}
 	}
 
 	if justNumbers.MatchString(cfg.Timeout) {
 		cfg.Timeout = fmt.Sprintf("%ss", cfg.Timeout)
 	}
+	if justNumbers.MatchString(cfg.TestTimeout) {
+		cfg.TestTimeout = fmt.Sprintf("%ss", cfg.TestTimeout)
+	}
+
+	if cfg.DeployFile != "" {
+		if err := cfg.loadDeployFile(); err != nil {
+			return nil, err
+		}
+	}
 
 	cfg.loadValuesSecrets()
+	if cfg.InterpolateFiles {
+		cfg.loadValuesFileSecrets()
+	}
+
+	// mask the secrets in everything printed from here on, including helm's output
+	// including the tokens from the auth_provider, which InitKube adds once it has them
+	secrets := cfg.Secrets()
+	cfg.Stdout = newRedactingWriter(cfg.Stdout, secrets, cfg.AuthProvider != "")
+	cfg.Stderr = newRedactingWriter(cfg.Stderr, secrets, cfg.AuthProvider != "")
 
 	if cfg.Debug && cfg.Stderr != nil {
 		cfg.logDebug()
@@ -138,6 +196,9 @@ func (cfg *Config) loadValuesSecrets() {
 		varName = sigils.ReplaceAllString(varName, "")
 
 		if value, ok := os.LookupEnv(varName); ok {
+			if value != "" {
+				cfg.interpolated = append(cfg.interpolated, value)
+			}
 			return value
 		}
 
@@ -147,21 +208,62 @@ func (cfg *Config) loadValuesSecrets() {
 		return ""
 	}
 
-	cfg.Values = findVar.ReplaceAllStringFunc(cfg.Values, replacer)
-	cfg.StringValues = findVar.ReplaceAllStringFunc(cfg.StringValues, replacer)
+	for _, values := range []Values{cfg.Values, cfg.StringValues, cfg.JSONValues} {
+		for i := range values {
+			values[i] = findVar.ReplaceAllStringFunc(values[i], replacer)
+		}
+	}
+
+	for i := 0; i < len(cfg.Releases); i++ {
+		for j := range cfg.Releases[i].Values {
+			cfg.Releases[i].Values[j] = findVar.ReplaceAllStringFunc(cfg.Releases[i].Values[j], replacer)
+		}
+	}
 
 	for i := 0; i < len(cfg.AddRepos); i++ {
 		cfg.AddRepos[i] = findVar.ReplaceAllStringFunc(cfg.AddRepos[i], replacer)
 	}
+
+	for i := 0; i < len(cfg.Clusters); i++ {
+		cfg.Clusters[i].APIServer = findVar.ReplaceAllStringFunc(cfg.Clusters[i].APIServer, replacer)
+		cfg.Clusters[i].Token = findVar.ReplaceAllStringFunc(cfg.Clusters[i].Token, replacer)
+		cfg.Clusters[i].Certificate = findVar.ReplaceAllStringFunc(cfg.Clusters[i].Certificate, replacer)
+	}
+
+	for i := 0; i < len(cfg.Repos); i++ {
+		cfg.Repos[i].URL = findVar.ReplaceAllStringFunc(cfg.Repos[i].URL, replacer)
+		cfg.Repos[i].Username = findVar.ReplaceAllStringFunc(cfg.Repos[i].Username, replacer)
+		cfg.Repos[i].Password = findVar.ReplaceAllStringFunc(cfg.Repos[i].Password, replacer)
+	}
 }
 
 func (cfg Config) logDebug() {
-	if cfg.KubeToken != "" {
-		cfg.KubeToken = "(redacted)"
-	}
+	cfg = redactFields(reflect.ValueOf(cfg)).Interface().(Config)
+	cfg.interpolated = nil
 	fmt.Fprintf(cfg.Stderr, "Generated config: %+v\n", cfg)
 }
 
+// Secrets returns the values of the settings tagged as secret and of every environment variable that was
+// interpolated into the settings. Values shorter than four characters are left out, since masking them would
+// garble the output.
+func (cfg Config) Secrets() []string {
+	var secrets []string
+	seen := map[string]bool{}
+	for _, secret := range append(secretValues(reflect.ValueOf(cfg)), cfg.interpolated...) {
+		if len(secret) >= minSecretLength && !seen[secret] {
+			seen[secret] = true
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// Flush writes out any output that the redaction is holding back. It should be called before the plugin exits.
+func (cfg Config) Flush() {
+	flushOutput(cfg.Stdout)
+	flushOutput(cfg.Stderr)
+}
+
 func (cfg *Config) varsMessage(vars []string, format string) {
 	for _, varname := range vars {
 		_, barePresent := os.LookupEnv(varname)
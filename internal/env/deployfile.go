@@ -0,0 +1,122 @@
+package env
+
+import (
+	"fmt"
+	"os"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// deployFile is the structure of the file named in the `deploy_file` setting. It describes the same things
+// as the plugin's settings, so that they can be kept in the repository rather than in the drone config.
+type deployFile struct {
+	Repositories   Repos `yaml:"repositories"`
+	deploySettings `yaml:",inline"`
+	Environments   map[string]deploySettings `yaml:"environments"` // Overrides applied for a particular deploy_environment
+}
+
+type deploySettings struct {
+	Chart        string   `yaml:"chart"`
+	ChartVersion string   `yaml:"chart_version"`
+	Namespace    string   `yaml:"namespace"`
+	Values       Values   `yaml:"values"`
+	StringValues Values   `yaml:"string_values"`
+	ValuesFiles  []string `yaml:"values_files"`
+	Releases     Releases `yaml:"releases"`
+}
+
+// loadDeployFile reads cfg.DeployFile and fills in any settings that weren't given in the drone config.
+func (cfg *Config) loadDeployFile() error {
+	if cfg.Debug {
+		fmt.Fprintf(cfg.Stderr, "loading deploy file from %s\n", cfg.DeployFile)
+	}
+
+	contents, err := os.ReadFile(cfg.DeployFile)
+	if err != nil {
+		return fmt.Errorf("could not read deploy file: %w", err)
+	}
+
+	var file deployFile
+	if err := yaml.UnmarshalStrict(contents, &file); err != nil {
+		return fmt.Errorf("could not parse deploy file %s: %w", cfg.DeployFile, err)
+	}
+
+	settings := file.deploySettings
+	environment := cfg.DeployEnvironment
+	if environment == "" {
+		// drone sets DRONE_DEPLOY_TO for promotions and rollbacks
+		environment = os.Getenv("DRONE_DEPLOY_TO")
+	}
+	if overrides, ok := file.Environments[environment]; ok {
+		settings = settings.override(overrides)
+	} else if cfg.DeployEnvironment != "" {
+		return fmt.Errorf("deploy file %s has no environment '%s'", cfg.DeployFile, cfg.DeployEnvironment)
+	}
+
+	cfg.Repos = append(cfg.Repos, file.Repositories...)
+
+	if cfg.Chart == "" {
+		cfg.Chart = settings.Chart
+	}
+	if cfg.ChartVersion == "" {
+		cfg.ChartVersion = settings.ChartVersion
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = settings.Namespace
+	}
+	if len(cfg.Values) == 0 {
+		cfg.Values = settings.Values
+	}
+	if len(cfg.StringValues) == 0 {
+		cfg.StringValues = settings.StringValues
+	}
+	if len(cfg.ValuesFiles) == 0 {
+		cfg.ValuesFiles = settings.ValuesFiles
+	}
+	if len(cfg.Releases) == 0 && cfg.Release == "" {
+		cfg.Releases = settings.Releases
+	}
+
+	return nil
+}
+
+// override returns a copy of the settings with every field that's set in overrides replaced. Releases are
+// matched by name, so an environment only needs to mention the fields of a release that differ.
+func (s deploySettings) override(overrides deploySettings) deploySettings {
+	if overrides.Chart != "" {
+		s.Chart = overrides.Chart
+	}
+	if overrides.ChartVersion != "" {
+		s.ChartVersion = overrides.ChartVersion
+	}
+	if overrides.Namespace != "" {
+		s.Namespace = overrides.Namespace
+	}
+	if len(overrides.Values) > 0 {
+		s.Values = overrides.Values
+	}
+	if len(overrides.StringValues) > 0 {
+		s.StringValues = overrides.StringValues
+	}
+	if len(overrides.ValuesFiles) > 0 {
+		s.ValuesFiles = overrides.ValuesFiles
+	}
+
+	releases := append(Releases{}, s.Releases...)
+	for _, override := range overrides.Releases {
+		found := false
+		for i := range releases {
+			if releases[i].Release == override.Release {
+				releases[i] = releases[i].override(override)
+				found = true
+				break
+			}
+		}
+		if !found {
+			releases = append(releases, override)
+		}
+	}
+	s.Releases = releases
+
+	return s
+}
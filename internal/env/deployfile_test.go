@@ -0,0 +1,149 @@
+package env
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const deployFileContents = `
+repositories:
+  - name: bitnami
+    url: https://charts.bitnami.com/bitnami
+  - name: internal
+    url: https://charts.example.com
+    username: deployer
+    password: $CHARTS_PASSWORD
+chart: ./charts/service
+namespace: staging
+values: replicas=1
+values_files: [./values/common.yml]
+releases:
+  - release: database
+    chart: bitnami/postgresql
+    chart_version: 11.1.0
+  - release: api
+    depends_on: [database]
+environments:
+  production:
+    namespace: production
+    values: replicas=3
+    releases:
+      - release: database
+        values_files: [./values/postgres-production.yml]
+      - release: billing
+        depends_on: [database]
+`
+
+type DeployFileTestSuite struct {
+	suite.Suite
+	file *os.File
+}
+
+func TestDeployFileTestSuite(t *testing.T) {
+	suite.Run(t, new(DeployFileTestSuite))
+}
+
+func (suite *DeployFileTestSuite) BeforeTest(_, _ string) {
+	file, err := os.CreateTemp("", "deploy********.yml")
+	suite.Require().NoError(err)
+	_, err = file.WriteString(deployFileContents)
+	suite.Require().NoError(err)
+	suite.Require().NoError(file.Close())
+	suite.file = file
+}
+
+func (suite *DeployFileTestSuite) AfterTest(_, _ string) {
+	os.Remove(suite.file.Name())
+}
+
+func (suite *DeployFileTestSuite) TestLoadDeployFile() {
+	cfg := Config{DeployFile: suite.file.Name()}
+	suite.Require().NoError(cfg.loadDeployFile())
+
+	suite.Equal(Repos{
+		{Name: "bitnami", URL: "https://charts.bitnami.com/bitnami"},
+		{Name: "internal", URL: "https://charts.example.com", Username: "deployer", Password: "$CHARTS_PASSWORD"},
+	}, cfg.Repos)
+	suite.Equal("./charts/service", cfg.Chart)
+	suite.Equal("staging", cfg.Namespace)
+	suite.Equal(Values{"replicas=1"}, cfg.Values)
+	suite.Equal([]string{"./values/common.yml"}, cfg.ValuesFiles)
+	suite.Equal(Releases{
+		{Release: "database", Chart: "bitnami/postgresql", ChartVersion: "11.1.0"},
+		{Release: "api", DependsOn: []string{"database"}},
+	}, cfg.Releases)
+}
+
+func (suite *DeployFileTestSuite) TestLoadDeployFileWithEnvironment() {
+	cfg := Config{
+		DeployFile:        suite.file.Name(),
+		DeployEnvironment: "production",
+	}
+	suite.Require().NoError(cfg.loadDeployFile())
+
+	suite.Equal("./charts/service", cfg.Chart)
+	suite.Equal("production", cfg.Namespace)
+	suite.Equal(Values{"replicas=3"}, cfg.Values)
+	suite.Equal(Releases{
+		{
+			Release:      "database",
+			Chart:        "bitnami/postgresql",
+			ChartVersion: "11.1.0",
+			ValuesFiles:  []string{"./values/postgres-production.yml"},
+		},
+		{Release: "api", DependsOn: []string{"database"}},
+		{Release: "billing", DependsOn: []string{"database"}},
+	}, cfg.Releases)
+}
+
+func (suite *DeployFileTestSuite) TestLoadDeployFileUnknownEnvironment() {
+	cfg := Config{
+		DeployFile:        suite.file.Name(),
+		DeployEnvironment: "qa",
+	}
+	err := cfg.loadDeployFile()
+	suite.EqualError(err, "deploy file "+suite.file.Name()+" has no environment 'qa'")
+}
+
+func (suite *DeployFileTestSuite) TestSettingsTakePrecedence() {
+	cfg := Config{
+		DeployFile: suite.file.Name(),
+		AddRepos:   []string{"stable=https://charts.helm.sh/stable"},
+		Namespace:  "sandbox",
+		Release:    "experiment",
+	}
+	suite.Require().NoError(cfg.loadDeployFile())
+
+	suite.Equal([]string{"stable=https://charts.helm.sh/stable"}, cfg.AddRepos)
+	suite.Len(cfg.Repos, 2)
+	suite.Equal("sandbox", cfg.Namespace)
+	suite.Equal("experiment", cfg.Release)
+	suite.Nil(cfg.Releases, "releases from the file shouldn't be used when release is set")
+}
+
+func (suite *DeployFileTestSuite) TestLoadDeployFileErrors() {
+	cfg := Config{DeployFile: "/usr/foreign/exclude/deploy.yml"}
+	err := cfg.loadDeployFile()
+	suite.Error(err)
+	suite.Regexp("could not read deploy file: .* no such file or directory", err)
+
+	suite.Require().NoError(os.WriteFile(suite.file.Name(), []byte("chart: ./here\ncharts: ./there\n"), 0600))
+	cfg = Config{DeployFile: suite.file.Name()}
+	err = cfg.loadDeployFile()
+	suite.Error(err)
+	suite.Regexp("(?s)could not parse deploy file .*: .* field charts not found", err)
+}
+
+func (suite *DeployFileTestSuite) TestDebugOutput() {
+	stderr := strings.Builder{}
+	cfg := Config{
+		DeployFile: suite.file.Name(),
+		Debug:      true,
+		Stderr:     &stderr,
+	}
+	suite.Require().NoError(cfg.loadDeployFile())
+	suite.Equal("loading deploy file from "+suite.file.Name()+"\n", stderr.String())
+}
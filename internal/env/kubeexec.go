@@ -0,0 +1,29 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// KubeExec describes an exec credential plugin for the kubeconfig, which kubectl and helm run to get a
+// short-lived credential instead of using a static token.
+type KubeExec struct {
+	APIVersion string        `json:"api_version"` // ExecCredential API version; defaults to client.authentication.k8s.io/v1beta1
+	Command    string        `json:"command"`     // Command to run
+	Args       []string      `json:"args"`        // Arguments to pass to the command
+	Env        []KubeExecEnv `json:"env"`         // Additional environment variables for the command
+}
+
+// KubeExecEnv is an environment variable given to an exec credential plugin.
+type KubeExecEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value" secret:"true"` // often a credential, such as an AWS secret key
+}
+
+// Decode implements envconfig.Decoder, reading the JSON object that drone generates from the `kube_exec` setting.
+func (k *KubeExec) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), k); err != nil {
+		return fmt.Errorf("could not parse kube_exec: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package env
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in everything the plugin prints.
+const Redacted = "(redacted)"
+
+// minSecretLength is the length below which a secret isn't masked in output. Interpolated values such as a
+// replica count of "3" would otherwise be masked wherever the character appears.
+const minSecretLength = 4
+
+// secretValues returns the values of the string fields tagged `secret:"true"` in v, a struct, including the
+// fields of nested structs and of lists of structs.
+func secretValues(v reflect.Value) []string {
+	var values []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch {
+		case field.Tag.Get("secret") == "true" && value.Kind() == reflect.String:
+			values = append(values, value.String())
+		case value.Kind() == reflect.Struct:
+			values = append(values, secretValues(value)...)
+		case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < value.Len(); j++ {
+				values = append(values, secretValues(value.Index(j))...)
+			}
+		}
+	}
+	return values
+}
+
+// redactFields returns a copy of v, a struct, in which every non-empty field tagged `secret:"true"` is replaced
+// with Redacted. Lists of structs are copied rather than modified in place.
+func redactFields(v reflect.Value) reflect.Value {
+	redacted := reflect.New(v.Type()).Elem()
+	redacted.Set(v)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch {
+		case field.Tag.Get("secret") == "true" && value.Kind() == reflect.String:
+			if value.String() != "" {
+				redacted.Field(i).SetString(Redacted)
+			}
+		case value.Kind() == reflect.Struct:
+			redacted.Field(i).Set(redactFields(value))
+		case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct && value.Len() > 0:
+			list := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+			for j := 0; j < value.Len(); j++ {
+				list.Index(j).Set(redactFields(value.Index(j)))
+			}
+			redacted.Field(i).Set(list)
+		}
+	}
+	return redacted
+}
+
+// redactingWriter masks secrets in everything written to the underlying writer. A secret may be split across
+// several writes, e.g. when it comes from helm's output, so the writer holds back any trailing text that could be
+// the beginning of a secret until the next write or Flush.
+type redactingWriter struct {
+	out      io.Writer
+	secrets  []string
+	replacer *strings.Replacer
+	pending  []byte
+	lock     sync.Mutex
+}
+
+// newRedactingWriter wraps out so that the given secrets are masked, or returns out itself if there's nothing
+// to mask. If more secrets are expected from AddSecrets, out is wrapped even if there's nothing to mask yet.
+func newRedactingWriter(out io.Writer, secrets []string, moreExpected bool) io.Writer {
+	if out == nil || (len(secrets) == 0 && !moreExpected) {
+		return out
+	}
+
+	w := &redactingWriter{out: out}
+	w.setSecrets(secrets)
+	return w
+}
+
+// setSecrets replaces the secrets that the writer masks.
+func (w *redactingWriter) setSecrets(secrets []string) {
+	// longer secrets go first so that a secret containing another is masked as a whole
+	secrets = append([]string{}, secrets...)
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, Redacted)
+	}
+	w.secrets = secrets
+	w.replacer = strings.NewReplacer(pairs...)
+}
+
+// AddSecrets masks more secrets in the output written to w, for secrets that only come to light after the
+// Config is created, such as the contents of an encrypted values file. It does nothing unless w, or the writer
+// that w wraps, is masking secrets already; set a secret setting, such as a decryption key, to make sure it is.
+func AddSecrets(w io.Writer, secrets []string) {
+	for w != nil {
+		switch writer := w.(type) {
+		case *redactingWriter:
+			writer.lock.Lock()
+			defer writer.lock.Unlock()
+
+			for _, secret := range secrets {
+				if len(secret) >= minSecretLength {
+					writer.secrets = append(writer.secrets, secret)
+				}
+			}
+			writer.setSecrets(writer.secrets)
+			return
+		case interface{ Unwrap() io.Writer }:
+			w = writer.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	text := w.replacer.Replace(string(w.pending) + string(p))
+	held := w.heldBack(text)
+	w.pending = []byte(text[len(text)-held:])
+	if _, err := io.WriteString(w.out, text[:len(text)-held]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out any text that was held back because it could have been the beginning of a secret.
+func (w *redactingWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	pending := w.pending
+	w.pending = nil
+	_, err := w.out.Write(pending)
+	return err
+}
+
+// heldBack returns the length of the longest end of text that is the beginning of a secret.
+func (w *redactingWriter) heldBack(text string) int {
+	longest := 0
+	for _, secret := range w.secrets {
+		n := len(secret) - 1
+		if n > len(text) {
+			n = len(text)
+		}
+		for ; n > longest; n-- {
+			if strings.HasSuffix(text, secret[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// flushOutput flushes w if it's a redactingWriter.
+func flushOutput(w io.Writer) error {
+	if rw, ok := w.(*redactingWriter); ok {
+		return rw.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package env
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RedactTestSuite struct {
+	suite.Suite
+}
+
+func TestRedactTestSuite(t *testing.T) {
+	suite.Run(t, new(RedactTestSuite))
+}
+
+func (suite *RedactTestSuite) TestSecretValues() {
+	cfg := Config{
+		KubeToken:       "akallabeth",
+		RepoCertificate: "cmVwbyBjZXJ0",
+		Namespace:       "valinor",
+		Repos:           Repos{{Name: "valinor", Password: "manwe", Key: "a2V5"}},
+		Clusters:        Clusters{{Name: "numenor", Token: "elendil"}},
+		SopsAgeKey:      "AGE-SECRET-KEY-1SILMARIL",
+	}
+	values := secretValues(reflect.ValueOf(cfg))
+	for _, secret := range []string{"akallabeth", "cmVwbyBjZXJ0", "manwe", "a2V5", "elendil", "AGE-SECRET-KEY-1SILMARIL"} {
+		suite.Contains(values, secret)
+	}
+	suite.NotContains(values, "valinor", "untagged fields aren't secret")
+}
+
+func (suite *RedactTestSuite) TestRedactFieldsCopiesLists() {
+	cfg := Config{Repos: Repos{{Name: "valinor", Password: "manwe"}, {Name: "numenor"}}}
+	redacted := redactFields(reflect.ValueOf(cfg)).Interface().(Config)
+
+	suite.Equal(Redacted, redacted.Repos[0].Password)
+	suite.Equal("", redacted.Repos[1].Password, "empty secrets should stay empty")
+	suite.Equal("manwe", cfg.Repos[0].Password)
+}
+
+func (suite *RedactTestSuite) TestWriterMasksSecrets() {
+	out := &strings.Builder{}
+	w := newRedactingWriter(out, []string{"hunter2", "Eru_Ilúvatar"}, false)
+
+	fmt.Fprintln(w, "--set password=hunter2,fire=Eru_Ilúvatar")
+	suite.Equal("--set password=(redacted),fire=(redacted)\n", out.String())
+}
+
+func (suite *RedactTestSuite) TestWriterMasksSecretsSplitAcrossWrites() {
+	out := &strings.Builder{}
+	w := newRedactingWriter(out, []string{"hunter2"}, false)
+
+	fmt.Fprint(w, "password: hun")
+	suite.Equal("password: ", out.String(), "the beginning of a secret should be held back")
+	fmt.Fprint(w, "ter2 and hu")
+	suite.Equal("password: (redacted) and ", out.String())
+	fmt.Fprint(w, "nting")
+	suite.Equal("password: (redacted) and hunting", out.String(), "text that turns out not to be a secret should be written")
+	fmt.Fprint(w, "\nhunter")
+	suite.Require().NoError(flushOutput(w))
+	suite.Equal("password: (redacted) and hunting\nhunter", out.String())
+}
+
+func (suite *RedactTestSuite) TestWriterPrefersLongerSecrets() {
+	out := &strings.Builder{}
+	w := newRedactingWriter(out, []string{"hunter", "hunter2"}, false)
+
+	fmt.Fprint(w, "hunter2 hunter")
+	suite.Require().NoError(flushOutput(w))
+	suite.Equal("(redacted) (redacted)", out.String())
+}
+
+func (suite *RedactTestSuite) TestNoSecrets() {
+	out := &strings.Builder{}
+	suite.Same(out, newRedactingWriter(out, nil, false))
+	suite.NoError(flushOutput(out))
+}
+
+// unwrapper stands in for writers, such as the ones that prefix parallel output, that wrap a redactingWriter.
+type unwrapper struct {
+	io.Writer
+}
+
+func (u unwrapper) Unwrap() io.Writer {
+	return u.Writer
+}
+
+func (suite *RedactTestSuite) TestAddSecrets() {
+	out := &strings.Builder{}
+	w := unwrapper{newRedactingWriter(out, []string{"hunter2"}, false)}
+	AddSecrets(w, []string{"correct-horse", "3"})
+
+	fmt.Fprint(w, "hunter2 correct-horse 3")
+	suite.Require().NoError(flushOutput(w.Writer))
+	suite.Equal("(redacted) (redacted) 3", out.String(), "short secrets should be left alone")
+
+	plain := &strings.Builder{}
+	AddSecrets(plain, []string{"correct-horse"})
+	AddSecrets(nil, []string{"correct-horse"})
+	fmt.Fprint(plain, "correct-horse")
+	suite.Equal("correct-horse", plain.String(), "a writer that isn't masking secrets should be left alone")
+}
+
+func (suite *RedactTestSuite) TestAddSecretsWhenExpected() {
+	out := &strings.Builder{}
+	w := newRedactingWriter(out, nil, true)
+	suite.NotSame(out, w, "the writer should be ready for secrets that come later")
+
+	fmt.Fprint(w, "nothing to hide; ")
+	AddSecrets(w, []string{"correct-horse"})
+	fmt.Fprint(w, "correct-horse")
+	suite.Require().NoError(flushOutput(w))
+	suite.Equal("nothing to hide; (redacted)", out.String())
+}
@@ -0,0 +1,157 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A Release describes one of several releases deployed by a single plugin step. Drone passes
+// structured settings to plugins as JSON, so the field names match the equivalent Config settings.
+type Release struct {
+	Release      string   `json:"release" yaml:"release"`             // Release argument to use in `helm upgrade`
+	Chart        string   `json:"chart" yaml:"chart"`                 // Chart argument to use in `helm upgrade`; defaults to the top-level chart
+	ChartVersion string   `json:"chart_version" yaml:"chart_version"` // Specific chart version to use; defaults to the top-level chart_version
+	Namespace    string   `json:"namespace" yaml:"namespace"`         // Kubernetes namespace for the release; defaults to the top-level namespace
+	Values       Values   `json:"values" yaml:"values"`               // Arguments to pass to --set; defaults to the top-level values
+	ValuesFiles  []string `json:"values_files" yaml:"values_files"`   // Arguments to pass to --values; defaults to the top-level values_files
+	DependsOn    []string `json:"depends_on" yaml:"depends_on"`       // Releases that must be installed successfully before this one
+	KubeContext  string   `json:"kube_context" yaml:"kube_context"`   // Context of the cluster to install the release in; defaults to the top-level kube_context
+}
+
+// override returns a copy of the release with every field that's set in overrides replaced.
+func (r Release) override(overrides Release) Release {
+	if overrides.Chart != "" {
+		r.Chart = overrides.Chart
+	}
+	if overrides.ChartVersion != "" {
+		r.ChartVersion = overrides.ChartVersion
+	}
+	if overrides.Namespace != "" {
+		r.Namespace = overrides.Namespace
+	}
+	if len(overrides.Values) > 0 {
+		r.Values = overrides.Values
+	}
+	if len(overrides.ValuesFiles) > 0 {
+		r.ValuesFiles = overrides.ValuesFiles
+	}
+	if len(overrides.DependsOn) > 0 {
+		r.DependsOn = overrides.DependsOn
+	}
+	if overrides.KubeContext != "" {
+		r.KubeContext = overrides.KubeContext
+	}
+	return r
+}
+
+// Releases is the list of releases given in the `releases` setting.
+type Releases []Release
+
+// Decode implements envconfig.Decoder, reading the JSON list that drone generates from the `releases` setting.
+func (r *Releases) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), r); err != nil {
+		return fmt.Errorf("could not parse releases: %w", err)
+	}
+	return nil
+}
+
+// Sorted returns the releases ordered so that each one comes after the releases it depends on. Releases
+// that don't depend on each other keep their original order. It is an error for a release to depend on an
+// unknown release, or for the dependencies to form a cycle.
+func (r Releases) Sorted() (Releases, error) {
+	byName := make(map[string]Release, len(r))
+	for _, release := range r {
+		if _, ok := byName[release.Release]; ok {
+			return nil, fmt.Errorf("release '%s' is listed more than once", release.Release)
+		}
+		byName[release.Release] = release
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(r))
+	sorted := make(Releases, 0, len(r))
+
+	var visit func(release Release, path []string) error
+	visit = func(release Release, path []string) error {
+		path = append(path, release.Release)
+		switch state[release.Release] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("releases have a dependency cycle: %s", strings.Join(path, " -> "))
+		}
+
+		state[release.Release] = visiting
+		for _, name := range release.DependsOn {
+			dependency, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("release '%s' depends on unknown release '%s'", release.Release, name)
+			}
+			if err := visit(dependency, path); err != nil {
+				return err
+			}
+		}
+		state[release.Release] = visited
+
+		sorted = append(sorted, release)
+		return nil
+	}
+
+	for _, release := range r {
+		if err := visit(release, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// ReleaseConfigs returns one Config per entry in cfg.Releases, with the entry's settings taking precedence
+// over the top-level ones. The configs are ordered so that each release comes after the ones it depends on.
+// If no releases are listed, it returns the Config itself.
+func (cfg Config) ReleaseConfigs() []Config {
+	if len(cfg.Releases) == 0 {
+		return []Config{cfg}
+	}
+
+	releases, err := cfg.Releases.Sorted()
+	if err != nil {
+		// NewPlan rejects invalid dependencies, so this only happens when the plan is built piecemeal
+		releases = cfg.Releases
+	}
+
+	configs := make([]Config, 0, len(releases))
+	for _, release := range releases {
+		relCfg := cfg
+		relCfg.Releases = nil
+		relCfg.Release = release.Release
+
+		if release.Chart != "" {
+			relCfg.Chart = release.Chart
+		}
+		if release.ChartVersion != "" {
+			relCfg.ChartVersion = release.ChartVersion
+		}
+		if release.Namespace != "" {
+			relCfg.Namespace = release.Namespace
+		}
+		if len(release.Values) > 0 {
+			relCfg.Values = release.Values
+		}
+		if len(release.ValuesFiles) > 0 {
+			relCfg.ValuesFiles = release.ValuesFiles
+		}
+		if release.KubeContext != "" {
+			relCfg.KubeContext = release.KubeContext
+		}
+
+		configs = append(configs, relCfg)
+	}
+
+	return configs
+}
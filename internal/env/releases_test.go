@@ -0,0 +1,147 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ReleasesTestSuite struct {
+	suite.Suite
+}
+
+func TestReleasesTestSuite(t *testing.T) {
+	suite.Run(t, new(ReleasesTestSuite))
+}
+
+func (suite *ReleasesTestSuite) TestDecode() {
+	var releases Releases
+	err := releases.Decode(`[{"release":"gandalf","chart":"./istari","chart_version":"3.0","namespace":"middle-earth","values":"staff=true","values_files":["./grey.yml","./white.yml"]},{"release":"saruman","depends_on":["gandalf"]}]`)
+	suite.Require().NoError(err)
+
+	suite.Equal(Releases{
+		{
+			Release:      "gandalf",
+			Chart:        "./istari",
+			ChartVersion: "3.0",
+			Namespace:    "middle-earth",
+			Values:       Values{"staff=true"},
+			ValuesFiles:  []string{"./grey.yml", "./white.yml"},
+		},
+		{Release: "saruman", DependsOn: []string{"gandalf"}},
+	}, releases)
+}
+
+func (suite *ReleasesTestSuite) TestDecodeError() {
+	var releases Releases
+	err := releases.Decode("gandalf,saruman")
+	suite.Error(err)
+	suite.Regexp("^could not parse releases: ", err)
+}
+
+func (suite *ReleasesTestSuite) TestReleaseConfigsWithoutReleases() {
+	cfg := Config{Release: "radagast", Chart: "./istari"}
+	suite.Equal([]Config{cfg}, cfg.ReleaseConfigs())
+}
+
+func (suite *ReleasesTestSuite) TestReleaseConfigs() {
+	cfg := Config{
+		Chart:        "./istari",
+		ChartVersion: "3.0",
+		Namespace:    "middle-earth",
+		Values:       Values{"staff=true"},
+		ValuesFiles:  []string{"./maiar.yml"},
+		Wait:         true,
+		Releases: Releases{
+			{Release: "gandalf"},
+			{
+				Release:      "saruman",
+				Chart:        "./isengard",
+				ChartVersion: "4.0",
+				Namespace:    "orthanc",
+				Values:       Values{"palantir=true"},
+				ValuesFiles:  []string{"./white.yml"},
+				KubeContext:  "isengard",
+			},
+		},
+	}
+
+	configs := cfg.ReleaseConfigs()
+	suite.Require().Len(configs, 2)
+
+	suite.Equal("gandalf", configs[0].Release)
+	suite.Equal("./istari", configs[0].Chart)
+	suite.Equal("3.0", configs[0].ChartVersion)
+	suite.Equal("middle-earth", configs[0].Namespace)
+	suite.Equal(Values{"staff=true"}, configs[0].Values)
+	suite.Equal([]string{"./maiar.yml"}, configs[0].ValuesFiles)
+	suite.True(configs[0].Wait, "settings that can't be given per-release should be inherited")
+	suite.Nil(configs[0].Releases)
+	suite.Equal("", configs[0].KubeContext)
+
+	suite.Equal("saruman", configs[1].Release)
+	suite.Equal("./isengard", configs[1].Chart)
+	suite.Equal("4.0", configs[1].ChartVersion)
+	suite.Equal("orthanc", configs[1].Namespace)
+	suite.Equal(Values{"palantir=true"}, configs[1].Values)
+	suite.Equal([]string{"./white.yml"}, configs[1].ValuesFiles)
+	suite.Equal("isengard", configs[1].KubeContext)
+	suite.True(configs[1].Wait)
+}
+
+func (suite *ReleasesTestSuite) TestSorted() {
+	releases := Releases{
+		{Release: "api", DependsOn: []string{"database", "cache"}},
+		{Release: "frontend", DependsOn: []string{"api"}},
+		{Release: "database"},
+		{Release: "cache"},
+		{Release: "docs"},
+	}
+
+	sorted, err := releases.Sorted()
+	suite.Require().NoError(err)
+
+	names := []string{}
+	for _, release := range sorted {
+		names = append(names, release.Release)
+	}
+	suite.Equal([]string{"database", "cache", "api", "frontend", "docs"}, names)
+}
+
+func (suite *ReleasesTestSuite) TestSortedDetectsCycles() {
+	releases := Releases{
+		{Release: "chicken", DependsOn: []string{"egg"}},
+		{Release: "egg", DependsOn: []string{"hen"}},
+		{Release: "hen", DependsOn: []string{"chicken"}},
+	}
+
+	_, err := releases.Sorted()
+	suite.EqualError(err, "releases have a dependency cycle: chicken -> egg -> hen -> chicken")
+
+	_, err = Releases{{Release: "ouroboros", DependsOn: []string{"ouroboros"}}}.Sorted()
+	suite.EqualError(err, "releases have a dependency cycle: ouroboros -> ouroboros")
+}
+
+func (suite *ReleasesTestSuite) TestSortedUnknownDependency() {
+	_, err := Releases{{Release: "api", DependsOn: []string{"databse"}}}.Sorted()
+	suite.EqualError(err, "release 'api' depends on unknown release 'databse'")
+}
+
+func (suite *ReleasesTestSuite) TestSortedDuplicateRelease() {
+	_, err := Releases{{Release: "api"}, {Release: "api"}}.Sorted()
+	suite.EqualError(err, "release 'api' is listed more than once")
+}
+
+func (suite *ReleasesTestSuite) TestReleaseConfigsAreSorted() {
+	cfg := Config{
+		Releases: Releases{
+			{Release: "api", DependsOn: []string{"database"}},
+			{Release: "database"},
+		},
+	}
+
+	configs := cfg.ReleaseConfigs()
+	suite.Require().Len(configs, 2)
+	suite.Equal("database", configs[0].Release)
+	suite.Equal("api", configs[1].Release)
+}
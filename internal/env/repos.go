@@ -0,0 +1,31 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// A Repo describes a chart repository given in the structured `repos` setting, for repositories that need
+// more than the `name=url` that add_repos can express.
+type Repo struct {
+	Name                  string `json:"name" yaml:"name"`                                         // Name to give the repository in `helm repo add`
+	URL                   string `json:"url" yaml:"url"`                                           // URL of the repository
+	Username              string `json:"username" yaml:"username"`                                 // Chart repository username
+	Password              string `json:"password" yaml:"password" secret:"true"`                   // Chart repository password
+	PassCredentials       bool   `json:"pass_credentials" yaml:"pass_credentials"`                 // Pass --pass-credentials to `helm repo add`
+	Certificate           string `json:"certificate" yaml:"certificate" secret:"true"`             // The repository's self-signed certificate (must be base64-encoded); defaults to repo_certificate
+	Key                   string `json:"key" yaml:"key" secret:"true"`                             // Key for the client certificate (must be base64-encoded)
+	CACertificate         string `json:"ca_certificate" yaml:"ca_certificate"`                     // The repository CA's self-signed certificate (must be base64-encoded); defaults to repo_ca_certificate
+	InsecureSkipTLSVerify bool   `json:"insecure_skip_tls_verify" yaml:"insecure_skip_tls_verify"` // Connect to the repository without checking its TLS certificate
+}
+
+// Repos is the list of repositories given in the `repos` setting.
+type Repos []Repo
+
+// Decode implements envconfig.Decoder, reading the JSON list that drone generates from the `repos` setting.
+func (r *Repos) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), r); err != nil {
+		return fmt.Errorf("could not parse repos: %w", err)
+	}
+	return nil
+}
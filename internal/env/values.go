@@ -0,0 +1,91 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Values is a list of `key=value` assignments for `--set`, `--set-string`, `--set-file` or `--set-json`. Each
+// entry is passed to helm with its own flag.
+type Values []string
+
+// Decode implements envconfig.Decoder. Drone joins the entries of a list setting with commas, so the setting is
+// split at every comma that isn't escaped with a backslash or inside brackets, braces or double quotes. A JSON
+// list of strings is taken as it is, for entries that can't be written that way.
+func (v *Values) Decode(value string) error {
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var list []string
+		if err := json.Unmarshal([]byte(value), &list); err == nil {
+			*v = list
+			return nil
+		}
+	}
+	*v = splitValues(value)
+	return nil
+}
+
+// UnmarshalJSON accepts either a list of entries or a single string to split, as in the `releases` setting.
+func (v *Values) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*v = list
+		return nil
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("values must be a string or a list of strings: %w", err)
+	}
+	*v = splitValues(value)
+	return nil
+}
+
+// UnmarshalYAML accepts either a list of entries or a single string to split, as in a deploy file.
+func (v *Values) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*v = list
+		return nil
+	}
+
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return fmt.Errorf("values must be a string or a list of strings: %w", err)
+	}
+	*v = splitValues(value)
+	return nil
+}
+
+// splitValues splits a comma-separated list of assignments, leaving escaped commas and those inside brackets,
+// braces or double quotes, such as helm's `{a,b}` list syntax or a JSON object, within their entry.
+func splitValues(value string) Values {
+	var values Values
+	depth, quoted, escaped, start := 0, false, false, 0
+	add := func(entry string) {
+		if entry != "" {
+			values = append(values, entry)
+		}
+	}
+
+	for i, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '{' || c == '[':
+			depth++
+		case (c == '}' || c == ']') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			add(value[start:i])
+			start = i + 1
+		}
+	}
+	add(value[start:])
+	return values
+}
@@ -0,0 +1,55 @@
+package env
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type ValuesTestSuite struct {
+	suite.Suite
+}
+
+func TestValuesTestSuite(t *testing.T) {
+	suite.Run(t, new(ValuesTestSuite))
+}
+
+func (suite *ValuesTestSuite) TestDecode() {
+	for setting, expected := range map[string]Values{
+		"":                                 nil,
+		"replicas=3":                       {"replicas=3"},
+		"replicas=3,image.tag=v1":          {"replicas=3", "image.tag=v1"},
+		`url=https://x.test/?a=1\,b=2,c=3`: {`url=https://x.test/?a=1\,b=2`, "c=3"},
+		"hosts={a.test,b.test},c=3":        {"hosts={a.test,b.test}", "c=3"},
+		`ingress={"hosts":["a","b"]},c=3`:  {`ingress={"hosts":["a","b"]}`, "c=3"},
+		`motd="hello, world",c=3`:          {`motd="hello, world"`, "c=3"},
+		"a=1,,b=2":                         {"a=1", "b=2"},
+		`["motd=hello, world","c=3"]`:      {"motd=hello, world", "c=3"},
+	} {
+		var values Values
+		suite.Require().NoError(values.Decode(setting))
+		suite.Equal(expected, values, setting)
+	}
+}
+
+func (suite *ValuesTestSuite) TestUnmarshalJSON() {
+	var release Release
+	suite.Require().NoError(json.Unmarshal([]byte(`{"values":"a=1,b=2"}`), &release))
+	suite.Equal(Values{"a=1", "b=2"}, release.Values)
+
+	suite.Require().NoError(json.Unmarshal([]byte(`{"values":["motd=hello, world","b=2"]}`), &release))
+	suite.Equal(Values{"motd=hello, world", "b=2"}, release.Values)
+
+	suite.Error(json.Unmarshal([]byte(`{"values":3}`), &release))
+}
+
+func (suite *ValuesTestSuite) TestUnmarshalYAML() {
+	var settings deploySettings
+	suite.Require().NoError(yaml.UnmarshalStrict([]byte("values: a=1,b=2\nstring_values:\n  - motd=hello, world\n"), &settings))
+	suite.Equal(Values{"a=1", "b=2"}, settings.Values)
+	suite.Equal(Values{"motd=hello, world"}, settings.StringValues)
+
+	suite.Error(yaml.UnmarshalStrict([]byte("values: {a: 1}\n"), &settings))
+}
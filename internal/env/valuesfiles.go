@@ -0,0 +1,57 @@
+package env
+
+import (
+	"os"
+	"regexp"
+)
+
+// valuesFileVar matches `${VAR}` and `${VAR:-default}`, along with the `$${VAR}` escape for a literal `${VAR}`.
+var valuesFileVar = regexp.MustCompile(`\$(\$?)\{(\w+)(:-([^}]*))?\}`)
+
+// ExpandValuesFile substitutes environment variables into the contents of a values file, for the
+// interpolate_values_files setting. `${VAR}` is replaced with the variable's value and `${VAR:-default}` with the
+// default if the variable is unset or empty. Unlike in the values setting, a bare `$VAR` is left alone, since
+// dollar signs are common in YAML. It returns the expanded contents, the non-empty values that were substituted,
+// and the names of the variables that were unset and had no default.
+func ExpandValuesFile(contents string) (string, []string, []string) {
+	var values, missing []string
+	expanded := valuesFileVar.ReplaceAllStringFunc(contents, func(match string) string {
+		parts := valuesFileVar.FindStringSubmatch(match)
+		escaped, name, hasDefault, fallback := parts[1] != "", parts[2], parts[3] != "", parts[4]
+		if escaped {
+			return match[1:]
+		}
+
+		value, ok := os.LookupEnv(name)
+		switch {
+		case value != "":
+			values = append(values, value)
+			return value
+		case hasDefault:
+			return fallback
+		case !ok:
+			missing = append(missing, name)
+		}
+		return ""
+	})
+	return expanded, values, missing
+}
+
+// loadValuesFileSecrets records the values that interpolate_values_files will substitute into the values files,
+// so they're redacted along with the rest of the secrets. Files that can't be read are skipped here; the steps
+// that use them report the error.
+func (cfg *Config) loadValuesFileSecrets() {
+	files := cfg.ValuesFiles
+	for _, release := range cfg.Releases {
+		files = append(files[:len(files):len(files)], release.ValuesFiles...)
+	}
+
+	for _, filename := range files {
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		_, values, _ := ExpandValuesFile(string(contents))
+		cfg.interpolated = append(cfg.interpolated, values...)
+	}
+}
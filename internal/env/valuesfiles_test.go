@@ -0,0 +1,62 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ValuesFilesTestSuite struct {
+	suite.Suite
+}
+
+func TestValuesFilesTestSuite(t *testing.T) {
+	suite.Run(t, new(ValuesFilesTestSuite))
+}
+
+func (suite *ValuesFilesTestSuite) TestExpandValuesFile() {
+	suite.T().Setenv("SECRET_FIRE", "Eru_Ilúvatar")
+	suite.T().Setenv("SECRET_EMPTY", "")
+	suite.T().Setenv("SECRET_WATER", "") // restored after the test
+	os.Unsetenv("SECRET_WATER")
+
+	expanded, values, missing := ExpandValuesFile(strings.Join([]string{
+		"fire: ${SECRET_FIRE}",
+		"water: ${SECRET_WATER}",
+		"earth: ${SECRET_EARTH:-stone}",
+		"empty: ${SECRET_EMPTY:-fallback}",
+		"literal: $${SECRET_FIRE}",
+		"price: $SECRET_FIRE",
+	}, "\n"))
+
+	suite.Equal(strings.Join([]string{
+		"fire: Eru_Ilúvatar",
+		"water: ",
+		"earth: stone",
+		"empty: fallback",
+		"literal: ${SECRET_FIRE}",
+		"price: $SECRET_FIRE",
+	}, "\n"), expanded)
+	suite.Equal([]string{"Eru_Ilúvatar"}, values)
+	suite.Equal([]string{"SECRET_WATER"}, missing)
+}
+
+func (suite *ValuesFilesTestSuite) TestNewConfigRedactsValuesFileSecrets() {
+	suite.T().Setenv("SECRET_FIRE", "Eru_Ilúvatar")
+	filename := filepath.Join(suite.T().TempDir(), "values.yml")
+	suite.Require().NoError(os.WriteFile(filename, []byte("fire: ${SECRET_FIRE}\n"), 0644))
+	suite.T().Setenv("PLUGIN_VALUES_FILES", filename)
+
+	suite.T().Setenv("PLUGIN_INTERPOLATE_VALUES_FILES", "false")
+	cfg, err := NewConfig(&strings.Builder{}, &strings.Builder{})
+	suite.Require().NoError(err)
+	suite.NotContains(cfg.Secrets(), "Eru_Ilúvatar", "the files shouldn't be read unless interpolation is on")
+
+	suite.T().Setenv("PLUGIN_INTERPOLATE_VALUES_FILES", "true")
+	cfg, err = NewConfig(&strings.Builder{}, &strings.Builder{})
+	suite.Require().NoError(err)
+	suite.Contains(cfg.Secrets(), "Eru_Ilúvatar")
+}
@@ -0,0 +1,256 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+// parallelSteps is a Step that runs several named sequences of steps concurrently. The steps within a
+// sequence run in order, and a failure stops the rest of its sequence without affecting the others, except
+// for sequences that depend on it, which are skipped. With a maxParallel of one, the sequences run one at a
+// time in the order they were added, which must put every sequence after the ones it depends on.
+type parallelSteps struct {
+	sequences   []*sequence
+	maxParallel int
+	debug       bool
+	stderr      io.Writer
+	outputLock  sync.Mutex
+	report      *report
+}
+
+type sequence struct {
+	name      string
+	steps     []Step
+	dependsOn []string // names of sequences that must succeed before this one starts
+	writers   []*prefixWriter
+}
+
+func newParallelSteps(cfg env.Config) *parallelSteps {
+	return &parallelSteps{
+		maxParallel: cfg.MaxParallel,
+		debug:       cfg.Debug,
+		stderr:      cfg.Stderr,
+	}
+}
+
+// sequenceConfig returns a copy of cfg whose output is prefixed with the sequence's name, so that
+// interleaved output from concurrent sequences remains readable. Sequences that run one at a time don't
+// interleave, so their output is left as it is.
+func (p *parallelSteps) sequenceConfig(cfg env.Config, name string) (env.Config, *sequence) {
+	seq := &sequence{name: name}
+	p.sequences = append(p.sequences, seq)
+	if p.maxParallel <= 1 {
+		return cfg, seq
+	}
+	prefix := fmt.Sprintf("[%s] ", name)
+
+	if cfg.Stdout != nil {
+		stdout := newPrefixWriter(cfg.Stdout, prefix, &p.outputLock)
+		seq.writers = append(seq.writers, stdout)
+		cfg.Stdout = stdout
+	}
+	if cfg.Stderr != nil {
+		stderr := newPrefixWriter(cfg.Stderr, prefix, &p.outputLock)
+		seq.writers = append(seq.writers, stderr)
+		cfg.Stderr = stderr
+	}
+
+	return cfg, seq
+}
+
+// Prepare prepares every step of every sequence, in order.
+func (p *parallelSteps) Prepare() error {
+	for _, seq := range p.sequences {
+		for i, step := range seq.steps {
+			if p.debug {
+				fmt.Fprintf(p.stderr, "calling %T.Prepare (%s step %d)\n", step, seq.name, i)
+			}
+
+			if err := step.Prepare(); err != nil {
+				return fmt.Errorf("while preparing %T step for %s: %w", step, seq.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Execute runs the sequences, at most maxParallel at a time, and reports every sequence that failed.
+func (p *parallelSteps) Execute() error {
+	limit := p.maxParallel
+	if limit < 1 {
+		limit = 1
+	}
+
+	errs := make([]error, len(p.sequences))
+	done := make([]chan struct{}, len(p.sequences))
+	indexes := make(map[string]int, len(p.sequences))
+	for i, seq := range p.sequences {
+		done[i] = make(chan struct{})
+		indexes[seq.name] = i
+	}
+
+	semaphore := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i, seq := range p.sequences {
+		wg.Add(1)
+		run := func(i int, seq *sequence) {
+			defer wg.Done()
+			defer close(done[i])
+
+			for _, name := range seq.dependsOn {
+				dep, ok := indexes[name]
+				if !ok {
+					continue
+				}
+				<-done[dep]
+				if errs[dep] != nil {
+					errs[i] = fmt.Errorf("skipped because %s failed", name)
+					for _, step := range seq.steps {
+						p.report.skip(seq.name, step)
+					}
+					return
+				}
+			}
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			errs[i] = p.executeSequence(seq)
+		}
+		if limit == 1 {
+			// the sequences it depends on came before it, so they're done already
+			run(i, seq)
+		} else {
+			go run(i, seq)
+		}
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", p.sequences[i].name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d releases failed: %s", len(failures), len(p.sequences), strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// Cleanup cleans up every step of every sequence, even if some of them fail.
+func (p *parallelSteps) Cleanup() error {
+	var failures []string
+	for _, seq := range p.sequences {
+		for _, step := range seq.steps {
+			c, ok := step.(cleaner)
+			if !ok {
+				continue
+			}
+			if err := c.Cleanup(); err != nil {
+				failures = append(failures, fmt.Sprintf("while cleaning up %T step for %s: %s", step, seq.name, err))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (p *parallelSteps) executeSequence(seq *sequence) error {
+	defer func() {
+		for _, w := range seq.writers {
+			w.Flush()
+		}
+	}()
+
+	for i, step := range seq.steps {
+		if p.debug {
+			p.outputLock.Lock()
+			fmt.Fprintf(p.stderr, "calling %T.Execute (%s step %d)\n", step, seq.name, i)
+			p.outputLock.Unlock()
+		}
+
+		if err := p.report.execute(seq.name, step); err != nil {
+			for _, skipped := range seq.steps[i+1:] {
+				p.report.skip(seq.name, skipped)
+			}
+			return fmt.Errorf("while executing %T step: %w", step, err)
+		}
+	}
+
+	return nil
+}
+
+// prefixWriter writes each line of its input to an underlying writer, preceded by a prefix. Writers that
+// share an underlying writer should share a lock, so that their lines aren't interleaved mid-line.
+type prefixWriter struct {
+	out    io.Writer
+	prefix []byte
+	lock   *sync.Mutex
+
+	bufLock sync.Mutex
+	buf     []byte
+}
+
+func newPrefixWriter(out io.Writer, prefix string, lock *sync.Mutex) *prefixWriter {
+	return &prefixWriter{
+		out:    out,
+		prefix: []byte(prefix),
+		lock:   lock,
+	}
+}
+
+// Unwrap returns the underlying writer.
+func (w *prefixWriter) Unwrap() io.Writer {
+	return w.out
+}
+
+// Write buffers its input and writes out every complete line.
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.bufLock.Lock()
+	defer w.bufLock.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		end := bytes.IndexByte(w.buf, '\n')
+		if end < 0 {
+			break
+		}
+		if err := w.writeLine(w.buf[:end+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[end+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes out any partial line left in the buffer.
+func (w *prefixWriter) Flush() {
+	w.bufLock.Lock()
+	defer w.bufLock.Unlock()
+
+	if len(w.buf) > 0 {
+		_ = w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	_, err := w.out.Write(append(append([]byte{}, w.prefix...), line...))
+	return err
+}
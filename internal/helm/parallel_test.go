@@ -0,0 +1,244 @@
+package helm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+type ParallelStepsTestSuite struct {
+	suite.Suite
+}
+
+func TestParallelStepsTestSuite(t *testing.T) {
+	suite.Run(t, new(ParallelStepsTestSuite))
+}
+
+func (suite *ParallelStepsTestSuite) TestSequenceConfig() {
+	stdout := strings.Builder{}
+	stderr := strings.Builder{}
+	cfg := env.Config{
+		Release: "vivaldi",
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+
+	group := newParallelSteps(env.Config{MaxParallel: 2})
+	seqCfg, seq := group.sequenceConfig(cfg, "vivaldi")
+
+	suite.Equal("vivaldi", seq.name)
+	suite.Require().Len(group.sequences, 1)
+	suite.Same(seq, group.sequences[0])
+	suite.Len(seq.writers, 2)
+
+	fmt.Fprint(seqCfg.Stdout, "spring\nsummer")
+	fmt.Fprint(seqCfg.Stderr, "autumn\n")
+	suite.Equal("[vivaldi] spring\n", stdout.String(), "partial lines should be held back")
+	suite.Equal("[vivaldi] autumn\n", stderr.String())
+
+	for _, w := range seq.writers {
+		w.Flush()
+	}
+	suite.Equal("[vivaldi] spring\n[vivaldi] summer\n", stdout.String())
+}
+
+func (suite *ParallelStepsTestSuite) TestSequenceConfigOneAtATime() {
+	stdout := strings.Builder{}
+	cfg := env.Config{Release: "vivaldi", Stdout: &stdout}
+
+	group := newParallelSteps(env.Config{})
+	seqCfg, seq := group.sequenceConfig(cfg, "vivaldi")
+
+	suite.Require().Len(group.sequences, 1)
+	suite.Same(seq, group.sequences[0])
+	suite.Empty(seq.writers)
+	fmt.Fprint(seqCfg.Stdout, "spring\n")
+	suite.Equal("spring\n", stdout.String(), "output that isn't interleaved shouldn't be prefixed")
+}
+
+func (suite *ParallelStepsTestSuite) TestPrepare() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := NewMockStep(ctrl)
+	stepTwo := NewMockStep(ctrl)
+
+	group := newParallelSteps(env.Config{MaxParallel: 2})
+	_, seqOne := group.sequenceConfig(env.Config{}, "bach")
+	seqOne.steps = []Step{stepOne}
+	_, seqTwo := group.sequenceConfig(env.Config{}, "handel")
+	seqTwo.steps = []Step{stepTwo}
+
+	stepOne.EXPECT().Prepare()
+	stepTwo.EXPECT().Prepare().Return(fmt.Errorf("water music"))
+
+	err := group.Prepare()
+	suite.EqualError(err, "while preparing *helm.MockStep step for handel: water music")
+}
+
+func (suite *ParallelStepsTestSuite) TestExecuteRunsConcurrently() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+
+	group := newParallelSteps(env.Config{MaxParallel: 2})
+
+	var running, maxRunning int32
+	var lock sync.Mutex
+	track := func() error {
+		now := atomic.AddInt32(&running, 1)
+		lock.Lock()
+		if now > maxRunning {
+			maxRunning = now
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	for _, name := range []string{"haydn", "mozart", "beethoven", "schubert"} {
+		step := NewMockStep(ctrl)
+		step.EXPECT().Execute().DoAndReturn(track)
+		_, seq := group.sequenceConfig(env.Config{}, name)
+		seq.steps = []Step{step}
+	}
+
+	suite.NoError(group.Execute())
+	suite.Equal(int32(2), maxRunning, "no more than max_parallel sequences should run at once")
+}
+
+func (suite *ParallelStepsTestSuite) TestExecuteCollectsFailures() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+
+	group := newParallelSteps(env.Config{MaxParallel: 3})
+
+	brahmsUpgrade := NewMockStep(ctrl)
+	brahmsTest := NewMockStep(ctrl)
+	brahmsUpgrade.EXPECT().Execute().Return(fmt.Errorf("lullaby"))
+	_, seq := group.sequenceConfig(env.Config{}, "brahms")
+	seq.steps = []Step{brahmsUpgrade, brahmsTest} // brahmsTest should never be executed
+
+	lisztUpgrade := NewMockStep(ctrl)
+	lisztUpgrade.EXPECT().Execute()
+	_, seq = group.sequenceConfig(env.Config{}, "liszt")
+	seq.steps = []Step{lisztUpgrade}
+
+	chopinUpgrade := NewMockStep(ctrl)
+	chopinUpgrade.EXPECT().Execute().Return(fmt.Errorf("nocturne"))
+	_, seq = group.sequenceConfig(env.Config{}, "chopin")
+	seq.steps = []Step{chopinUpgrade}
+
+	err := group.Execute()
+	suite.EqualError(err, "2 of 3 releases failed: "+
+		"brahms: while executing *helm.MockStep step: lullaby; "+
+		"chopin: while executing *helm.MockStep step: nocturne")
+}
+
+func (suite *ParallelStepsTestSuite) TestExecuteWaitsForDependencies() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+
+	group := newParallelSteps(env.Config{MaxParallel: 3})
+
+	var lock sync.Mutex
+	order := []string{}
+	record := func(name string) func() error {
+		return func() error {
+			time.Sleep(10 * time.Millisecond)
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+			return nil
+		}
+	}
+
+	for _, name := range []string{"frontend", "api", "database"} {
+		step := NewMockStep(ctrl)
+		step.EXPECT().Execute().DoAndReturn(record(name))
+		_, seq := group.sequenceConfig(env.Config{}, name)
+		seq.steps = []Step{step}
+	}
+	group.sequences[0].dependsOn = []string{"api"}
+	group.sequences[1].dependsOn = []string{"database"}
+
+	suite.NoError(group.Execute())
+	suite.Equal([]string{"database", "api", "frontend"}, order)
+}
+
+func (suite *ParallelStepsTestSuite) TestExecuteOneAtATime() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+
+	group := newParallelSteps(env.Config{})
+
+	var calls []*gomock.Call
+	for _, name := range []string{"database", "api", "frontend", "docs"} {
+		step := NewMockStep(ctrl)
+		calls = append(calls, step.EXPECT().Execute())
+		_, seq := group.sequenceConfig(env.Config{}, name)
+		seq.steps = []Step{step}
+	}
+	group.sequences[1].dependsOn = []string{"database"}
+	group.sequences[2].dependsOn = []string{"api"}
+	gomock.InOrder(calls...)
+
+	suite.NoError(group.Execute())
+}
+
+func (suite *ParallelStepsTestSuite) TestExecuteSkipsDependentsOfFailures() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+
+	group := newParallelSteps(env.Config{MaxParallel: 2})
+
+	database := NewMockStep(ctrl)
+	database.EXPECT().Execute().Return(fmt.Errorf("disk full"))
+	_, seq := group.sequenceConfig(env.Config{}, "database")
+	seq.steps = []Step{database}
+
+	api := NewMockStep(ctrl) // should never be executed
+	_, seq = group.sequenceConfig(env.Config{}, "api")
+	seq.steps = []Step{api}
+	seq.dependsOn = []string{"database"}
+
+	frontend := NewMockStep(ctrl) // should never be executed
+	_, seq = group.sequenceConfig(env.Config{}, "frontend")
+	seq.steps = []Step{frontend}
+	seq.dependsOn = []string{"api"}
+
+	docs := NewMockStep(ctrl)
+	docs.EXPECT().Execute()
+	_, seq = group.sequenceConfig(env.Config{}, "docs")
+	seq.steps = []Step{docs}
+
+	err := group.Execute()
+	suite.EqualError(err, "3 of 4 releases failed: "+
+		"database: while executing *helm.MockStep step: disk full; "+
+		"api: skipped because database failed; "+
+		"frontend: skipped because api failed")
+}
+
+func (suite *ParallelStepsTestSuite) TestCleanup() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := &cleanupStep{MockStep: NewMockStep(ctrl), cleanupErr: fmt.Errorf("the harpsichord is out of tune")}
+	stepTwo := &cleanupStep{MockStep: NewMockStep(ctrl)}
+
+	group := newParallelSteps(env.Config{MaxParallel: 2})
+	_, seqOne := group.sequenceConfig(env.Config{}, "bach")
+	seqOne.steps = []Step{stepOne, NewMockStep(ctrl)}
+	_, seqTwo := group.sequenceConfig(env.Config{}, "handel")
+	seqTwo.steps = []Step{stepTwo}
+
+	suite.EqualError(group.Cleanup(), "while cleaning up *helm.cleanupStep step for bach: the harpsichord is out of tune")
+	suite.True(stepOne.cleanedUp)
+	suite.True(stepTwo.cleanedUp)
+}
@@ -3,7 +3,7 @@ package helm
 import (
 	"errors"
 	"fmt"
-	"os"
+	"strings"
 
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 	"github.com/mongodb-forks/drone-helm3/internal/run"
@@ -20,10 +20,17 @@ type Step interface {
 	Execute() error
 }
 
+// A cleaner is a Step that leaves something behind during Prepare or Execute, such as a file containing
+// credentials. Its Cleanup method is called once the plan is finished, whether or not the plan succeeded.
+type cleaner interface {
+	Cleanup() error
+}
+
 // A Plan is a series of steps to perform.
 type Plan struct {
-	steps []Step
-	cfg   env.Config
+	steps  []Step
+	cfg    env.Config
+	report *report
 }
 
 // NewPlan makes a plan for running a helm operation.
@@ -36,15 +43,42 @@ func NewPlan(cfg env.Config) (*Plan, error) {
 		return nil, errors.New("update_dependencies is deprecated and cannot be provided together with dependencies_action")
 	}
 
+	if cfg.Release != "" && len(cfg.Releases) > 0 {
+		return nil, errors.New("release and releases cannot be provided together")
+	}
+
+	if _, err := cfg.Releases.Sorted(); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Clusters) > 0 && !cfg.SkipKubeconfig {
+		clusters := cfg.Clusters.Names()
+		for _, release := range cfg.Releases {
+			if release.KubeContext != "" && !clusters[release.KubeContext] {
+				return nil, fmt.Errorf("release '%s' has kube_context '%s', which is not in the clusters", release.Release, release.KubeContext)
+			}
+		}
+	}
+
 	p.steps = (*determineSteps(cfg))(cfg)
 
+	p.report = newReport(cfg)
+	for _, step := range p.steps {
+		if group, ok := step.(*parallelSteps); ok {
+			group.report = p.report
+		}
+	}
+
 	for i, step := range p.steps {
 		if cfg.Debug {
-			fmt.Fprintf(os.Stderr, "calling %T.Prepare (step %d)\n", step, i)
+			fmt.Fprintf(cfg.Stderr, "calling %T.Prepare (step %d)\n", step, i)
 		}
 
 		if err := step.Prepare(); err != nil {
 			err = fmt.Errorf("while preparing %T step: %w", step, err)
+			if cleanupErr := p.cleanup(); cleanupErr != nil {
+				fmt.Fprintf(cfg.Stderr, "%s\n", cleanupErr)
+			}
 			return nil, err
 		}
 	}
@@ -62,14 +96,22 @@ func determineSteps(cfg env.Config) *func(env.Config) []Step {
 		return &uninstall
 	case "lint":
 		return &lint
+	case "template":
+		return &template
+	case "diff":
+		return &diff
+	case "rollback":
+		return &rollback
 	case "convert":
 		return &convert
 	case "help":
 		return &help
 	default:
 		switch cfg.DroneEvent {
-		case "push", "tag", "deployment", "pull_request", "promote", "rollback":
+		case "push", "tag", "deployment", "pull_request", "promote":
 			return &upgrade
+		case "rollback":
+			return &rollback
 		case "delete":
 			return &uninstall
 		default:
@@ -78,14 +120,38 @@ func determineSteps(cfg env.Config) *func(env.Config) []Step {
 	}
 }
 
-// Execute runs each step in the plan, aborting and reporting on error
-func (p *Plan) Execute() error {
+// Execute runs each step in the plan, aborting and reporting on error. Steps are always cleaned up
+// afterward, even if one of them failed, and then the report_file is written. The releases' status is
+// looked up for the report before the cleanup removes the kubeconfig.
+func (p *Plan) Execute() (err error) {
+	p.report.start()
+	defer func() {
+		p.report.lookupReleases()
+
+		cleanupErr := p.cleanup()
+		if err == nil {
+			err = cleanupErr
+		} else if cleanupErr != nil {
+			fmt.Fprintf(p.cfg.Stderr, "%s\n", cleanupErr)
+		}
+
+		reportErr := p.report.finish(err)
+		if err == nil {
+			err = reportErr
+		} else if reportErr != nil {
+			fmt.Fprintf(p.cfg.Stderr, "%s\n", reportErr)
+		}
+	}()
+
 	for i, step := range p.steps {
 		if p.cfg.Debug {
 			fmt.Fprintf(p.cfg.Stderr, "calling %T.Execute (step %d)\n", step, i)
 		}
 
-		if err := step.Execute(); err != nil {
+		if err := p.report.execute("", step); err != nil {
+			for _, skipped := range p.steps[i+1:] {
+				p.report.skip("", skipped)
+			}
 			return fmt.Errorf("while executing %T step: %w", step, err)
 		}
 	}
@@ -93,31 +159,120 @@ func (p *Plan) Execute() error {
 	return nil
 }
 
+// cleanup calls Cleanup on every step that has one. Every step is cleaned up even if some of them fail.
+func (p *Plan) cleanup() error {
+	var failures []string
+	for i, step := range p.steps {
+		c, ok := step.(cleaner)
+		if !ok {
+			continue
+		}
+
+		if p.cfg.Debug {
+			fmt.Fprintf(p.cfg.Stderr, "calling %T.Cleanup (step %d)\n", step, i)
+		}
+
+		if err := c.Cleanup(); err != nil {
+			failures = append(failures, fmt.Sprintf("while cleaning up %T step: %s", step, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
 var upgrade = func(cfg env.Config) []Step {
 	var steps []Step
+	var kube *run.InitKube
 	if !cfg.SkipKubeconfig {
-		steps = append(steps, run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile))
+		kube = run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile)
+		steps = append(steps, kube)
 	}
 
-	if !cfg.DisableV2Conversion {
-		// The "helm" context is coming from the template
-		steps = append(steps, run.NewConvert(cfg, kubeConfigFile, "helm"))
-	}
+	releases := cfg.ReleaseConfigs()
 
 	for _, repo := range cfg.AddRepos {
 		steps = append(steps, run.NewAddRepo(cfg, repo))
 	}
+	for _, repo := range cfg.Repos {
+		steps = append(steps, run.NewAddRepoFromSettings(cfg, repo))
+	}
 
-	if cfg.DependenciesAction != "" {
-		steps = append(steps, run.NewDepAction(cfg))
+	if cfg.RegistryLoginHost != "" {
+		steps = append(steps, run.NewRegistryLogin(cfg))
 	}
 
-	if cfg.UpdateDependencies {
-		steps = append(steps, run.NewDepUpdate(cfg))
+	// releases that share a chart only need its dependencies fetched once
+	charts := make(map[string]bool)
+	for _, relCfg := range releases {
+		if charts[relCfg.Chart] {
+			continue
+		}
+		charts[relCfg.Chart] = true
+
+		if cfg.DependenciesAction != "" {
+			steps = append(steps, run.NewDepAction(relCfg))
+		}
+
+		if cfg.UpdateDependencies {
+			steps = append(steps, run.NewDepUpdate(relCfg))
+		}
+	}
+
+	// the checks come after the charts are ready, since they render them, but before anything in the cluster changes
+	if cfg.Preflight {
+		for _, relCfg := range releases {
+			steps = append(steps, run.NewPreflight(relCfg))
+		}
+	}
+
+	if !cfg.DisableV2Conversion {
+		for _, relCfg := range releases {
+			steps = append(steps, run.NewConvert(relCfg, kubeConfigFile, kubeContext(relCfg)))
+		}
+	}
+
+	// the releases are grouped even when they're installed one at a time, so that a failure only skips the
+	// releases that depend on the one that failed
+	if len(releases) > 1 {
+		dependencies := make(map[string][]string)
+		for _, release := range cfg.Releases {
+			dependencies[release.Release] = release.DependsOn
+		}
+
+		group := newParallelSteps(cfg)
+		for _, relCfg := range releases {
+			relCfg, seq := group.sequenceConfig(relCfg, relCfg.Release)
+			seq.steps = releaseSteps(relCfg, kube)
+			seq.dependsOn = dependencies[relCfg.Release]
+		}
+		return append(steps, group)
 	}
 
+	return append(steps, releaseSteps(releases[0], kube)...)
+}
+
+// releaseSteps are the steps that install a single release once the cluster and charts are ready. kube is the
+// step that writes the kubeconfig, if there is one.
+func releaseSteps(cfg env.Config, kube *run.InitKube) []Step {
+	// a token from the auth_provider may not last through every release, so each one gets a fresh token
+	var refresh []Step
+	if kube != nil && cfg.AuthProvider != "" {
+		refresh = []Step{run.NewKubeRefresh(kube)}
+	}
+
+	var steps []Step
+	steps = append(steps, refresh...)
 	steps = append(steps, run.NewUpgrade(cfg))
 
+	// a dry run leaves the deployed release as it was, so its tests would only test the old one
+	if cfg.RunTests && !cfg.DryRun {
+		steps = append(steps, refresh...)
+		steps = append(steps, run.NewTest(cfg))
+	}
+
 	return steps
 }
 
@@ -134,11 +289,27 @@ var uninstall = func(cfg env.Config) []Step {
 	return steps
 }
 
+var rollback = func(cfg env.Config) []Step {
+	var steps []Step
+	if !cfg.SkipKubeconfig {
+		steps = append(steps, run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile))
+	}
+	steps = append(steps, run.NewRollback(cfg))
+
+	return steps
+}
+
 var lint = func(cfg env.Config) []Step {
 	var steps []Step
 	for _, repo := range cfg.AddRepos {
 		steps = append(steps, run.NewAddRepo(cfg, repo))
 	}
+	for _, repo := range cfg.Repos {
+		steps = append(steps, run.NewAddRepoFromSettings(cfg, repo))
+	}
+	if cfg.RegistryLoginHost != "" {
+		steps = append(steps, run.NewRegistryLogin(cfg))
+	}
 	if cfg.UpdateDependencies {
 		steps = append(steps, run.NewDepUpdate(cfg))
 	}
@@ -146,6 +317,53 @@ var lint = func(cfg env.Config) []Step {
 	return steps
 }
 
+// template renders the chart locally, so it doesn't need a kubeconfig or a v2 conversion.
+var template = func(cfg env.Config) []Step {
+	var steps []Step
+	for _, repo := range cfg.AddRepos {
+		steps = append(steps, run.NewAddRepo(cfg, repo))
+	}
+	for _, repo := range cfg.Repos {
+		steps = append(steps, run.NewAddRepoFromSettings(cfg, repo))
+	}
+	if cfg.RegistryLoginHost != "" {
+		steps = append(steps, run.NewRegistryLogin(cfg))
+	}
+	if cfg.DependenciesAction != "" {
+		steps = append(steps, run.NewDepAction(cfg))
+	}
+	if cfg.UpdateDependencies {
+		steps = append(steps, run.NewDepUpdate(cfg))
+	}
+	steps = append(steps, run.NewTemplate(cfg))
+	return steps
+}
+
+// diff only reads from the cluster, so it skips the v2 conversion.
+var diff = func(cfg env.Config) []Step {
+	var steps []Step
+	if !cfg.SkipKubeconfig {
+		steps = append(steps, run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile))
+	}
+	for _, repo := range cfg.AddRepos {
+		steps = append(steps, run.NewAddRepo(cfg, repo))
+	}
+	for _, repo := range cfg.Repos {
+		steps = append(steps, run.NewAddRepoFromSettings(cfg, repo))
+	}
+	if cfg.RegistryLoginHost != "" {
+		steps = append(steps, run.NewRegistryLogin(cfg))
+	}
+	if cfg.DependenciesAction != "" {
+		steps = append(steps, run.NewDepAction(cfg))
+	}
+	if cfg.UpdateDependencies {
+		steps = append(steps, run.NewDepUpdate(cfg))
+	}
+	steps = append(steps, run.NewDiff(cfg))
+	return steps
+}
+
 var help = func(cfg env.Config) []Step {
 	return []Step{run.NewHelp(cfg)}
 }
@@ -154,8 +372,17 @@ var convert = func(cfg env.Config) []Step {
 	var steps []Step
 	steps = append(steps, run.NewInitKube(cfg, kubeConfigTemplate, kubeConfigFile))
 
-	// The "helm" context is coming from the template
-	steps = append(steps, run.NewConvert(cfg, kubeConfigFile, "helm"))
+	steps = append(steps, run.NewConvert(cfg, kubeConfigFile, kubeContext(cfg)))
 
 	return steps
 }
+
+// kubeContext returns the kubeconfig context for steps that need to name one explicitly. The "helm"
+// context is coming from the template; a kube_config or clusters use the given context, or the
+// current-context.
+func kubeContext(cfg env.Config) string {
+	if cfg.KubeContext != "" || cfg.KubeConfig != "" || len(cfg.Clusters) > 0 {
+		return cfg.KubeContext
+	}
+	return "helm"
+}
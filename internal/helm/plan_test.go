@@ -55,7 +55,7 @@ func (suite *PlanTestSuite) TestNewPlan() {
 func (suite *PlanTestSuite) TestNewPlanAbortsOnError() {
 	ctrl := gomock.NewController(suite.T())
 	defer ctrl.Finish()
-	stepOne := NewMockStep(ctrl)
+	stepOne := &cleanupStep{MockStep: NewMockStep(ctrl)}
 	stepTwo := NewMockStep(ctrl)
 
 	origHelp := help
@@ -74,7 +74,8 @@ func (suite *PlanTestSuite) TestNewPlanAbortsOnError() {
 
 	_, err := NewPlan(cfg)
 	suite.Require().NotNil(err)
-	suite.EqualError(err, "while preparing *helm.MockStep step: I'm starry Dave, aye, cat blew that")
+	suite.EqualError(err, "while preparing *helm.cleanupStep step: I'm starry Dave, aye, cat blew that")
+	suite.True(stepOne.cleanedUp, "anything written during Prepare should be cleaned up")
 }
 
 func (suite *PlanTestSuite) TestExecute() {
@@ -116,6 +117,83 @@ func (suite *PlanTestSuite) TestExecuteAbortsOnError() {
 	suite.EqualError(err, "while executing *helm.MockStep step: oh, he'll gnaw")
 }
 
+// cleanupStep is a MockStep that also implements cleaner.
+type cleanupStep struct {
+	*MockStep
+	cleanedUp  bool
+	cleanupErr error
+}
+
+func (c *cleanupStep) Cleanup() error {
+	c.cleanedUp = true
+	return c.cleanupErr
+}
+
+func (suite *PlanTestSuite) TestExecuteCleansUp() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := &cleanupStep{MockStep: NewMockStep(ctrl)}
+	stepTwo := NewMockStep(ctrl)
+
+	plan := Plan{
+		steps: []Step{stepOne, stepTwo},
+	}
+
+	stepOne.EXPECT().Execute()
+	stepTwo.EXPECT().Execute()
+
+	suite.NoError(plan.Execute())
+	suite.True(stepOne.cleanedUp)
+}
+
+func (suite *PlanTestSuite) TestExecuteCleansUpAfterError() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := NewMockStep(ctrl)
+	stepTwo := &cleanupStep{MockStep: NewMockStep(ctrl)}
+	stderr := &strings.Builder{}
+
+	plan := Plan{
+		steps: []Step{stepOne, stepTwo},
+		cfg:   env.Config{Stderr: stderr},
+	}
+
+	stepOne.EXPECT().
+		Execute().
+		Return(fmt.Errorf("oh, he'll gnaw"))
+	stepTwo.cleanupErr = fmt.Errorf("the hydrant is stuck")
+
+	err := plan.Execute()
+	suite.EqualError(err, "while executing *helm.MockStep step: oh, he'll gnaw")
+	suite.True(stepTwo.cleanedUp, "steps should be cleaned up even when they never executed")
+	suite.Equal("while cleaning up *helm.cleanupStep step: the hydrant is stuck\n", stderr.String())
+}
+
+func (suite *PlanTestSuite) TestExecuteReportsCleanupErrors() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+	stepOne := &cleanupStep{MockStep: NewMockStep(ctrl), cleanupErr: fmt.Errorf("the hydrant is stuck")}
+	stepTwo := &cleanupStep{MockStep: NewMockStep(ctrl)}
+
+	plan := Plan{
+		steps: []Step{stepOne, stepTwo},
+	}
+
+	stepOne.EXPECT().Execute()
+	stepTwo.EXPECT().Execute()
+
+	suite.EqualError(plan.Execute(), "while cleaning up *helm.cleanupStep step: the hydrant is stuck")
+	suite.True(stepTwo.cleanedUp, "a failed cleanup shouldn't stop the others")
+}
+
+func (suite *PlanTestSuite) TestKubeContext() {
+	suite.Equal("helm", kubeContext(env.Config{}), "the template's context should be the default")
+	suite.Equal("", kubeContext(env.Config{KubeConfig: "apiVersion: v1"}), "a kube_config's current-context should be used")
+	suite.Equal("prod", kubeContext(env.Config{KubeConfig: "apiVersion: v1", KubeContext: "prod"}))
+	suite.Equal("", kubeContext(env.Config{Clusters: env.Clusters{{Name: "staging"}}}), "the first cluster should be the current-context")
+	suite.Equal("prod", kubeContext(env.Config{Clusters: env.Clusters{{Name: "staging"}, {Name: "prod"}}, KubeContext: "prod"}))
+}
+
 func (suite *PlanTestSuite) TestUpgrade() {
 	steps := upgrade(env.Config{})
 	suite.Require().Equal(3, len(steps), "upgrade should return 3 steps")
@@ -124,6 +202,19 @@ func (suite *PlanTestSuite) TestUpgrade() {
 	suite.IsType(&run.Upgrade{}, steps[2])
 }
 
+func (suite *PlanTestSuite) TestUpgradeWithPreflight() {
+	steps := upgrade(env.Config{Preflight: true, UpdateDependencies: true, DisableV2Conversion: true})
+	suite.Require().Equal(4, len(steps), "upgrade should have a Preflight step when Preflight is true")
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.DepUpdate{}, steps[1])
+	suite.IsType(&run.Preflight{}, steps[2], "the preflight check should render the chart after its dependencies are fetched")
+	suite.IsType(&run.Upgrade{}, steps[3])
+
+	steps = upgrade(env.Config{Preflight: true, DryRun: true, DisableV2Conversion: true})
+	suite.Require().Equal(3, len(steps))
+	suite.IsType(&run.Preflight{}, steps[1], "a dry run is a good time to check the permissions")
+}
+
 func (suite *PlanTestSuite) TestUpgradeWithSkipKubeconfig() {
 	steps := upgrade(env.Config{SkipKubeconfig: true, DisableV2Conversion: true})
 	suite.Require().Equal(1, len(steps), "upgrade should return 1 step")
@@ -135,10 +226,216 @@ func (suite *PlanTestSuite) TestUpgradeWithUpdateDependencies() {
 		UpdateDependencies: true,
 	}
 	steps := upgrade(cfg)
-	suite.Require().Equal(4, len(steps), "upgrade should have a third step when DepUpdate is true")
+	suite.Require().Equal(4, len(steps), "upgrade should have a DepUpdate step when UpdateDependencies is true")
 	suite.IsType(&run.InitKube{}, steps[0])
-	suite.IsType(&run.Convert{}, steps[1])
-	suite.IsType(&run.DepUpdate{}, steps[2])
+	suite.IsType(&run.DepUpdate{}, steps[1])
+	suite.IsType(&run.Convert{}, steps[2])
+	suite.IsType(&run.Upgrade{}, steps[3])
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithRunTests() {
+	steps := upgrade(env.Config{RunTests: true, DisableV2Conversion: true})
+	suite.Require().Equal(3, len(steps), "upgrade should have a third step when RunTests is true")
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.Upgrade{}, steps[1])
+	suite.IsType(&run.Test{}, steps[2])
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithRunTestsDryRun() {
+	steps := upgrade(env.Config{RunTests: true, DryRun: true, DisableV2Conversion: true})
+	suite.Require().Equal(2, len(steps), "a dry run shouldn't test the release that's already deployed")
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.Upgrade{}, steps[1])
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithAuthProvider() {
+	cfg := env.Config{
+		AuthProvider:        "eks",
+		RunTests:            true,
+		DisableV2Conversion: true,
+		Releases:            env.Releases{{Release: "root"}, {Release: "shaw"}},
+	}
+	steps := upgrade(cfg)
+	suite.Require().Equal(2, len(steps))
+	suite.Require().IsType(&run.InitKube{}, steps[0])
+	suite.Require().IsType(&parallelSteps{}, steps[1])
+	for _, seq := range steps[1].(*parallelSteps).sequences {
+		suite.Require().Len(seq.steps, 4)
+		suite.IsType(&run.KubeRefresh{}, seq.steps[0], "each release should start with a fresh token")
+		suite.IsType(&run.Upgrade{}, seq.steps[1])
+		suite.IsType(&run.KubeRefresh{}, seq.steps[2], "the tests may start long after the upgrade")
+		suite.IsType(&run.Test{}, seq.steps[3])
+	}
+
+	steps = upgrade(env.Config{AuthProvider: "eks", DisableV2Conversion: true})
+	suite.Require().Equal(3, len(steps))
+	suite.IsType(&run.KubeRefresh{}, steps[1], "a single release isn't grouped")
+	suite.IsType(&run.Upgrade{}, steps[2])
+
+	cfg.SkipKubeconfig = true
+	steps = upgrade(cfg)
+	suite.Require().Equal(1, len(steps))
+	for _, seq := range steps[0].(*parallelSteps).sequences {
+		suite.Len(seq.steps, 2, "there's no token to refresh without the kubeconfig")
+	}
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithReleases() {
+	cfg := env.Config{
+		Chart:              "./charts/shared",
+		DependenciesAction: "build",
+		AddRepos:           []string{"machine=https://github.com/harold_finch/themachine"},
+		Preflight:          true,
+		Releases: env.Releases{
+			{Release: "root"},
+			{Release: "shaw"},
+			{Release: "samaritan", Chart: "./charts/decima"},
+		},
+	}
+	steps := upgrade(cfg)
+	suite.Require().Equal(11, len(steps))
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.AddRepo{}, steps[1])
+	suite.IsType(&run.DepAction{}, steps[2], "releases sharing a chart should share a dependency step")
+	suite.IsType(&run.DepAction{}, steps[3])
+	suite.IsType(&run.Preflight{}, steps[4])
+	suite.IsType(&run.Preflight{}, steps[5])
+	suite.IsType(&run.Preflight{}, steps[6])
+	suite.IsType(&run.Convert{}, steps[7])
+	suite.IsType(&run.Convert{}, steps[8])
+	suite.IsType(&run.Convert{}, steps[9])
+	suite.Require().IsType(&parallelSteps{}, steps[10], "the releases should be grouped even when they're installed one at a time")
+
+	group := steps[10].(*parallelSteps)
+	suite.Equal(0, group.maxParallel)
+	suite.Require().Len(group.sequences, 3)
+	for i, name := range []string{"root", "shaw", "samaritan"} {
+		suite.Equal(name, group.sequences[i].name)
+		suite.Require().Len(group.sequences[i].steps, 1)
+		suite.IsType(&run.Upgrade{}, group.sequences[i].steps[0])
+	}
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithParallelReleases() {
+	cfg := env.Config{
+		DisableV2Conversion: true,
+		RunTests:            true,
+		MaxParallel:         2,
+		Releases: env.Releases{
+			{Release: "shaw", DependsOn: []string{"root"}},
+			{Release: "root"},
+		},
+	}
+	steps := upgrade(cfg)
+	suite.Require().Equal(2, len(steps))
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.Require().IsType(&parallelSteps{}, steps[1])
+
+	group := steps[1].(*parallelSteps)
+	suite.Equal(2, group.maxParallel)
+	suite.Nil(group.sequences[0].dependsOn)
+	suite.Equal([]string{"root"}, group.sequences[1].dependsOn)
+	suite.Require().Len(group.sequences, 2)
+	for i, name := range []string{"root", "shaw"} {
+		suite.Equal(name, group.sequences[i].name)
+		suite.Require().Len(group.sequences[i].steps, 2)
+		suite.IsType(&run.Upgrade{}, group.sequences[i].steps[0])
+		suite.IsType(&run.Test{}, group.sequences[i].steps[1])
+	}
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithReleaseDependencies() {
+	cfg := env.Config{
+		SkipKubeconfig:      true,
+		DisableV2Conversion: true,
+		Releases: env.Releases{
+			{Release: "api", Chart: "./api", DependsOn: []string{"database"}},
+			{Release: "database", Chart: "./database"},
+		},
+	}
+	steps := upgrade(cfg)
+	suite.Require().Equal(1, len(steps))
+	suite.Require().IsType(&parallelSteps{}, steps[0])
+
+	group := steps[0].(*parallelSteps)
+	suite.Require().Len(group.sequences, 2)
+	suite.Equal("database", group.sequences[0].name, "a release should come after the releases it depends on")
+	suite.Nil(group.sequences[0].dependsOn)
+	suite.Equal("api", group.sequences[1].name)
+	suite.Equal([]string{"database"}, group.sequences[1].dependsOn)
+}
+
+func (suite *PlanTestSuite) TestExecuteSequentialReleaseFailure() {
+	ctrl := gomock.NewController(suite.T())
+	defer ctrl.Finish()
+
+	cfg := env.Config{
+		SkipKubeconfig:      true,
+		DisableV2Conversion: true,
+		Releases: env.Releases{
+			{Release: "api", DependsOn: []string{"database"}},
+			{Release: "database"},
+			{Release: "docs"},
+		},
+	}
+	steps := upgrade(cfg)
+	suite.Require().Equal(1, len(steps))
+	suite.Require().IsType(&parallelSteps{}, steps[0])
+
+	database := NewMockStep(ctrl)
+	api := NewMockStep(ctrl) // should never be executed
+	docs := NewMockStep(ctrl)
+	gomock.InOrder(
+		database.EXPECT().Execute().Return(fmt.Errorf("disk full")),
+		docs.EXPECT().Execute(),
+	)
+	mocks := map[string]Step{"api": api, "database": database, "docs": docs}
+	for _, seq := range steps[0].(*parallelSteps).sequences {
+		seq.steps = []Step{mocks[seq.name]}
+	}
+
+	plan := Plan{steps: steps, cfg: cfg}
+	suite.EqualError(plan.Execute(), "while executing *helm.parallelSteps step: 2 of 3 releases failed: "+
+		"database: while executing *helm.MockStep step: disk full; "+
+		"api: skipped because database failed")
+}
+
+func (suite *PlanTestSuite) TestNewPlanWithReleaseDependencyCycle() {
+	cfg := env.Config{
+		Command: "upgrade",
+		Releases: env.Releases{
+			{Release: "api", DependsOn: []string{"database"}},
+			{Release: "database", DependsOn: []string{"api"}},
+		},
+	}
+
+	_, err := NewPlan(cfg)
+	suite.EqualError(err, "releases have a dependency cycle: api -> database -> api")
+}
+
+func (suite *PlanTestSuite) TestNewPlanWithReleaseAndReleases() {
+	cfg := env.Config{
+		Command:  "upgrade",
+		Release:  "root",
+		Releases: env.Releases{{Release: "shaw"}},
+	}
+
+	_, err := NewPlan(cfg)
+	suite.EqualError(err, "release and releases cannot be provided together")
+}
+
+func (suite *PlanTestSuite) TestNewPlanWithUnknownReleaseContext() {
+	cfg := env.Config{
+		Command:  "upgrade",
+		Clusters: env.Clusters{{Name: "staging"}, {Name: "production"}},
+		Releases: env.Releases{
+			{Release: "api", KubeContext: "staging"},
+			{Release: "worker", KubeContext: "development"},
+		},
+	}
+
+	_, err := NewPlan(cfg)
+	suite.EqualError(err, "release 'worker' has kube_context 'development', which is not in the clusters")
 }
 
 func (suite *PlanTestSuite) TestUpgradeWithAddRepos() {
@@ -149,8 +446,21 @@ func (suite *PlanTestSuite) TestUpgradeWithAddRepos() {
 	}
 	steps := upgrade(cfg)
 	suite.Require().True(len(steps) > 1, "upgrade should generate at least two steps")
-	suite.IsType(&run.Convert{}, steps[1])
-	suite.IsType(&run.AddRepo{}, steps[2])
+	suite.IsType(&run.AddRepo{}, steps[1])
+}
+
+func (suite *PlanTestSuite) TestUpgradeWithRepos() {
+	cfg := env.Config{
+		AddRepos:            []string{"machine=https://github.com/harold_finch/themachine"},
+		Repos:               env.Repos{{Name: "samaritan", URL: "https://github.com/john_greer/samaritan"}},
+		DisableV2Conversion: true,
+		SkipKubeconfig:      true,
+	}
+	steps := upgrade(cfg)
+	suite.Require().Equal(3, len(steps))
+	suite.IsType(&run.AddRepo{}, steps[0])
+	suite.IsType(&run.AddRepo{}, steps[1])
+	suite.IsType(&run.Upgrade{}, steps[2])
 }
 
 func (suite *PlanTestSuite) TestUpgradeWithoutConvert() {
@@ -214,7 +524,7 @@ func (suite *PlanTestSuite) TestDeterminePlanUpgradeCommand() {
 func (suite *PlanTestSuite) TestDeterminePlanUpgradeFromDroneEvent() {
 	cfg := env.Config{}
 
-	upgradeEvents := []string{"push", "tag", "deployment", "pull_request", "promote", "rollback"}
+	upgradeEvents := []string{"push", "tag", "deployment", "pull_request", "promote"}
 	for _, event := range upgradeEvents {
 		cfg.DroneEvent = event
 		stepsMaker := determineSteps(cfg)
@@ -222,6 +532,35 @@ func (suite *PlanTestSuite) TestDeterminePlanUpgradeFromDroneEvent() {
 	}
 }
 
+func (suite *PlanTestSuite) TestDeterminePlanRollbackCommand() {
+	cfg := env.Config{
+		Command: "rollback",
+	}
+	stepsMaker := determineSteps(cfg)
+	suite.Same(&rollback, stepsMaker)
+}
+
+func (suite *PlanTestSuite) TestDeterminePlanRollbackFromDroneEvent() {
+	cfg := env.Config{
+		DroneEvent: "rollback",
+	}
+	stepsMaker := determineSteps(cfg)
+	suite.Same(&rollback, stepsMaker)
+}
+
+func (suite *PlanTestSuite) TestRollback() {
+	steps := rollback(env.Config{})
+	suite.Require().Equal(2, len(steps), "rollback should return 2 steps")
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.Rollback{}, steps[1])
+}
+
+func (suite *PlanTestSuite) TestRollbackWithSkipKubeconfig() {
+	steps := rollback(env.Config{SkipKubeconfig: true})
+	suite.Require().Equal(1, len(steps), "rollback should return 1 step")
+	suite.IsType(&run.Rollback{}, steps[0])
+}
+
 func (suite *PlanTestSuite) TestDeterminePlanUninstallCommand() {
 	cfg := env.Config{
 		Command: "uninstall",
@@ -280,3 +619,73 @@ func (suite *PlanTestSuite) TestDeterminePlanConvertCommand() {
 	stepsMaker := determineSteps(cfg)
 	suite.Same(&convert, stepsMaker)
 }
+
+func (suite *PlanTestSuite) TestTemplate() {
+	steps := template(env.Config{})
+	suite.Require().Equal(1, len(steps), "template should not initialize a kubeconfig")
+	suite.IsType(&run.Template{}, steps[0])
+}
+
+func (suite *PlanTestSuite) TestTemplateWithAddReposAndDependencies() {
+	cfg := env.Config{
+		AddRepos:           []string{"northern_lights=https://github.com/root/northern_lights"},
+		DependenciesAction: "build",
+	}
+	steps := template(cfg)
+	suite.Require().Equal(3, len(steps))
+	suite.IsType(&run.AddRepo{}, steps[0])
+	suite.IsType(&run.DepAction{}, steps[1])
+	suite.IsType(&run.Template{}, steps[2])
+}
+
+func (suite *PlanTestSuite) TestDeterminePlanTemplateCommand() {
+	cfg := env.Config{
+		Command: "template",
+	}
+
+	stepsMaker := determineSteps(cfg)
+	suite.Same(&template, stepsMaker)
+}
+
+func (suite *PlanTestSuite) TestDiff() {
+	steps := diff(env.Config{})
+	suite.Require().Equal(2, len(steps), "diff should return 2 steps")
+	suite.IsType(&run.InitKube{}, steps[0])
+	suite.IsType(&run.Diff{}, steps[1])
+}
+
+func (suite *PlanTestSuite) TestDiffWithSkipKubeconfig() {
+	steps := diff(env.Config{SkipKubeconfig: true})
+	suite.Require().Equal(1, len(steps), "diff should return 1 step")
+	suite.IsType(&run.Diff{}, steps[0])
+}
+
+func (suite *PlanTestSuite) TestDeterminePlanDiffCommand() {
+	cfg := env.Config{
+		Command: "diff",
+	}
+
+	stepsMaker := determineSteps(cfg)
+	suite.Same(&diff, stepsMaker)
+}
+
+func (suite *PlanTestSuite) TestRegistryLogin() {
+	cfg := env.Config{
+		RegistryLoginHost:   "registry.example.com",
+		AddRepos:            []string{"machine=https://github.com/harold_finch/themachine"},
+		DisableV2Conversion: true,
+		SkipKubeconfig:      true,
+	}
+
+	for name, stepsMaker := range map[string]func(env.Config) []Step{
+		"upgrade":  upgrade,
+		"lint":     lint,
+		"template": template,
+		"diff":     diff,
+	} {
+		steps := stepsMaker(cfg)
+		suite.Require().Equal(3, len(steps), name)
+		suite.IsType(&run.AddRepo{}, steps[0], name)
+		suite.IsType(&run.RegistryLogin{}, steps[1], name)
+	}
+}
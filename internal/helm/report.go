@@ -0,0 +1,217 @@
+package helm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/mongodb-forks/drone-helm3/internal/run"
+)
+
+// These are variables so the tests can substitute stand-ins.
+var (
+	now           = time.Now
+	releaseStatus = run.ReleaseStatus
+)
+
+// commander is implemented by steps that run a helm command.
+type commander interface {
+	Command() string
+}
+
+// report records the outcome of a Plan for the report_file setting. A nil *report records nothing, so the
+// plan doesn't need to check whether a report was requested.
+type report struct {
+	Status   string          `json:"status"`
+	Error    string          `json:"error,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Duration float64         `json:"duration_seconds"`
+	Steps    []stepReport    `json:"steps"`
+	Releases []releaseReport `json:"releases,omitempty"`
+
+	filename string
+	secrets  []string
+	releases []env.Config // releases whose status should be looked up once the plan finishes
+	lock     sync.Mutex
+}
+
+type stepReport struct {
+	Type     string     `json:"type"`
+	Release  string     `json:"release,omitempty"`
+	Command  string     `json:"command,omitempty"`
+	Status   string     `json:"status"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Duration float64    `json:"duration_seconds"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+type releaseReport struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Revision  int    `json:"revision,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// newReport returns a report for the plan, or nil if the report_file setting is empty.
+func newReport(cfg env.Config) *report {
+	if cfg.ReportFile == "" {
+		return nil
+	}
+
+	r := &report{
+		filename: cfg.ReportFile,
+		secrets:  cfg.Secrets(),
+		Steps:    []stepReport{},
+	}
+	// only installing or rolling back leaves a release whose status is worth reporting
+	if steps := determineSteps(cfg); (steps == &upgrade || steps == &rollback) && !cfg.DryRun {
+		for _, relCfg := range cfg.ReleaseConfigs() {
+			if relCfg.Release != "" {
+				r.releases = append(r.releases, relCfg)
+			}
+		}
+	}
+	return r
+}
+
+// start marks the beginning of the plan's execution.
+func (r *report) start() {
+	if r == nil {
+		return
+	}
+	r.Started = now()
+}
+
+// execute runs a step and records its outcome. A group of parallel steps records its own steps instead.
+func (r *report) execute(release string, step Step) error {
+	if _, ok := step.(*parallelSteps); r == nil || ok {
+		return step.Execute()
+	}
+
+	started := now()
+	err := step.Execute()
+	finished := now()
+
+	sr := r.stepReport(release, step)
+	sr.Started = &started
+	sr.Finished = &finished
+	sr.Duration = finished.Sub(started).Seconds()
+	sr.Status = "succeeded"
+	if sr.Command != "" {
+		exitCode := 0
+		sr.ExitCode = &exitCode
+	}
+	if err != nil {
+		sr.Status = "failed"
+		sr.Error = r.redact(err.Error())
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode := exitErr.ExitCode()
+			sr.ExitCode = &exitCode
+		} else {
+			sr.ExitCode = nil
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Steps = append(r.Steps, sr)
+	return err
+}
+
+// skip records a step that never ran because an earlier one failed.
+func (r *report) skip(release string, step Step) {
+	if r == nil {
+		return
+	}
+	if group, ok := step.(*parallelSteps); ok {
+		for _, seq := range group.sequences {
+			for _, s := range seq.steps {
+				r.skip(seq.name, s)
+			}
+		}
+		return
+	}
+
+	sr := r.stepReport(release, step)
+	sr.Status = "skipped"
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Steps = append(r.Steps, sr)
+}
+
+func (r *report) stepReport(release string, step Step) stepReport {
+	sr := stepReport{
+		Type:    strings.TrimPrefix(fmt.Sprintf("%T", step), "*"),
+		Release: release,
+	}
+	if c, ok := step.(commander); ok {
+		sr.Command = r.redact(c.Command())
+	}
+	return sr
+}
+
+// lookupReleases records the final status of the releases. It must be called before the plan is cleaned up,
+// since that removes the kubeconfig that the lookup needs.
+func (r *report) lookupReleases() {
+	if r == nil {
+		return
+	}
+
+	for _, relCfg := range r.releases {
+		rr := releaseReport{Name: relCfg.Release, Namespace: relCfg.Namespace}
+		info, err := releaseStatus(relCfg)
+		if err != nil {
+			rr.Error = r.redact(err.Error())
+		} else {
+			rr.Namespace = info.Namespace
+			rr.Status = info.Status
+			rr.Revision = info.Revision
+		}
+		r.Releases = append(r.Releases, rr)
+	}
+}
+
+// finish records the plan's outcome and writes the report file.
+func (r *report) finish(planErr error) error {
+	if r == nil {
+		return nil
+	}
+
+	r.Finished = now()
+	r.Duration = r.Finished.Sub(r.Started).Seconds()
+	r.Status = "succeeded"
+	if planErr != nil {
+		r.Status = "failed"
+		r.Error = r.redact(planErr.Error())
+	}
+
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode the report: %w", err)
+	}
+	if err := os.WriteFile(r.filename, append(contents, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write the report: %w", err)
+	}
+	return nil
+}
+
+// redact replaces every secret in s.
+func (r *report) redact(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, env.Redacted)
+	}
+	return s
+}
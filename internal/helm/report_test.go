@@ -0,0 +1,283 @@
+package helm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/mongodb-forks/drone-helm3/internal/run"
+)
+
+type ReportTestSuite struct {
+	suite.Suite
+	ctrl                  *gomock.Controller
+	reportFile            string
+	originalNow           func() time.Time
+	originalReleaseStatus func(env.Config) (run.ReleaseInfo, error)
+}
+
+func TestReportTestSuite(t *testing.T) {
+	suite.Run(t, new(ReportTestSuite))
+}
+
+func (suite *ReportTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.reportFile = filepath.Join(suite.T().TempDir(), "report.json")
+
+	suite.originalNow, suite.originalReleaseStatus = now, releaseStatus
+	clock := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	releaseStatus = func(cfg env.Config) (run.ReleaseInfo, error) {
+		return run.ReleaseInfo{}, fmt.Errorf("release: not found")
+	}
+}
+
+func (suite *ReportTestSuite) AfterTest(_, _ string) {
+	suite.ctrl.Finish()
+	now, releaseStatus = suite.originalNow, suite.originalReleaseStatus
+}
+
+// commandStep is a MockStep that also implements commander.
+type commandStep struct {
+	*MockStep
+	command string
+}
+
+func (c *commandStep) Command() string {
+	return c.command
+}
+
+func (suite *ReportTestSuite) readReport() map[string]interface{} {
+	contents, err := os.ReadFile(suite.reportFile)
+	suite.Require().NoError(err)
+
+	var written map[string]interface{}
+	suite.Require().NoError(json.Unmarshal(contents, &written))
+	return written
+}
+
+func (suite *ReportTestSuite) TestNewReport() {
+	suite.Nil(newReport(env.Config{Command: "upgrade", Release: "accounts"}), "there should be no report without a report_file")
+
+	r := newReport(env.Config{Command: "upgrade", ReportFile: suite.reportFile, Releases: env.Releases{{Release: "accounts"}, {Release: "billing"}}})
+	suite.Require().NotNil(r)
+	suite.Require().Len(r.releases, 2)
+	suite.Equal("accounts", r.releases[0].Release)
+	suite.Equal("billing", r.releases[1].Release)
+
+	r = newReport(env.Config{Command: "rollback", ReportFile: suite.reportFile, Release: "accounts"})
+	suite.Len(r.releases, 1)
+
+	r = newReport(env.Config{Command: "upgrade", ReportFile: suite.reportFile, Release: "accounts", DryRun: true})
+	suite.Empty(r.releases, "a dry run doesn't change the release")
+
+	r = newReport(env.Config{Command: "lint", ReportFile: suite.reportFile, Release: "accounts"})
+	suite.Empty(r.releases, "linting doesn't change the release")
+}
+
+func (suite *ReportTestSuite) TestExecuteWritesReport() {
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+	suite.Require().IsType(&exec.ExitError{}, exitErr)
+
+	stepOne := &commandStep{MockStep: NewMockStep(suite.ctrl), command: "/usr/bin/helm repo add --password hunter2 accounts https://charts.test"}
+	stepTwo := &commandStep{MockStep: NewMockStep(suite.ctrl), command: "/usr/bin/helm upgrade --install accounts ./chart"}
+	stepThree := NewMockStep(suite.ctrl)
+	stepOne.EXPECT().Execute()
+	stepTwo.EXPECT().Execute().Return(exitErr)
+
+	releaseStatus = func(cfg env.Config) (run.ReleaseInfo, error) {
+		suite.Equal("accounts", cfg.Release)
+		return run.ReleaseInfo{Namespace: "payments", Status: "failed", Revision: 4}, nil
+	}
+
+	plan := Plan{
+		steps: []Step{stepOne, stepTwo, stepThree},
+		cfg:   env.Config{Stderr: &strings.Builder{}},
+		report: &report{
+			filename: suite.reportFile,
+			secrets:  []string{"hunter2"},
+			releases: []env.Config{{Release: "accounts"}},
+			Steps:    []stepReport{},
+		},
+	}
+	suite.EqualError(plan.Execute(), "while executing *helm.commandStep step: exit status 3")
+
+	written := suite.readReport()
+	suite.Equal("failed", written["status"])
+	suite.Equal("while executing *helm.commandStep step: exit status 3", written["error"])
+	suite.Equal("2026-10-18T09:00:01Z", written["started"])
+	suite.Equal(float64(5), written["duration_seconds"])
+
+	steps := written["steps"].([]interface{})
+	suite.Require().Len(steps, 3)
+	suite.Equal(map[string]interface{}{
+		"type":             "helm.commandStep",
+		"command":          "/usr/bin/helm repo add --password (redacted) accounts https://charts.test",
+		"status":           "succeeded",
+		"started":          "2026-10-18T09:00:02Z",
+		"finished":         "2026-10-18T09:00:03Z",
+		"duration_seconds": float64(1),
+		"exit_code":        float64(0),
+	}, steps[0])
+	suite.Equal(map[string]interface{}{
+		"type":             "helm.commandStep",
+		"command":          "/usr/bin/helm upgrade --install accounts ./chart",
+		"status":           "failed",
+		"started":          "2026-10-18T09:00:04Z",
+		"finished":         "2026-10-18T09:00:05Z",
+		"duration_seconds": float64(1),
+		"exit_code":        float64(3),
+		"error":            "exit status 3",
+	}, steps[1])
+	suite.Equal(map[string]interface{}{
+		"type":             "helm.MockStep",
+		"status":           "skipped",
+		"duration_seconds": float64(0),
+	}, steps[2])
+
+	suite.Equal([]interface{}{map[string]interface{}{
+		"name":      "accounts",
+		"namespace": "payments",
+		"status":    "failed",
+		"revision":  float64(4),
+	}}, written["releases"])
+}
+
+func (suite *ReportTestSuite) TestExecuteReportsReleaseErrors() {
+	step := NewMockStep(suite.ctrl)
+	step.EXPECT().Execute().Return(errors.New("not a command"))
+
+	plan := Plan{
+		steps: []Step{step},
+		cfg:   env.Config{Stderr: &strings.Builder{}},
+		report: &report{
+			filename: suite.reportFile,
+			releases: []env.Config{{Release: "accounts", Namespace: "payments"}},
+			Steps:    []stepReport{},
+		},
+	}
+	suite.Error(plan.Execute())
+
+	written := suite.readReport()
+	steps := written["steps"].([]interface{})
+	suite.Require().Len(steps, 1)
+	suite.NotContains(steps[0], "exit_code", "a step that doesn't run a command has no exit code")
+	suite.Equal([]interface{}{map[string]interface{}{
+		"name":      "accounts",
+		"namespace": "payments",
+		"error":     "release: not found",
+	}}, written["releases"])
+}
+
+func (suite *ReportTestSuite) TestExecuteReportsParallelSteps() {
+	group := newParallelSteps(env.Config{MaxParallel: 2})
+	failing := &commandStep{MockStep: NewMockStep(suite.ctrl), command: "/usr/bin/helm upgrade --install accounts ./chart"}
+	failing.EXPECT().Execute().Return(errors.New("timed out"))
+	_, accounts := group.sequenceConfig(env.Config{}, "accounts")
+	accounts.steps = []Step{failing, NewMockStep(suite.ctrl)}
+	_, frontend := group.sequenceConfig(env.Config{}, "frontend")
+	frontend.steps = []Step{&commandStep{MockStep: NewMockStep(suite.ctrl), command: "/usr/bin/helm upgrade --install frontend ./chart"}}
+	frontend.dependsOn = []string{"accounts"}
+
+	plan := Plan{
+		steps:  []Step{group},
+		cfg:    env.Config{Stderr: &strings.Builder{}},
+		report: &report{filename: suite.reportFile, Steps: []stepReport{}},
+	}
+	group.report = plan.report
+	suite.Error(plan.Execute())
+
+	written := suite.readReport()
+	steps := written["steps"].([]interface{})
+	suite.Require().Len(steps, 3, "the group's steps should be reported instead of the group")
+
+	statuses := map[string]string{}
+	for _, s := range steps {
+		step := s.(map[string]interface{})
+		statuses[fmt.Sprintf("%s %s", step["release"], step["type"])] = step["status"].(string)
+	}
+	suite.Equal(map[string]string{
+		"accounts helm.commandStep": "failed",
+		"accounts helm.MockStep":    "skipped",
+		"frontend helm.commandStep": "skipped",
+	}, statuses)
+}
+
+func (suite *ReportTestSuite) TestExecuteCannotWriteReport() {
+	step := NewMockStep(suite.ctrl)
+	step.EXPECT().Execute()
+
+	plan := Plan{
+		steps:  []Step{step},
+		report: &report{filename: filepath.Join(suite.T().TempDir(), "missing", "report.json"), Steps: []stepReport{}},
+	}
+	err := plan.Execute()
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not write the report")
+}
+
+func (suite *ReportTestSuite) TestNewPlanWithReportFile() {
+	origHelp := help
+	step := NewMockStep(suite.ctrl)
+	group := newParallelSteps(env.Config{})
+	help = func(cfg env.Config) []Step {
+		return []Step{step, group}
+	}
+	defer func() { help = origHelp }()
+	step.EXPECT().Prepare()
+
+	plan, err := NewPlan(env.Config{Command: "help", ReportFile: suite.reportFile})
+	suite.Require().NoError(err)
+	suite.Require().NotNil(plan.report)
+	suite.Same(plan.report, group.report, "parallel steps should report to the plan's report")
+}
+
+func (suite *ReportTestSuite) TestExecuteLooksUpReleasesBeforeCleanup() {
+	kubeConfig := filepath.Join(suite.T().TempDir(), "config")
+	initKube := run.NewInitKube(env.Config{
+		APIServer: "https://kube.example.com",
+		KubeToken: "b2YgY291cnNlIEkgc3RpbGwgbG92ZSB5b3U=",
+		Stderr:    &strings.Builder{},
+	}, "../../assets/kubeconfig.tpl", kubeConfig) // the actual kubeconfig template
+	suite.Require().NoError(initKube.Prepare())
+
+	releaseStatus = func(cfg env.Config) (run.ReleaseInfo, error) {
+		// the real lookup reads the kubeconfig, which the cleanup removes
+		if _, err := os.Stat(kubeConfig); err != nil {
+			return run.ReleaseInfo{}, err
+		}
+		return run.ReleaseInfo{Namespace: "payments", Status: "deployed", Revision: 5}, nil
+	}
+
+	plan := Plan{
+		steps: []Step{initKube},
+		cfg:   env.Config{Stderr: &strings.Builder{}},
+		report: &report{
+			filename: suite.reportFile,
+			releases: []env.Config{{Release: "accounts"}},
+			Steps:    []stepReport{},
+		},
+	}
+	suite.Require().NoError(plan.Execute())
+	suite.NoFileExists(kubeConfig, "the kubeconfig should still be cleaned up")
+
+	suite.Equal([]interface{}{map[string]interface{}{
+		"name":      "accounts",
+		"namespace": "payments",
+		"status":    "deployed",
+		"revision":  float64(5),
+	}}, suite.readReport()["releases"])
+}
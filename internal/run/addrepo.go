@@ -9,9 +9,14 @@ import (
 // AddRepo is an execution step that calls `helm repo add` when executed.
 type AddRepo struct {
 	*config
-	repo  string
-	certs *repoCerts
-	cmd   cmd
+	repo            string
+	name            string
+	url             string
+	username        string
+	password        string
+	passCredentials bool
+	certs           *repoCerts
+	cmd             cmd
 }
 
 // NewAddRepo creates an AddRepo for the given repo-spec. No validation is performed at this time.
@@ -23,34 +28,83 @@ func NewAddRepo(cfg env.Config, repo string) *AddRepo {
 	}
 }
 
+// NewAddRepoFromSettings creates an AddRepo for an entry in the `repos` setting. No validation is performed at this time.
+func NewAddRepoFromSettings(cfg env.Config, repo env.Repo) *AddRepo {
+	return &AddRepo{
+		config:          newConfig(cfg),
+		name:            repo.Name,
+		url:             repo.URL,
+		username:        repo.Username,
+		password:        repo.Password,
+		passCredentials: repo.PassCredentials,
+		certs:           newRepoCertsFor(cfg, repo),
+	}
+}
+
 // Execute executes the `helm repo add` command.
 func (a *AddRepo) Execute() error {
 	return a.cmd.Run()
 }
 
+// Command returns the helm command that the AddRepo step runs.
+func (a *AddRepo) Command() string {
+	if a.cmd == nil {
+		return ""
+	}
+	return a.cmd.String()
+}
+
+// Cleanup removes the certificate files written during Prepare.
+func (a *AddRepo) Cleanup() error {
+	return a.certs.cleanup()
+}
+
 // Prepare gets the AddRepo ready to execute.
 func (a *AddRepo) Prepare() error {
-	if a.repo == "" {
+	if a.repo != "" {
+		split := strings.SplitN(a.repo, "=", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("bad repo spec '%s'", a.repo)
+		}
+		a.name = split[0]
+		a.url = split[1]
+	} else if a.name == "" && a.url == "" {
 		return fmt.Errorf("repo is required")
 	}
-	split := strings.SplitN(a.repo, "=", 2)
-	if len(split) != 2 {
-		return fmt.Errorf("bad repo spec '%s'", a.repo)
+
+	if a.name == "" {
+		return fmt.Errorf("repo name is required")
+	}
+	if a.url == "" {
+		return fmt.Errorf("url is required for repo '%s'", a.name)
+	}
+	if a.password != "" && a.username == "" {
+		return fmt.Errorf("username is required when a password is given for repo '%s'", a.name)
 	}
 
 	if err := a.certs.write(); err != nil {
 		return err
 	}
 
-	name := split[0]
-	url := split[1]
-
 	args := a.globalFlags()
 	args = append(args, "repo", "add")
 	args = append(args, a.certs.flags()...)
-	args = append(args, name, url)
+	if a.username != "" {
+		args = append(args, "--username", a.username)
+	}
+	if a.password != "" {
+		// the password goes through stdin so it can't show up in a process listing or the debug output
+		args = append(args, "--password-stdin")
+	}
+	if a.passCredentials {
+		args = append(args, "--pass-credentials")
+	}
+	args = append(args, a.name, a.url)
 
 	a.cmd = command(helmBin, args...)
+	if a.password != "" {
+		a.cmd.Stdin(strings.NewReader(a.password))
+	}
 	a.cmd.Stdout(a.stdout)
 	a.cmd.Stderr(a.stderr)
 
@@ -1,6 +1,9 @@
 package run
 
 import (
+	"io"
+	"os"
+
 	"github.com/golang/mock/gomock"
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 	"github.com/stretchr/testify/suite"
@@ -109,4 +112,113 @@ func (suite *AddRepoTestSuite) TestRepoAddFlags() {
 	suite.NoError(a.Prepare())
 	suite.Equal([]string{"repo", "add", "--ca-file", "./helm/reporepo.cert",
 		"machine", "https://github.com/harold_finch/themachine"}, suite.commandArgs)
+	suite.NoError(a.Cleanup(), "cleanup should only remove files that were written during Prepare")
+}
+
+func (suite *AddRepoTestSuite) TestNewAddRepoFromSettings() {
+	cfg := env.Config{
+		RepoCertificate:   "Z2xvYmFsIGNlcnQ=",
+		RepoCACertificate: "Z2xvYmFsIGNhIGNlcnQ=",
+	}
+	repo := NewAddRepoFromSettings(cfg, env.Repo{
+		Name:            "northern_lights",
+		URL:             "https://github.com/root/northern_lights",
+		Username:        "root",
+		Password:        "bear",
+		PassCredentials: true,
+		CACertificate:   "cmVwbyBjYSBjZXJ0",
+	})
+	suite.Require().NotNil(repo)
+	suite.Equal("", repo.repo)
+	suite.Equal("northern_lights", repo.name)
+	suite.Equal("https://github.com/root/northern_lights", repo.url)
+	suite.Equal("root", repo.username)
+	suite.Equal("bear", repo.password)
+	suite.Equal(true, repo.passCredentials)
+	suite.NotNil(repo.config)
+	suite.Require().NotNil(repo.certs)
+	suite.Equal("Z2xvYmFsIGNlcnQ=", repo.certs.cert, "the global certificate should be the default")
+	suite.Equal("cmVwbyBjYSBjZXJ0", repo.certs.caCert, "the repo's own certificate should take precedence")
+}
+
+func (suite *AddRepoTestSuite) TestPrepareWithRepoCerts() {
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	cfg := env.Config{RepoCACertificate: "Z2xvYmFsIGNhIGNlcnQ="}
+	a := NewAddRepoFromSettings(cfg, env.Repo{
+		Name:                  "northern_lights",
+		URL:                   "https://github.com/root/northern_lights",
+		Certificate:           "cmVwbyBjZXJ0",
+		Key:                   "cmVwbyBrZXk=",
+		InsecureSkipTLSVerify: true,
+	})
+
+	suite.Require().NoError(a.Prepare())
+	defer os.Remove(a.certs.certFilename)
+	defer os.Remove(a.certs.keyFilename)
+	defer os.Remove(a.certs.caCertFilename)
+
+	suite.Equal([]string{"repo", "add",
+		"--cert-file", a.certs.certFilename,
+		"--key-file", a.certs.keyFilename,
+		"--ca-file", a.certs.caCertFilename,
+		"--insecure-skip-tls-verify",
+		"northern_lights", "https://github.com/root/northern_lights"}, suite.commandArgs)
+
+	key, err := os.ReadFile(a.certs.keyFilename)
+	suite.Require().NoError(err)
+	suite.Equal("repo key", string(key))
+
+	suite.NoError(a.Cleanup())
+	suite.NoFileExists(a.certs.certFilename)
+	suite.NoFileExists(a.certs.keyFilename)
+	suite.NoFileExists(a.certs.caCertFilename)
+}
+
+func (suite *AddRepoTestSuite) TestPrepareAndExecuteWithCredentials() {
+	a := NewAddRepoFromSettings(env.Config{}, env.Repo{
+		Name:            "northern_lights",
+		URL:             "https://github.com/root/northern_lights",
+		Username:        "root",
+		Password:        "bear",
+		PassCredentials: true,
+	})
+
+	var stdin io.Reader
+	suite.mockCmd.EXPECT().
+		Stdin(gomock.Any()).
+		Do(func(in io.Reader) { stdin = in })
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run()
+
+	suite.Require().NoError(a.Prepare())
+	suite.Equal([]string{"repo", "add",
+		"--username", "root",
+		"--password-stdin",
+		"--pass-credentials",
+		"northern_lights", "https://github.com/root/northern_lights"}, suite.commandArgs)
+	suite.NotContains(suite.commandArgs, "bear")
+
+	password, err := io.ReadAll(stdin)
+	suite.Require().NoError(err)
+	suite.Equal("bear", string(password))
+
+	suite.NoError(a.Execute())
+}
+
+func (suite *AddRepoTestSuite) TestPrepareRepoSettingsAreRequired() {
+	a := NewAddRepoFromSettings(env.Config{}, env.Repo{URL: "https://github.com/root/northern_lights"})
+	suite.EqualError(a.Prepare(), "repo name is required")
+
+	a = NewAddRepoFromSettings(env.Config{}, env.Repo{Name: "northern_lights"})
+	suite.EqualError(a.Prepare(), "url is required for repo 'northern_lights'")
+
+	a = NewAddRepoFromSettings(env.Config{}, env.Repo{
+		Name:     "northern_lights",
+		URL:      "https://github.com/root/northern_lights",
+		Password: "bear",
+	})
+	suite.EqualError(a.Prepare(), "username is required when a password is given for repo 'northern_lights'")
 }
@@ -0,0 +1,98 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// These are variables so the tests can point them at stand-ins.
+var (
+	azureLoginEndpoint    = "https://login.microsoftonline.com"
+	azureMetadataEndpoint = "http://169.254.169.254"
+)
+
+// aksServerApplication is the Azure AD application that AKS clusters with Azure AD integration accept
+// tokens for.
+const aksServerApplication = "6dae42f8-4368-4678-94ff-3960e28e3630"
+
+// aksAuth gets an Azure AD token for an AKS cluster: with a service principal secret or federated token
+// when AZURE_CLIENT_ID and AZURE_TENANT_ID are set, or from the managed identity otherwise. Unlike EKS and
+// GKE, AKS can't describe the cluster with the same token, so kube_api_server must be given.
+func aksAuth(ctx context.Context, cluster *cloudCluster) error {
+	if cluster.apiServer == "" {
+		return fmt.Errorf("kube_api_server is required for the aks auth_provider")
+	}
+
+	var err error
+	clientID, tenantID := os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_TENANT_ID")
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); clientID != "" && tenantID != "" && secret != "" {
+		cluster.token, err = azureClientToken(ctx, tenantID, url.Values{
+			"client_id":     {clientID},
+			"client_secret": {secret},
+		})
+	} else if tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); clientID != "" && tenantID != "" && tokenFile != "" {
+		var assertion []byte
+		if assertion, err = os.ReadFile(tokenFile); err != nil {
+			return fmt.Errorf("could not read federated token: %w", err)
+		}
+		cluster.token, err = azureClientToken(ctx, tenantID, url.Values{
+			"client_id":             {clientID},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		})
+	} else {
+		cluster.token, err = azureManagedIdentityToken(ctx, clientID)
+	}
+	if err != nil {
+		return fmt.Errorf("could not get an Azure AD token: %w", err)
+	}
+	return nil
+}
+
+func azureClientToken(ctx context.Context, tenantID string, form url.Values) (string, error) {
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", aksServerApplication+"/.default")
+
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token", azureLoginEndpoint, url.PathEscape(tenantID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return azureAccessToken(req)
+}
+
+func azureManagedIdentityToken(ctx context.Context, clientID string) (string, error) {
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {aksServerApplication},
+	}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureMetadataEndpoint+"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	return azureAccessToken(req)
+}
+
+func azureAccessToken(req *http.Request) (string, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := getJSON(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("the response had no access token")
+	}
+	return token.AccessToken, nil
+}
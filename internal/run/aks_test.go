@@ -0,0 +1,85 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AKSTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	mux    *http.ServeMux
+
+	originalLogin    string
+	originalMetadata string
+}
+
+func TestAKSTestSuite(t *testing.T) {
+	suite.Run(t, new(AKSTestSuite))
+}
+
+func (suite *AKSTestSuite) SetupTest() {
+	suite.mux = http.NewServeMux()
+	suite.server = httptest.NewServer(suite.mux)
+
+	suite.originalLogin, suite.originalMetadata = azureLoginEndpoint, azureMetadataEndpoint
+	azureLoginEndpoint = suite.server.URL + "/login"
+	azureMetadataEndpoint = suite.server.URL + "/imds"
+
+	for _, name := range []string{"AZURE_CLIENT_ID", "AZURE_TENANT_ID", "AZURE_CLIENT_SECRET", "AZURE_FEDERATED_TOKEN_FILE"} {
+		suite.T().Setenv(name, "")
+	}
+}
+
+func (suite *AKSTestSuite) TearDownTest() {
+	suite.server.Close()
+	azureLoginEndpoint, azureMetadataEndpoint = suite.originalLogin, suite.originalMetadata
+}
+
+func (suite *AKSTestSuite) TestAKSAuthWithClientSecret() {
+	suite.T().Setenv("AZURE_CLIENT_ID", "deployer")
+	suite.T().Setenv("AZURE_TENANT_ID", "contoso")
+	suite.T().Setenv("AZURE_CLIENT_SECRET", "hunter2")
+
+	suite.mux.HandleFunc("/login/contoso/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		suite.Require().NoError(r.ParseForm())
+		suite.Equal("client_credentials", r.PostForm.Get("grant_type"))
+		suite.Equal("deployer", r.PostForm.Get("client_id"))
+		suite.Equal("hunter2", r.PostForm.Get("client_secret"))
+		suite.Equal("6dae42f8-4368-4678-94ff-3960e28e3630/.default", r.PostForm.Get("scope"))
+		fmt.Fprint(w, `{"token_type":"Bearer","expires_in":3599,"access_token":"eyJ.secret"}`)
+	})
+
+	cluster := cloudCluster{apiServer: "https://aks.example.com"}
+	suite.Require().NoError(aksAuth(context.Background(), &cluster))
+	suite.Equal("eyJ.secret", cluster.token)
+}
+
+func (suite *AKSTestSuite) TestAKSAuthWithManagedIdentity() {
+	suite.mux.HandleFunc("/imds/metadata/identity/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		suite.Equal("true", r.Header.Get("Metadata"))
+		suite.Equal("6dae42f8-4368-4678-94ff-3960e28e3630", r.URL.Query().Get("resource"))
+		fmt.Fprint(w, `{"access_token":"eyJ.identity","expires_in":"86399","token_type":"Bearer"}`)
+	})
+
+	cluster := cloudCluster{apiServer: "https://aks.example.com"}
+	suite.Require().NoError(aksAuth(context.Background(), &cluster))
+	suite.Equal("eyJ.identity", cluster.token)
+}
+
+func (suite *AKSTestSuite) TestAKSAuthErrors() {
+	suite.EqualError(aksAuth(context.Background(), &cloudCluster{}), "kube_api_server is required for the aks auth_provider")
+
+	suite.mux.HandleFunc("/imds/metadata/identity/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no identity", http.StatusBadRequest)
+	})
+	err := aksAuth(context.Background(), &cloudCluster{apiServer: "https://aks.example.com"})
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not get an Azure AD token")
+	suite.Contains(err.Error(), "400 Bad Request")
+}
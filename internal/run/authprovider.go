@@ -0,0 +1,67 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// cloudCluster identifies a cloud-managed cluster. An authProvider fills in its token, and its API
+// server and certificate when they weren't configured.
+type cloudCluster struct {
+	name    string
+	region  string
+	project string
+
+	apiServer   string
+	certificate string
+	token       string
+}
+
+// An authProvider gets a bearer token for a cloud-managed cluster from the cloud provider's own
+// credentials, so that no static kube_token is needed.
+type authProvider func(ctx context.Context, cluster *cloudCluster) error
+
+var authProviders = map[string]authProvider{
+	"eks": eksAuth,
+	"gke": gkeAuth,
+	"aks": aksAuth,
+}
+
+// authTimeout limits the time spent talking to the cloud provider.
+const authTimeout = 30 * time.Second
+
+// tokenRefreshAge is the age at which a token from an authProvider is replaced before deploying a release. EKS
+// tokens are accepted for 15 minutes and GKE tokens for an hour, so a refreshed token leaves each release at
+// least 10 minutes to deploy.
+const tokenRefreshAge = 5 * time.Minute
+
+// authNow is a variable so the tests can control the age of tokens.
+var authNow = time.Now
+
+var authHTTPClient = &http.Client{Timeout: authTimeout}
+
+// getJSON sends an HTTP request and decodes its JSON response into out.
+func getJSON(req *http.Request, out interface{}) error {
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Redacted(), resp.Status, body)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("could not parse the response from %s: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
@@ -6,18 +6,20 @@ import (
 )
 
 type config struct {
-	debug     bool
-	namespace string
-	stdout    io.Writer
-	stderr    io.Writer
+	debug       bool
+	namespace   string
+	kubeContext string
+	stdout      io.Writer
+	stderr      io.Writer
 }
 
 func newConfig(cfg env.Config) *config {
 	return &config{
-		debug:     cfg.Debug,
-		namespace: cfg.Namespace,
-		stdout:    cfg.Stdout,
-		stderr:    cfg.Stderr,
+		debug:       cfg.Debug,
+		namespace:   cfg.Namespace,
+		kubeContext: cfg.KubeContext,
+		stdout:      cfg.Stdout,
+		stderr:      cfg.Stderr,
 	}
 }
 
@@ -29,5 +31,17 @@ func (cfg *config) globalFlags() []string {
 	if cfg.namespace != "" {
 		flags = append(flags, "--namespace", cfg.namespace)
 	}
+	if cfg.kubeContext != "" {
+		flags = append(flags, "--kube-context", cfg.kubeContext)
+	}
+	return flags
+}
+
+// setFlags repeats the flag, such as --set, before each of the values.
+func setFlags(flag string, values []string) []string {
+	flags := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		flags = append(flags, flag, value)
+	}
 	return flags
 }
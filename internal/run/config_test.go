@@ -42,6 +42,13 @@ func (suite *ConfigTestSuite) TestGlobalFlags() {
 	flags := cfg.globalFlags()
 	suite.Equal([]string{"--debug", "--namespace", "public"}, flags)
 
+	cfg = config{
+		namespace:   "public",
+		kubeContext: "production",
+	}
+	flags = cfg.globalFlags()
+	suite.Equal([]string{"--namespace", "public", "--kube-context", "production"}, flags)
+
 	cfg = config{}
 	flags = cfg.globalFlags()
 	suite.Equal([]string{}, flags)
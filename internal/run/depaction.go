@@ -30,15 +30,34 @@ func NewDepAction(cfg env.Config) *DepAction {
 
 // Execute executes the `helm upgrade` command.
 func (d *DepAction) Execute() error {
+  if d.cmd == nil {
+    return nil
+  }
   return d.cmd.Run()
 }
 
+// Command returns the helm command that the DepAction step runs.
+func (d *DepAction) Command() string {
+  if d.cmd == nil {
+    return ""
+  }
+  return d.cmd.String()
+}
+
 // Prepare gets the DepAction ready to execute.
 func (d *DepAction) Prepare() error {
   if d.chart == "" {
     return fmt.Errorf("chart is required")
   }
 
+  if isOCI(d.chart) {
+    // charts in a registry are packaged along with their dependencies
+    if d.debug {
+      fmt.Fprintf(d.stderr, "skipping dependencies of %s, which is in an OCI registry\n", d.chart)
+    }
+    return nil
+  }
+
   args := d.globalFlags()
 
   if d.action != actionBuild && d.action != actionUpdate {
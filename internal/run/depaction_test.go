@@ -129,3 +129,25 @@ func (suite *DepActionTestSuite) TestPrepareChartRequired() {
   err := d.Prepare()
   suite.EqualError(err, "chart is required")
 }
+
+func (suite *DepActionTestSuite) TestPrepareAndExecuteOCIChart() {
+  defer suite.ctrl.Finish()
+
+  stderr := strings.Builder{}
+  cfg := env.Config{
+    Chart:              "oci://registry.example.com/charts/your_top_songs_2019",
+    DependenciesAction: "build",
+    Debug:              true,
+    Stderr:             &stderr,
+  }
+
+  command = func(path string, args ...string) cmd {
+    suite.Fail("dependencies of a chart in an OCI registry should not be fetched")
+    return suite.mockCmd
+  }
+
+  d := NewDepAction(cfg)
+  suite.Require().NoError(d.Prepare())
+  suite.NoError(d.Execute())
+  suite.Equal("skipping dependencies of oci://registry.example.com/charts/your_top_songs_2019, which is in an OCI registry\n", stderr.String())
+}
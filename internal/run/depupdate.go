@@ -22,15 +22,34 @@ func NewDepUpdate(cfg env.Config) *DepUpdate {
 
 // Execute executes the `helm upgrade` command.
 func (d *DepUpdate) Execute() error {
+	if d.cmd == nil {
+		return nil
+	}
 	return d.cmd.Run()
 }
 
+// Command returns the helm command that the DepUpdate step runs.
+func (d *DepUpdate) Command() string {
+	if d.cmd == nil {
+		return ""
+	}
+	return d.cmd.String()
+}
+
 // Prepare gets the DepUpdate ready to execute.
 func (d *DepUpdate) Prepare() error {
 	if d.chart == "" {
 		return fmt.Errorf("chart is required")
 	}
 
+	if isOCI(d.chart) {
+		// charts in a registry are packaged along with their dependencies
+		if d.debug {
+			fmt.Fprintf(d.stderr, "skipping dependencies of %s, which is in an OCI registry\n", d.chart)
+		}
+		return nil
+	}
+
 	args := d.globalFlags()
 	args = append(args, "dependency", "update", d.chart)
 
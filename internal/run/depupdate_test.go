@@ -79,3 +79,16 @@ func (suite *DepUpdateTestSuite) TestPrepareChartRequired() {
 	err := d.Prepare()
 	suite.EqualError(err, "chart is required")
 }
+
+func (suite *DepUpdateTestSuite) TestPrepareAndExecuteOCIChart() {
+	defer suite.ctrl.Finish()
+
+	command = func(path string, args ...string) cmd {
+		suite.Fail("dependencies of a chart in an OCI registry should not be updated")
+		return suite.mockCmd
+	}
+
+	d := NewDepUpdate(env.Config{Chart: "oci://registry.example.com/charts/scatterplot"})
+	suite.Require().NoError(d.Prepare())
+	suite.NoError(d.Execute())
+}
@@ -0,0 +1,189 @@
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/pmezard/go-difflib/difflib"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var manifestSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+
+// Diff is an execution step that compares the manifest of a deployed release with the manifest
+// rendered from the configured chart, printing a unified diff for each resource that changed.
+type Diff struct {
+	*config
+	release  string
+	template *Template
+
+	deployed  bytes.Buffer
+	rendered  bytes.Buffer
+	getErrors bytes.Buffer
+
+	cmd cmd
+}
+
+// NewDiff creates a Diff using fields from the given Config. No validation is performed at this time.
+func NewDiff(cfg env.Config) *Diff {
+	d := &Diff{
+		config:  newConfig(cfg),
+		release: cfg.Release,
+	}
+
+	// The rendered manifest is captured rather than printed, so it can be compared to the deployed one. The
+	// deployed manifest has no hooks or tests, so they're left out of the rendered one too.
+	renderCfg := cfg
+	renderCfg.Stdout = &d.rendered
+	renderCfg.TemplateOutput = ""
+	d.template = NewTemplate(renderCfg)
+	d.template.noHooks = true
+
+	return d
+}
+
+// Execute fetches the deployed manifest, renders the chart, and prints the differences.
+func (d *Diff) Execute() error {
+	if err := d.cmd.Run(); err != nil {
+		if !strings.Contains(d.getErrors.String(), "release: not found") {
+			return fmt.Errorf("could not get the manifest of release '%s': %w: %s", d.release, err, d.getErrors.String())
+		}
+		if d.debug {
+			fmt.Fprintf(d.stderr, "release %s is not deployed yet; every resource will be reported as added\n", d.release)
+		}
+		d.deployed.Reset()
+	}
+
+	if err := d.template.Execute(); err != nil {
+		return fmt.Errorf("could not render chart: %w", err)
+	}
+
+	return d.printDiff()
+}
+
+// Command returns the helm command that the Diff step runs.
+func (d *Diff) Command() string {
+	if d.cmd == nil {
+		return ""
+	}
+	return d.cmd.String()
+}
+
+// Cleanup removes the files left behind by rendering the chart.
+func (d *Diff) Cleanup() error {
+	return d.template.Cleanup()
+}
+
+// Prepare gets the Diff ready to execute.
+func (d *Diff) Prepare() error {
+	if d.release == "" {
+		return fmt.Errorf("release is required")
+	}
+
+	if err := d.template.Prepare(); err != nil {
+		return err
+	}
+
+	args := d.globalFlags()
+	args = append(args, "get", "manifest", d.release)
+
+	d.cmd = command(helmBin, args...)
+	d.cmd.Stdout(&d.deployed)
+	d.cmd.Stderr(&d.getErrors)
+
+	if d.debug {
+		fmt.Fprintf(d.stderr, "Generated command: '%s'\n", d.cmd.String())
+	}
+
+	return nil
+}
+
+func (d *Diff) printDiff() error {
+	deployed, err := splitManifest(d.deployed.String())
+	if err != nil {
+		return fmt.Errorf("could not parse the deployed manifest: %w", err)
+	}
+	rendered, err := splitManifest(d.rendered.String())
+	if err != nil {
+		return fmt.Errorf("could not parse the rendered manifest: %w", err)
+	}
+
+	keys := make([]string, 0, len(deployed)+len(rendered))
+	for key := range deployed {
+		keys = append(keys, key)
+	}
+	for key := range rendered {
+		if _, ok := deployed[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changed := 0
+	for _, key := range keys {
+		before, after := deployed[key], rendered[key]
+		if before == after {
+			continue
+		}
+		changed++
+
+		text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(before),
+			B:        difflib.SplitLines(after),
+			FromFile: key + " (deployed)",
+			ToFile:   key + " (rendered)",
+			Context:  3,
+		})
+		if err != nil {
+			return fmt.Errorf("could not diff %s: %w", key, err)
+		}
+		fmt.Fprintln(d.stdout, text)
+	}
+
+	if changed == 0 {
+		fmt.Fprintf(d.stdout, "Release %s has no changes\n", d.release)
+	} else {
+		fmt.Fprintf(d.stdout, "Release %s has %d changed resource(s)\n", d.release, changed)
+	}
+
+	return nil
+}
+
+// splitManifest breaks a multi-document manifest into its resources, keyed by kind, namespace and name. Hooks
+// are left out, since helm doesn't keep them in the release's manifest.
+func splitManifest(manifest string) (map[string]string, error) {
+	resources := make(map[string]string)
+
+	for _, doc := range manifestSeparator.Split(manifest, -1) {
+		var meta struct {
+			Kind     string `yaml:"kind"`
+			Metadata struct {
+				Name        string            `yaml:"name"`
+				Namespace   string            `yaml:"namespace"`
+				Annotations map[string]string `yaml:"annotations"`
+			} `yaml:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &meta); err != nil {
+			return nil, err
+		}
+		if meta.Kind == "" {
+			// nothing but comments or whitespace
+			continue
+		}
+		if _, ok := meta.Metadata.Annotations["helm.sh/hook"]; ok {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s", meta.Kind, meta.Metadata.Name)
+		if meta.Metadata.Namespace != "" {
+			key = fmt.Sprintf("%s/%s/%s", meta.Kind, meta.Metadata.Namespace, meta.Metadata.Name)
+		}
+		resources[key] = strings.TrimSpace(doc) + "\n"
+	}
+
+	return resources, nil
+}
@@ -0,0 +1,272 @@
+package run
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+const deployedManifest = `---
+# Source: mychart/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: ballad
+spec:
+  port: 80
+---
+# Source: mychart/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: chorus
+data:
+  verse: one
+`
+
+const renderedManifest = `---
+# Source: mychart/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: ballad
+spec:
+  port: 8080
+---
+# Source: mychart/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: chorus
+data:
+  verse: one
+---
+# Source: mychart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bridge
+  namespace: encore
+`
+
+const hookManifests = `---
+# Source: mychart/templates/migrate.yaml
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    "helm.sh/hook": pre-upgrade
+---
+# Source: mychart/templates/tests/test-connection.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-connection
+  annotations:
+    helm.sh/hook: test
+`
+
+type DiffTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	getCmd          *Mockcmd
+	templateCmd     *Mockcmd
+	getArgs         []string
+	templateArgs    []string
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *DiffTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.getCmd = NewMockcmd(suite.ctrl)
+	suite.templateCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd {
+		for _, arg := range args {
+			if arg == "template" {
+				suite.templateArgs = args
+				return suite.templateCmd
+			}
+		}
+		suite.getArgs = args
+		return suite.getCmd
+	}
+}
+
+func (suite *DiffTestSuite) AfterTest(_, _ string) {
+	suite.ctrl.Finish()
+	command = suite.originalCommand
+}
+
+func TestDiffTestSuite(t *testing.T) {
+	suite.Run(t, new(DiffTestSuite))
+}
+
+// expectOutput makes the mock write the given text to whatever writer it was given with Stdout or Stderr.
+func (suite *DiffTestSuite) expectOutput(mock *Mockcmd, stdout, stderr string, runErr error) {
+	var outWriter, errWriter io.Writer
+	mock.EXPECT().
+		Stdout(gomock.Any()).
+		Do(func(w io.Writer) { outWriter = w })
+	mock.EXPECT().
+		Stderr(gomock.Any()).
+		Do(func(w io.Writer) { errWriter = w })
+	mock.EXPECT().
+		Run().
+		DoAndReturn(func() error {
+			if stdout != "" {
+				_, _ = io.WriteString(outWriter, stdout)
+			}
+			if stderr != "" {
+				_, _ = io.WriteString(errWriter, stderr)
+			}
+			return runErr
+		})
+}
+
+func (suite *DiffTestSuite) TestNewDiff() {
+	cfg := env.Config{
+		Chart:          "billboard_hot_100",
+		Release:        "lizzo_good_as_hell",
+		Values:         env.Values{"steadfastness", "forthrightness"},
+		TemplateOutput: "/tmp/manifests.yaml",
+	}
+
+	d := NewDiff(cfg)
+	suite.Equal("lizzo_good_as_hell", d.release)
+	suite.NotNil(d.config)
+	suite.Require().NotNil(d.template)
+	suite.Equal("billboard_hot_100", d.template.chart)
+	suite.Equal([]string{"steadfastness", "forthrightness"}, d.template.values)
+	suite.Equal("", d.template.outputFilename, "the rendered manifest should not be written to a file")
+	suite.Equal(&d.rendered, d.template.stdout)
+	suite.True(d.template.noHooks, "hooks should be left out of the rendered manifest")
+}
+
+func (suite *DiffTestSuite) TestPrepareAndExecute() {
+	stdout := strings.Builder{}
+	cfg := env.Config{
+		Chart:     "at40",
+		Release:   "billie_eilish_bad_guy",
+		Namespace: "charts",
+		Stdout:    &stdout,
+	}
+	d := NewDiff(cfg)
+
+	suite.expectOutput(suite.getCmd, deployedManifest, "", nil)
+	suite.expectOutput(suite.templateCmd, renderedManifest, "", nil)
+
+	suite.Require().NoError(d.Prepare())
+	suite.Equal([]string{"--namespace", "charts", "get", "manifest", "billie_eilish_bad_guy"}, suite.getArgs)
+	suite.Equal([]string{"--namespace", "charts", "template", "--no-hooks", "--skip-tests", "billie_eilish_bad_guy", "at40"}, suite.templateArgs)
+
+	suite.Require().NoError(d.Execute())
+
+	output := stdout.String()
+	suite.Contains(output, "--- Service/ballad (deployed)\n+++ Service/ballad (rendered)\n")
+	suite.Contains(output, "-  port: 80\n+  port: 8080\n")
+	suite.Contains(output, "+++ Deployment/encore/bridge (rendered)\n")
+	suite.NotContains(output, "ConfigMap/chorus")
+	suite.Contains(output, "Release billie_eilish_bad_guy has 2 changed resource(s)\n")
+}
+
+func (suite *DiffTestSuite) TestExecuteWithoutChanges() {
+	stdout := strings.Builder{}
+	cfg := env.Config{
+		Chart:   "at40",
+		Release: "billie_eilish_bad_guy",
+		Stdout:  &stdout,
+	}
+	d := NewDiff(cfg)
+
+	suite.expectOutput(suite.getCmd, deployedManifest, "", nil)
+	suite.expectOutput(suite.templateCmd, deployedManifest, "", nil)
+
+	suite.Require().NoError(d.Prepare())
+	suite.Require().NoError(d.Execute())
+	suite.Equal("Release billie_eilish_bad_guy has no changes\n", stdout.String())
+}
+
+func (suite *DiffTestSuite) TestExecuteIgnoresHooks() {
+	stdout := strings.Builder{}
+	cfg := env.Config{
+		Chart:   "at40",
+		Release: "billie_eilish_bad_guy",
+		Stdout:  &stdout,
+	}
+	d := NewDiff(cfg)
+
+	// `helm get manifest` leaves hooks out, so they shouldn't count as added
+	suite.expectOutput(suite.getCmd, deployedManifest, "", nil)
+	suite.expectOutput(suite.templateCmd, deployedManifest+hookManifests, "", nil)
+
+	suite.Require().NoError(d.Prepare())
+	suite.Require().NoError(d.Execute())
+	suite.Equal("Release billie_eilish_bad_guy has no changes\n", stdout.String())
+}
+
+func (suite *DiffTestSuite) TestExecuteWithNewRelease() {
+	stdout := strings.Builder{}
+	cfg := env.Config{
+		Chart:   "at40",
+		Release: "billie_eilish_bad_guy",
+		Stdout:  &stdout,
+	}
+	d := NewDiff(cfg)
+
+	suite.expectOutput(suite.getCmd, "", "Error: release: not found\n", errors.New("exit status 1"))
+	suite.expectOutput(suite.templateCmd, renderedManifest, "", nil)
+
+	suite.Require().NoError(d.Prepare())
+	suite.Require().NoError(d.Execute())
+	suite.Contains(stdout.String(), "Release billie_eilish_bad_guy has 3 changed resource(s)\n")
+}
+
+func (suite *DiffTestSuite) TestExecuteGetManifestError() {
+	cfg := env.Config{
+		Chart:   "at40",
+		Release: "billie_eilish_bad_guy",
+	}
+	d := NewDiff(cfg)
+
+	suite.expectOutput(suite.getCmd, "", "Error: Kubernetes cluster unreachable\n", errors.New("exit status 1"))
+	suite.templateCmd.EXPECT().Stdout(gomock.Any())
+	suite.templateCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(d.Prepare())
+	err := d.Execute()
+	suite.EqualError(err, "could not get the manifest of release 'billie_eilish_bad_guy': exit status 1: Error: Kubernetes cluster unreachable\n")
+}
+
+func (suite *DiffTestSuite) TestPrepareRequiresRelease() {
+	// These aren't really expected, but allowing them gives clearer test-failure messages
+	suite.getCmd.EXPECT().Stdout(gomock.Any()).AnyTimes()
+	suite.getCmd.EXPECT().Stderr(gomock.Any()).AnyTimes()
+
+	d := NewDiff(env.Config{Chart: "at40"})
+	suite.EqualError(d.Prepare(), "release is required")
+}
+
+func (suite *DiffTestSuite) TestSplitManifest() {
+	resources, err := splitManifest(renderedManifest)
+	suite.Require().NoError(err)
+	suite.Len(resources, 3)
+	suite.Contains(resources, "Service/ballad")
+	suite.Contains(resources, "ConfigMap/chorus")
+	suite.Contains(resources, "Deployment/encore/bridge")
+
+	resources, err = splitManifest(hookManifests)
+	suite.Require().NoError(err)
+	suite.Len(resources, 0, "hooks and tests aren't part of the release's manifest")
+
+	resources, err = splitManifest("---\n# Source: mychart/templates/empty.yaml\n")
+	suite.Require().NoError(err)
+	suite.Len(resources, 0)
+}
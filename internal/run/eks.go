@@ -0,0 +1,394 @@
+package run
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// These are variables so the tests can point them at stand-ins.
+var (
+	stsEndpoint = func(region string) string {
+		return fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+	}
+	eksEndpoint = func(region string) string {
+		return fmt.Sprintf("https://eks.%s.amazonaws.com", region)
+	}
+	awsMetadataEndpoint  = "http://169.254.169.254"
+	awsContainerEndpoint = "http://169.254.170.2"
+	awsNow               = time.Now
+)
+
+const (
+	// eksTokenPrefix marks a bearer token as a presigned STS request, for the aws-iam-authenticator
+	// built into EKS.
+	eksTokenPrefix = "k8s-aws-v1."
+	// eksClusterHeader names the cluster in the presigned request, so the token can't be used elsewhere.
+	eksClusterHeader = "x-k8s-aws-id"
+)
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// eksAuth gets a token for an EKS cluster by presigning an STS GetCallerIdentity request, the same way
+// `aws eks get-token` does. The cluster's endpoint and certificate are looked up if they weren't given.
+func eksAuth(ctx context.Context, cluster *cloudCluster) error {
+	if cluster.name == "" {
+		return fmt.Errorf("cluster_name is required for the eks auth_provider")
+	}
+	region := cluster.region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return fmt.Errorf("cluster_region is required for the eks auth_provider")
+	}
+
+	creds, err := awsCredentialsFromEnvironment(ctx, region)
+	if err != nil {
+		return fmt.Errorf("could not get AWS credentials: %w", err)
+	}
+
+	if cluster.token, err = eksToken(creds, region, cluster.name); err != nil {
+		return err
+	}
+
+	if cluster.apiServer == "" {
+		if err := describeEKSCluster(ctx, creds, region, cluster); err != nil {
+			return fmt.Errorf("could not describe EKS cluster '%s': %w", cluster.name, err)
+		}
+	}
+	return nil
+}
+
+func eksToken(creds awsCredentials, region, clusterName string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, stsEndpoint(region)+"/?Action=GetCallerIdentity&Version=2011-06-15", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(eksClusterHeader, clusterName)
+	presignV4(req, creds, region, "sts", awsNow(), 60*time.Second)
+
+	return eksTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(req.URL.String())), nil
+}
+
+func describeEKSCluster(ctx context.Context, creds awsCredentials, region string, cluster *cloudCluster) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, eksEndpoint(region)+"/clusters/"+url.PathEscape(cluster.name), nil)
+	if err != nil {
+		return err
+	}
+	signV4(req, creds, region, "eks", awsNow())
+
+	var described struct {
+		Cluster struct {
+			Endpoint             string `json:"endpoint"`
+			CertificateAuthority struct {
+				Data string `json:"data"`
+			} `json:"certificateAuthority"`
+		} `json:"cluster"`
+	}
+	if err := getJSON(req, &described); err != nil {
+		return err
+	}
+
+	cluster.apiServer = described.Cluster.Endpoint
+	if cluster.certificate == "" {
+		cluster.certificate = described.Cluster.CertificateAuthority.Data
+	}
+	return nil
+}
+
+// awsCredentialsFromEnvironment looks for credentials in the same places as the AWS SDKs: environment
+// variables, a web identity token (e.g. IAM roles for service accounts), the ECS container endpoint,
+// and finally the EC2 instance metadata service.
+func awsCredentialsFromEnvironment(ctx context.Context, region string) (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	if tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && role != "" {
+		return assumeRoleWithWebIdentity(ctx, region, tokenFile, role)
+	}
+
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return awsContainerCredentials(ctx)
+	}
+
+	return awsInstanceCredentials(ctx)
+}
+
+func assumeRoleWithWebIdentity(ctx context.Context, region, tokenFile, role string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("could not read web identity token: %w", err)
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("drone-helm3-%d", awsNow().Unix())
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint(region)+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("AssumeRoleWithWebIdentity returned %s: %s", resp.Status, body)
+	}
+
+	var assumed struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string `xml:"SecretAccessKey"`
+			SessionToken    string `xml:"SessionToken"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &assumed); err != nil {
+		return awsCredentials{}, fmt.Errorf("could not parse AssumeRoleWithWebIdentity response: %w", err)
+	}
+	return awsCredentials(assumed.Credentials), nil
+}
+
+// awsMetadataCredentials is the response from both the ECS and EC2 credential endpoints.
+type awsMetadataCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+func (c awsMetadataCredentials) credentials() awsCredentials {
+	return awsCredentials{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.Token,
+	}
+}
+
+func awsContainerCredentials(ctx context.Context) (awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = awsContainerEndpoint + relative
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if auth := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	var creds awsMetadataCredentials
+	if err := getJSON(req, &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	return creds.credentials(), nil
+}
+
+// awsInstanceCredentials gets the credentials of the EC2 instance's role, using IMDSv2.
+func awsInstanceCredentials(ctx context.Context) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	session, err := readMetadata(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no credentials in the environment, and the instance metadata service is unavailable: %w", err)
+	}
+
+	rolesURL := awsMetadataEndpoint + "/latest/meta-data/iam/security-credentials/"
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, rolesURL, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", session)
+	roles, err := readMetadata(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("could not find the instance's role: %w", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, fmt.Errorf("the instance has no role")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, rolesURL+url.PathEscape(role), nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", session)
+
+	var creds awsMetadataCredentials
+	if err := getJSON(req, &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	return creds.credentials(), nil
+}
+
+func readMetadata(req *http.Request) (string, error) {
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s returned %s", req.Method, req.URL, resp.Status)
+	}
+	return string(body), nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to a request without a body.
+func signV4(req *http.Request, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	scope, signedHeaders, signature := sigV4(req, creds, region, service, amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// presignV4 adds an AWS Signature Version 4 signature to a request's query string, so that the URL can be
+// used without any credentials until it expires. Headers on the request are included in the signature.
+func presignV4(req *http.Request, creds awsCredentials, region, service string, now time.Time, expires time.Duration) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", fmt.Sprintf("%s/%s", creds.AccessKeyID, sigV4Scope(amzDate, region, service)))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", strings.Join(sigV4HeaderNames(req), ";"))
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	req.URL.RawQuery = sigV4Query(query)
+
+	_, _, signature := sigV4(req, creds, region, service, amzDate)
+	req.URL.RawQuery += "&X-Amz-Signature=" + signature
+}
+
+func sigV4(req *http.Request, creds awsCredentials, region, service, amzDate string) (scope, signedHeaders, signature string) {
+	scope = sigV4Scope(amzDate, region, service)
+	names := sigV4HeaderNames(req)
+
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.Join(req.Header.Values(name), ",")
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	emptyPayload := sha256.Sum256(nil)
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		sigV4Query(req.URL.Query()),
+		headers.String(),
+		strings.Join(names, ";"),
+		hex.EncodeToString(emptyPayload[:]),
+	}, "\n")
+
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hashed[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return scope, strings.Join(names, ";"), hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func sigV4Scope(amzDate, region, service string) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", amzDate[:8], region, service)
+}
+
+// sigV4HeaderNames returns the sorted, lower-case names of the request's headers, plus the host.
+func sigV4HeaderNames(req *http.Request) []string {
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sigV4Query encodes a query string the way SigV4 requires: sorted, with spaces as %20.
+func sigV4Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, sigV4Escape(key)+"="+sigV4Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sigV4Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,204 @@
+package run
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type EKSTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	mux    *http.ServeMux
+
+	originalSTS       func(string) string
+	originalEKS       func(string) string
+	originalMetadata  string
+	originalContainer string
+	originalNow       func() time.Time
+}
+
+func TestEKSTestSuite(t *testing.T) {
+	suite.Run(t, new(EKSTestSuite))
+}
+
+func (suite *EKSTestSuite) SetupTest() {
+	suite.mux = http.NewServeMux()
+	suite.server = httptest.NewServer(suite.mux)
+
+	suite.originalSTS, suite.originalEKS = stsEndpoint, eksEndpoint
+	suite.originalMetadata, suite.originalContainer = awsMetadataEndpoint, awsContainerEndpoint
+	suite.originalNow = awsNow
+
+	stsEndpoint = func(region string) string { return suite.server.URL + "/sts/" + region }
+	eksEndpoint = func(region string) string { return suite.server.URL + "/eks/" + region }
+	awsMetadataEndpoint = suite.server.URL + "/imds"
+	awsContainerEndpoint = suite.server.URL + "/ecs"
+	awsNow = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_REGION", "AWS_DEFAULT_REGION",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_AUTHORIZATION_TOKEN"} {
+		suite.T().Setenv(name, "")
+	}
+}
+
+func (suite *EKSTestSuite) TearDownTest() {
+	suite.server.Close()
+	stsEndpoint, eksEndpoint = suite.originalSTS, suite.originalEKS
+	awsMetadataEndpoint, awsContainerEndpoint = suite.originalMetadata, suite.originalContainer
+	awsNow = suite.originalNow
+}
+
+func (suite *EKSTestSuite) TestSignV4() {
+	// The example from AWS's Signature Version 4 documentation
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	suite.Require().NoError(err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, creds, "us-east-1", "iam", awsNow())
+
+	suite.Equal("20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	suite.Equal("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+}
+
+func (suite *EKSTestSuite) TestEKSToken() {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", SessionToken: "sessiontoken"}
+	token, err := eksToken(creds, "us-west-2", "peanut")
+	suite.Require().NoError(err)
+	suite.Require().True(strings.HasPrefix(token, "k8s-aws-v1."))
+
+	rawURL, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, "k8s-aws-v1."))
+	suite.Require().NoError(err)
+	presigned, err := url.Parse(string(rawURL))
+	suite.Require().NoError(err)
+
+	query := presigned.Query()
+	suite.Equal("/sts/us-west-2/", presigned.Path)
+	suite.Equal("GetCallerIdentity", query.Get("Action"))
+	suite.Equal("AWS4-HMAC-SHA256", query.Get("X-Amz-Algorithm"))
+	suite.Equal("AKIDEXAMPLE/20150830/us-west-2/sts/aws4_request", query.Get("X-Amz-Credential"))
+	suite.Equal("20150830T123600Z", query.Get("X-Amz-Date"))
+	suite.Equal("60", query.Get("X-Amz-Expires"))
+	suite.Equal("host;x-k8s-aws-id", query.Get("X-Amz-SignedHeaders"))
+	suite.Equal("sessiontoken", query.Get("X-Amz-Security-Token"))
+	suite.True(strings.HasSuffix(presigned.RawQuery, "&X-Amz-Signature="+query.Get("X-Amz-Signature")),
+		"the signature should come last, after the parameters it signs")
+
+	// STS checks the signature over the rest of the URL and the cluster header
+	signature := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+	presigned.RawQuery = query.Encode()
+	check, err := http.NewRequest(http.MethodGet, presigned.String(), nil)
+	suite.Require().NoError(err)
+	check.Header.Set("x-k8s-aws-id", "peanut")
+	_, _, expected := sigV4(check, creds, "us-west-2", "sts", "20150830T123600Z")
+	suite.Equal(expected, signature)
+}
+
+func (suite *EKSTestSuite) TestEKSAuthDescribesCluster() {
+	suite.T().Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	suite.T().Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	suite.T().Setenv("AWS_REGION", "eu-west-1")
+
+	suite.mux.HandleFunc("/eks/eu-west-1/clusters/peanut", func(w http.ResponseWriter, r *http.Request) {
+		suite.True(strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/eu-west-1/eks/aws4_request"))
+		fmt.Fprint(w, `{"cluster":{"name":"peanut","endpoint":"https://PEANUT.gr7.eu-west-1.eks.amazonaws.com","certificateAuthority":{"data":"Y2VydGlmaWVk"}}}`)
+	})
+
+	cluster := cloudCluster{name: "peanut"}
+	suite.Require().NoError(eksAuth(context.Background(), &cluster))
+	suite.Equal("https://PEANUT.gr7.eu-west-1.eks.amazonaws.com", cluster.apiServer)
+	suite.Equal("Y2VydGlmaWVk", cluster.certificate)
+	suite.True(strings.HasPrefix(cluster.token, "k8s-aws-v1."))
+}
+
+func (suite *EKSTestSuite) TestEKSAuthKeepsConfiguredServer() {
+	suite.T().Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	suite.T().Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+
+	cluster := cloudCluster{name: "peanut", region: "eu-west-1", apiServer: "https://kube.cluster/peanut"}
+	suite.Require().NoError(eksAuth(context.Background(), &cluster), "the cluster shouldn't be described")
+	suite.Equal("https://kube.cluster/peanut", cluster.apiServer)
+	suite.NotEqual("", cluster.token)
+}
+
+func (suite *EKSTestSuite) TestEKSAuthRequiredSettings() {
+	suite.EqualError(eksAuth(context.Background(), &cloudCluster{region: "eu-west-1"}), "cluster_name is required for the eks auth_provider")
+	suite.EqualError(eksAuth(context.Background(), &cloudCluster{name: "peanut"}), "cluster_region is required for the eks auth_provider")
+}
+
+func (suite *EKSTestSuite) TestInstanceCredentials() {
+	suite.mux.HandleFunc("/imds/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		suite.Equal(http.MethodPut, r.Method)
+		fmt.Fprint(w, "imds-session")
+	})
+	suite.mux.HandleFunc("/imds/latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		suite.Equal("imds-session", r.Header.Get("X-aws-ec2-metadata-token"))
+		switch r.URL.Path {
+		case "/imds/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "drone-runner\n")
+		case "/imds/latest/meta-data/iam/security-credentials/drone-runner":
+			fmt.Fprint(w, `{"Code":"Success","AccessKeyId":"ASIAINSTANCE","SecretAccessKey":"instancesecret","Token":"instancetoken"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	creds, err := awsCredentialsFromEnvironment(context.Background(), "eu-west-1")
+	suite.Require().NoError(err)
+	suite.Equal(awsCredentials{AccessKeyID: "ASIAINSTANCE", SecretAccessKey: "instancesecret", SessionToken: "instancetoken"}, creds)
+}
+
+func (suite *EKSTestSuite) TestContainerCredentials() {
+	suite.T().Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/abc")
+	suite.mux.HandleFunc("/ecs/v2/credentials/abc", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"AccessKeyId":"ASIACONTAINER","SecretAccessKey":"containersecret","Token":"containertoken"}`)
+	})
+
+	creds, err := awsCredentialsFromEnvironment(context.Background(), "eu-west-1")
+	suite.Require().NoError(err)
+	suite.Equal(awsCredentials{AccessKeyID: "ASIACONTAINER", SecretAccessKey: "containersecret", SessionToken: "containertoken"}, creds)
+}
+
+func (suite *EKSTestSuite) TestWebIdentityCredentials() {
+	tokenFile, err := tempfile("token********", "projected-token\n")
+	suite.Require().NoError(err)
+	defer os.Remove(tokenFile.Name())
+
+	suite.T().Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile.Name())
+	suite.T().Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/deployer")
+	suite.mux.HandleFunc("/sts/eu-west-1/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		suite.Equal("AssumeRoleWithWebIdentity", form.Get("Action"))
+		suite.Equal("arn:aws:iam::123456789012:role/deployer", form.Get("RoleArn"))
+		suite.Equal("projected-token", form.Get("WebIdentityToken"))
+		fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAWEBIDENTITY</AccessKeyId>
+      <SecretAccessKey>websecret</SecretAccessKey>
+      <SessionToken>webtoken</SessionToken>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`)
+	})
+
+	creds, err := awsCredentialsFromEnvironment(context.Background(), "eu-west-1")
+	suite.Require().NoError(err)
+	suite.Equal(awsCredentials{AccessKeyID: "ASIAWEBIDENTITY", SecretAccessKey: "websecret", SessionToken: "webtoken"}, creds)
+}
@@ -0,0 +1,73 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2/google"
+)
+
+// gkeEndpoint is a variable so the tests can point it at a stand-in.
+var gkeEndpoint = "https://container.googleapis.com"
+
+const gkeScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gkeAuth gets a token for a GKE cluster from Google's application default credentials: a service
+// account key named by GOOGLE_APPLICATION_CREDENTIALS, or the metadata server when running on GCP. The
+// cluster's endpoint and certificate are looked up if they weren't given.
+func gkeAuth(ctx context.Context, cluster *cloudCluster) error {
+	creds, err := google.FindDefaultCredentials(ctx, gkeScope)
+	if err != nil {
+		return fmt.Errorf("could not get Google credentials: %w", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return fmt.Errorf("could not get a Google access token: %w", err)
+	}
+	cluster.token = token.AccessToken
+
+	if cluster.apiServer != "" {
+		return nil
+	}
+
+	project := cluster.project
+	if project == "" {
+		project = creds.ProjectID
+	}
+	if cluster.name == "" || cluster.region == "" || project == "" {
+		return fmt.Errorf("cluster_name, cluster_region and cluster_project are required for the gke auth_provider unless kube_api_server is set")
+	}
+
+	if err := describeGKECluster(ctx, token.AccessToken, project, cluster); err != nil {
+		return fmt.Errorf("could not describe GKE cluster '%s': %w", cluster.name, err)
+	}
+	return nil
+}
+
+func describeGKECluster(ctx context.Context, token, project string, cluster *cloudCluster) error {
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/locations/%s/clusters/%s", gkeEndpoint,
+		url.PathEscape(project), url.PathEscape(cluster.region), url.PathEscape(cluster.name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	var described struct {
+		Endpoint   string `json:"endpoint"`
+		MasterAuth struct {
+			ClusterCACertificate string `json:"clusterCaCertificate"`
+		} `json:"masterAuth"`
+	}
+	if err := getJSON(req, &described); err != nil {
+		return err
+	}
+
+	cluster.apiServer = "https://" + described.Endpoint
+	if cluster.certificate == "" {
+		cluster.certificate = described.MasterAuth.ClusterCACertificate
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type GKETestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	mux    *http.ServeMux
+
+	originalEndpoint string
+}
+
+func TestGKETestSuite(t *testing.T) {
+	suite.Run(t, new(GKETestSuite))
+}
+
+// SetupTest starts a stand-in for both the GCE metadata server and the GKE API.
+func (suite *GKETestSuite) SetupTest() {
+	suite.mux = http.NewServeMux()
+	suite.server = httptest.NewServer(suite.mux)
+
+	suite.originalEndpoint = gkeEndpoint
+	gkeEndpoint = suite.server.URL + "/gke"
+
+	suite.T().Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	suite.T().Setenv("HOME", suite.T().TempDir()) // no gcloud application_default_credentials.json
+	suite.T().Setenv("GCE_METADATA_HOST", strings.TrimPrefix(suite.server.URL, "http://"))
+
+	suite.mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
+		suite.Equal("Google", r.Header.Get("Metadata-Flavor"))
+		fmt.Fprint(w, `{"access_token":"ya29.metadata","expires_in":3599,"token_type":"Bearer"}`)
+	})
+	suite.mux.HandleFunc("/computeMetadata/v1/project/project-id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "middle-earth")
+	})
+}
+
+func (suite *GKETestSuite) TearDownTest() {
+	suite.server.Close()
+	gkeEndpoint = suite.originalEndpoint
+}
+
+func (suite *GKETestSuite) TestGKEAuthDescribesCluster() {
+	suite.mux.HandleFunc("/gke/v1/projects/middle-earth/locations/europe-west1/clusters/shire", func(w http.ResponseWriter, r *http.Request) {
+		suite.Equal("Bearer ya29.metadata", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"name":"shire","endpoint":"203.0.113.7","masterAuth":{"clusterCaCertificate":"Y2VydGlmaWVk"}}`)
+	})
+
+	cluster := cloudCluster{name: "shire", region: "europe-west1"}
+	suite.Require().NoError(gkeAuth(context.Background(), &cluster), "the project should default to the metadata server's")
+	suite.Equal("ya29.metadata", cluster.token)
+	suite.Equal("https://203.0.113.7", cluster.apiServer)
+	suite.Equal("Y2VydGlmaWVk", cluster.certificate)
+}
+
+func (suite *GKETestSuite) TestGKEAuthKeepsConfiguredServer() {
+	cluster := cloudCluster{apiServer: "https://kube.cluster/shire", certificate: "b3VyIG93bg=="}
+	suite.Require().NoError(gkeAuth(context.Background(), &cluster))
+	suite.Equal("ya29.metadata", cluster.token)
+	suite.Equal("https://kube.cluster/shire", cluster.apiServer)
+	suite.Equal("b3VyIG93bg==", cluster.certificate)
+}
+
+func (suite *GKETestSuite) TestGKEAuthRequiresCluster() {
+	cluster := cloudCluster{region: "europe-west1"}
+	suite.EqualError(gkeAuth(context.Background(), &cluster),
+		"cluster_name, cluster_region and cluster_project are required for the gke auth_provider unless kube_api_server is set")
+}
@@ -32,6 +32,14 @@ func (h *Help) Execute() error {
 	return fmt.Errorf("unknown command '%s'", h.helmCommand)
 }
 
+// Command returns the helm command that the Help step runs.
+func (h *Help) Command() string {
+	if h.cmd == nil {
+		return ""
+	}
+	return h.cmd.String()
+}
+
 // Prepare gets the Help ready to execute.
 func (h *Help) Prepare() error {
 	args := h.globalFlags()
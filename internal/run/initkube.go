@@ -1,12 +1,22 @@
 package run
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/mongodb-forks/drone-helm3/internal/env"
+	yaml "gopkg.in/yaml.v2"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 // InitKube is a step in a helm Plan that initializes the kubernetes config file.
@@ -16,33 +26,83 @@ type InitKube struct {
 	configFilename   string
 	template         *template.Template
 	configFile       io.WriteCloser
+	created          bool // whether Prepare opened the config file, and Cleanup should remove it
 	values           kubeValues
+	kubeConfig       string // a complete kubeconfig to write instead of rendering the template
+	kubeContext      string
+	clusters         env.Clusters
+	rawConfig        []byte
+	authProvider     string
+	cluster          cloudCluster
+	authenticated    time.Time  // when the token came from the authProvider
+	lock             sync.Mutex // for refreshing the token while releases deploy in parallel
 }
 
 type kubeValues struct {
-	SkipTLSVerify  bool
-	Certificate    string
-	APIServer      string
-	Namespace      string
-	ServiceAccount string
-	Token          string
+	SkipTLSVerify     bool
+	Certificate       string
+	APIServer         string
+	Namespace         string
+	ServiceAccount    string
+	Token             string
+	TokenFile         string
+	Exec              *env.KubeExec
+	ClientCertificate string
+	ClientKey         string
+	Clusters          []kubeCluster // every cluster in the kubeconfig; one named "helm" unless clusters are configured
+	CurrentContext    string
 }
 
+// kubeCluster is a cluster in the kubeconfig, along with its context and user.
+type kubeCluster struct {
+	Name              string
+	SkipTLSVerify     bool
+	Certificate       string
+	APIServer         string
+	Namespace         string
+	User              string
+	Token             string
+	TokenFile         string
+	Exec              *env.KubeExec
+	ClientCertificate string
+	ClientKey         string
+}
+
+// clusterName limits cluster names to characters that are safe to put in the kubeconfig unquoted.
+var clusterName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
 // NewInitKube creates a InitKube using the given Config and filepaths. No validation is performed at this time.
 func NewInitKube(cfg env.Config, templateFile, configFile string) *InitKube {
-	return &InitKube{
+	init := &InitKube{
 		config: newConfig(cfg),
 		values: kubeValues{
-			SkipTLSVerify:  cfg.SkipTLSVerify,
-			Certificate:    cfg.Certificate,
-			APIServer:      cfg.APIServer,
-			Namespace:      cfg.Namespace,
-			ServiceAccount: cfg.ServiceAccount,
-			Token:          cfg.KubeToken,
+			SkipTLSVerify:     cfg.SkipTLSVerify,
+			Certificate:       cfg.Certificate,
+			APIServer:         cfg.APIServer,
+			Namespace:         cfg.Namespace,
+			ServiceAccount:    cfg.ServiceAccount,
+			Token:             cfg.KubeToken,
+			TokenFile:         cfg.KubeTokenFile,
+			ClientCertificate: cfg.KubeClientCertificate,
+			ClientKey:         cfg.KubeClientKey,
 		},
 		templateFilename: templateFile,
 		configFilename:   configFile,
+		kubeConfig:       cfg.KubeConfig,
+		kubeContext:      cfg.KubeContext,
+		clusters:         cfg.Clusters,
+		authProvider:     cfg.AuthProvider,
+		cluster: cloudCluster{
+			name:    cfg.ClusterName,
+			region:  cfg.ClusterRegion,
+			project: cfg.ClusterProject,
+		},
+	}
+	if cfg.KubeExec.Command != "" || len(cfg.KubeExec.Args) > 0 || len(cfg.KubeExec.Env) > 0 || cfg.KubeExec.APIVersion != "" {
+		exec := cfg.KubeExec
+		init.values.Exec = &exec
 	}
+	return init
 }
 
 // Execute generates a kubernetes config file from drone-helm3's template.
@@ -51,6 +111,10 @@ func (i *InitKube) Execute() error {
 		fmt.Fprintf(i.stderr, "writing kubeconfig file to %s\n", i.configFilename)
 	}
 	defer i.configFile.Close()
+	if i.rawConfig != nil {
+		_, err := i.configFile.Write(i.rawConfig)
+		return err
+	}
 	return i.template.Execute(i.configFile, i.values)
 }
 
@@ -58,23 +122,72 @@ func (i *InitKube) Execute() error {
 func (i *InitKube) Prepare() error {
 	var err error
 
-	if i.values.APIServer == "" {
-		return errors.New("an API Server is needed to deploy")
-	}
-	if i.values.Token == "" {
-		return errors.New("token is needed to deploy")
-	}
+	if i.kubeConfig != "" {
+		if i.authProvider != "" {
+			return errors.New("auth_provider can't be used with kube_config")
+		}
+		if i.rawConfig, err = parseKubeConfig(i.kubeConfig, i.kubeContext); err != nil {
+			return err
+		}
+	} else if len(i.clusters) > 0 {
+		if err := i.prepareClusters(); err != nil {
+			return err
+		}
+	} else {
+		if i.kubeContext != "" {
+			return errors.New("kube_context can only be used with kube_config or clusters")
+		}
+		if i.authProvider != "" {
+			if err := i.authenticate(); err != nil {
+				return err
+			}
+		}
+		if i.values.APIServer == "" {
+			return errors.New("an API Server is needed to deploy")
+		}
+		if (i.values.ClientCertificate == "") != (i.values.ClientKey == "") {
+			return errors.New("kube_client_certificate and kube_client_key must be provided together")
+		}
+		if i.values.Exec != nil {
+			if i.values.Exec.Command == "" {
+				return errors.New("kube_exec requires a command")
+			}
+			if i.values.Exec.APIVersion == "" {
+				i.values.Exec.APIVersion = "client.authentication.k8s.io/v1beta1"
+			}
+		}
+		if i.values.Token == "" && i.values.TokenFile == "" && i.values.Exec == nil && i.values.ClientCertificate == "" {
+			return errors.New("a token, token file, exec credential or client certificate is needed to deploy")
+		}
 
-	if i.values.ServiceAccount == "" {
-		i.values.ServiceAccount = "helm"
-	}
+		if i.values.ServiceAccount == "" {
+			i.values.ServiceAccount = "helm"
+		}
 
-	if i.debug {
-		fmt.Fprintf(i.stderr, "loading kubeconfig template from %s\n", i.templateFilename)
+		i.values.Clusters = []kubeCluster{{
+			Name:              "helm",
+			SkipTLSVerify:     i.values.SkipTLSVerify,
+			Certificate:       i.values.Certificate,
+			APIServer:         i.values.APIServer,
+			Namespace:         i.values.Namespace,
+			User:              i.values.ServiceAccount,
+			Token:             i.values.Token,
+			TokenFile:         i.values.TokenFile,
+			Exec:              i.values.Exec,
+			ClientCertificate: i.values.ClientCertificate,
+			ClientKey:         i.values.ClientKey,
+		}}
+		i.values.CurrentContext = "helm"
 	}
-	i.template, err = template.ParseFiles(i.templateFilename)
-	if err != nil {
-		return fmt.Errorf("could not load kubeconfig template: %w", err)
+
+	if i.rawConfig == nil {
+		if i.debug {
+			fmt.Fprintf(i.stderr, "loading kubeconfig template from %s\n", i.templateFilename)
+		}
+		i.template, err = template.ParseFiles(i.templateFilename)
+		if err != nil {
+			return fmt.Errorf("could not load kubeconfig template: %w", err)
+		}
 	}
 
 	if i.debug {
@@ -87,9 +200,203 @@ func (i *InitKube) Prepare() error {
 		fmt.Fprintf(i.stderr, "kubeconfig file at %s\n", i.configFilename)
 	}
 
-	i.configFile, err = os.Create(i.configFilename)
+	// the kubeconfig contains credentials, so it should only be readable by its owner
+	file, err := os.OpenFile(i.configFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("could not open kubeconfig file for writing: %w", err)
 	}
+	i.configFile = file
+	i.created = true
+	if err := file.Chmod(0600); err != nil {
+		return fmt.Errorf("could not restrict kubeconfig file permissions: %w", err)
+	}
 	return nil
 }
+
+// prepareClusters validates the configured clusters and gives each one a context and user of the same name.
+// The current-context is the kube_context, or the first cluster.
+func (i *InitKube) prepareClusters() error {
+	if i.authProvider != "" {
+		return errors.New("auth_provider can't be used with clusters")
+	}
+
+	i.values.Clusters = make([]kubeCluster, 0, len(i.clusters))
+	names := map[string]bool{}
+	for n, cluster := range i.clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("cluster %d has no name", n+1)
+		}
+		if !clusterName.MatchString(cluster.Name) {
+			return fmt.Errorf("cluster name '%s' may only contain letters, digits, '.', '_' and '-'", cluster.Name)
+		}
+		if names[cluster.Name] {
+			return fmt.Errorf("cluster '%s' is listed more than once", cluster.Name)
+		}
+		names[cluster.Name] = true
+		if cluster.APIServer == "" {
+			return fmt.Errorf("cluster '%s' needs an api_server", cluster.Name)
+		}
+		if cluster.Token == "" {
+			return fmt.Errorf("cluster '%s' needs a token", cluster.Name)
+		}
+
+		i.values.Clusters = append(i.values.Clusters, kubeCluster{
+			Name:          cluster.Name,
+			SkipTLSVerify: cluster.SkipTLSVerify,
+			Certificate:   cluster.Certificate,
+			APIServer:     cluster.APIServer,
+			Namespace:     i.values.Namespace,
+			User:          cluster.Name,
+			Token:         cluster.Token,
+		})
+	}
+
+	i.values.CurrentContext = i.clusters[0].Name
+	if i.kubeContext != "" {
+		if !names[i.kubeContext] {
+			return fmt.Errorf("kube_context '%s' is not in the clusters", i.kubeContext)
+		}
+		i.values.CurrentContext = i.kubeContext
+	}
+	return nil
+}
+
+// authenticate gets a token from the auth_provider, along with the cluster's API server and certificate
+// if they weren't configured.
+func (i *InitKube) authenticate() error {
+	provider, ok := authProviders[i.authProvider]
+	if !ok {
+		return fmt.Errorf("unknown auth_provider '%s'; valid options are eks, gke and aks", i.authProvider)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	cluster := i.cluster
+	cluster.apiServer = i.values.APIServer
+	cluster.certificate = i.values.Certificate
+	if err := provider(ctx, &cluster); err != nil {
+		return fmt.Errorf("%s auth_provider: %w", i.authProvider, err)
+	}
+	// the token is as good as a password until it expires, so it mustn't turn up in helm's output
+	env.AddSecrets(i.stdout, []string{cluster.token})
+	env.AddSecrets(i.stderr, []string{cluster.token})
+
+	if i.debug {
+		fmt.Fprintf(i.stderr, "got a token for %s from the %s auth_provider\n", cluster.apiServer, i.authProvider)
+	}
+	i.values.APIServer = cluster.apiServer
+	i.values.Certificate = cluster.certificate
+	i.values.Token = cluster.token
+	i.authenticated = authNow()
+	return nil
+}
+
+// refresh gets a new token from the auth_provider and rewrites the kubeconfig with it, unless the token is still
+// fresh or didn't come from an auth_provider in the first place, as when the kubeconfig wasn't rendered from the
+// template. The kubeconfig is replaced rather than rewritten in place, so
+// that helm commands running in parallel never read half of it.
+func (i *InitKube) refresh() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.template == nil || i.authenticated.IsZero() || !i.created || authNow().Sub(i.authenticated) < tokenRefreshAge {
+		return nil
+	}
+	if err := i.authenticate(); err != nil {
+		return err
+	}
+	i.values.Clusters[0].Token = i.values.Token
+
+	var rendered bytes.Buffer
+	if err := i.template.Execute(&rendered, i.values); err != nil {
+		return err
+	}
+
+	if i.debug {
+		fmt.Fprintf(i.stderr, "rewriting kubeconfig file %s with the new token\n", i.configFilename)
+	}
+	// CreateTemp makes the file readable only by its owner, like the kubeconfig it replaces
+	file, err := os.CreateTemp(filepath.Dir(i.configFilename), ".kubeconfig")
+	if err != nil {
+		return fmt.Errorf("could not create kubeconfig file: %w", err)
+	}
+	_, err = file.Write(rendered.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), i.configFilename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("could not rewrite kubeconfig file: %w", err)
+	}
+	return nil
+}
+
+// Cleanup removes the kubeconfig file, since it contains credentials.
+func (i *InitKube) Cleanup() error {
+	if !i.created {
+		return nil
+	}
+
+	if i.debug {
+		fmt.Fprintf(i.stderr, "removing kubeconfig file %s\n", i.configFilename)
+	}
+	if err := os.Remove(i.configFilename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not remove kubeconfig file: %w", err)
+	}
+	i.created = false
+	return nil
+}
+
+// parseKubeConfig decodes a kubeconfig given as raw YAML or base64. The kubeconfig is returned verbatim
+// unless a context is given, in which case it becomes the current-context.
+func parseKubeConfig(kubeConfig, context string) ([]byte, error) {
+	raw := []byte(kubeConfig)
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(kubeConfig)); err == nil {
+		raw = decoded
+	}
+
+	var parsed yaml.MapSlice
+	if err := yaml.Unmarshal(raw, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse kube_config: %w", err)
+	}
+
+	if context == "" {
+		return raw, nil
+	}
+
+	var contexts struct {
+		Contexts []struct {
+			Name string `yaml:"name"`
+		} `yaml:"contexts"`
+	}
+	if err := yaml.Unmarshal(raw, &contexts); err != nil {
+		return nil, fmt.Errorf("could not parse kube_config contexts: %w", err)
+	}
+	found := false
+	for _, c := range contexts.Contexts {
+		if c.Name == context {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("kube_context '%s' is not in the kube_config", context)
+	}
+
+	replaced := false
+	for n, item := range parsed {
+		if item.Key == "current-context" {
+			parsed[n].Value = context
+			replaced = true
+		}
+	}
+	if !replaced {
+		parsed = append(parsed, yaml.MapItem{Key: "current-context", Value: context})
+	}
+
+	return yaml.Marshal(parsed)
+}
@@ -1,6 +1,8 @@
 package run
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strings"
@@ -132,6 +134,223 @@ func (suite *InitKubeTestSuite) TestExecuteGeneratesConfig() {
 	suite.NoError(yaml.UnmarshalStrict(contents, &conf))
 }
 
+func (suite *InitKubeTestSuite) TestExecuteGeneratesConfigWithClientCertificate() {
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	defer os.Remove(configFile.Name())
+	suite.Require().NoError(err)
+
+	cfg := env.Config{
+		APIServer:             "https://kube.cluster/peanut",
+		KubeClientCertificate: "Y2VydGlmaWVkIGZyZXNo",
+		KubeClientKey:         "a2V5IGxpbWU=",
+	}
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", configFile.Name()) // the actual kubeconfig template
+	suite.Require().NoError(init.Prepare(), "a token shouldn't be needed with a client certificate")
+	suite.Require().NoError(init.Execute())
+
+	contents, err := os.ReadFile(configFile.Name())
+	suite.Require().NoError(err)
+
+	suite.Contains(string(contents), "client-certificate-data: Y2VydGlmaWVkIGZyZXNo")
+	suite.Contains(string(contents), "client-key-data: a2V5IGxpbWU=")
+	suite.NotContains(string(contents), "token:")
+
+	conf := map[string]interface{}{}
+	suite.NoError(yaml.UnmarshalStrict(contents, &conf))
+}
+
+func (suite *InitKubeTestSuite) TestExecuteGeneratesConfigWithTokenFile() {
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	defer os.Remove(configFile.Name())
+	suite.Require().NoError(err)
+
+	cfg := env.Config{
+		APIServer:     "https://kube.cluster/peanut",
+		KubeTokenFile: "/var/run/secrets/tokens/ci-token",
+	}
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", configFile.Name()) // the actual kubeconfig template
+	suite.Require().NoError(init.Prepare(), "a token shouldn't be needed with a token file")
+	suite.Require().NoError(init.Execute())
+
+	contents, err := os.ReadFile(configFile.Name())
+	suite.Require().NoError(err)
+
+	var conf struct {
+		Users []struct {
+			User map[string]interface{} `yaml:"user"`
+		} `yaml:"users"`
+	}
+	suite.Require().NoError(yaml.Unmarshal(contents, &conf))
+	suite.Require().Len(conf.Users, 1)
+	suite.Equal(map[string]interface{}{"tokenFile": "/var/run/secrets/tokens/ci-token"}, conf.Users[0].User)
+}
+
+func (suite *InitKubeTestSuite) TestExecuteGeneratesConfigWithExec() {
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	defer os.Remove(configFile.Name())
+	suite.Require().NoError(err)
+
+	cfg := env.Config{
+		APIServer: "https://kube.cluster/peanut",
+		KubeExec: env.KubeExec{
+			Command: "aws",
+			Args:    []string{"eks", "get-token", "--cluster-name", "peanut: gallery"},
+			Env:     []env.KubeExecEnv{{Name: "AWS_PROFILE", Value: "ci"}},
+		},
+	}
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", configFile.Name()) // the actual kubeconfig template
+	suite.Require().NoError(init.Prepare(), "a token shouldn't be needed with an exec credential")
+	suite.Require().NoError(init.Execute())
+
+	contents, err := os.ReadFile(configFile.Name())
+	suite.Require().NoError(err)
+
+	strict := map[string]interface{}{}
+	suite.Require().NoError(yaml.UnmarshalStrict(contents, &strict))
+
+	var conf struct {
+		Users []struct {
+			User struct {
+				Exec struct {
+					APIVersion      string   `yaml:"apiVersion"`
+					Command         string   `yaml:"command"`
+					Args            []string `yaml:"args"`
+					InteractiveMode string   `yaml:"interactiveMode"`
+					Env             []struct {
+						Name  string `yaml:"name"`
+						Value string `yaml:"value"`
+					} `yaml:"env"`
+				} `yaml:"exec"`
+			} `yaml:"user"`
+		} `yaml:"users"`
+	}
+	suite.Require().NoError(yaml.Unmarshal(contents, &conf))
+	suite.Require().Len(conf.Users, 1)
+	exec := conf.Users[0].User.Exec
+	suite.Equal("client.authentication.k8s.io/v1beta1", exec.APIVersion)
+	suite.Equal("aws", exec.Command)
+	suite.Equal([]string{"eks", "get-token", "--cluster-name", "peanut: gallery"}, exec.Args)
+	suite.Require().Len(exec.Env, 1)
+	suite.Equal("AWS_PROFILE", exec.Env[0].Name)
+	suite.Equal("ci", exec.Env[0].Value)
+	suite.Equal("", exec.InteractiveMode)
+
+	init.values.Exec.APIVersion = "client.authentication.k8s.io/v1"
+	suite.Require().NoError(init.Prepare())
+	suite.Require().NoError(init.Execute())
+	contents, err = os.ReadFile(configFile.Name())
+	suite.Require().NoError(err)
+	suite.Contains(string(contents), "interactiveMode: Never", "the v1 API requires an interactive mode")
+}
+
+func (suite *InitKubeTestSuite) TestPrepareExecRequiresCommand() {
+	cfg := env.Config{
+		APIServer: "https://kube.cluster/peanut",
+		KubeExec:  env.KubeExec{Args: []string{"get-token"}},
+	}
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", "conf.yml")
+	suite.EqualError(init.Prepare(), "kube_exec requires a command")
+}
+
+func (suite *InitKubeTestSuite) TestPrepareWithAuthProvider() {
+	original := authProviders["eks"]
+	defer func() { authProviders["eks"] = original }()
+	authProviders["eks"] = func(ctx context.Context, cluster *cloudCluster) error {
+		suite.Equal("peanut", cluster.name)
+		suite.Equal("eu-west-1", cluster.region)
+		cluster.apiServer = "https://peanut.eks.amazonaws.com"
+		cluster.certificate = "Y2VydGlmaWVk"
+		cluster.token = "k8s-aws-v1.presigned"
+		return nil
+	}
+
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	defer os.Remove(configFile.Name())
+	suite.Require().NoError(err)
+
+	cfg := env.Config{
+		AuthProvider:  "eks",
+		ClusterName:   "peanut",
+		ClusterRegion: "eu-west-1",
+	}
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", configFile.Name())
+	suite.Require().NoError(init.Prepare(), "the API server and token should come from the auth provider")
+	suite.Equal("https://peanut.eks.amazonaws.com", init.values.APIServer)
+	suite.Equal("Y2VydGlmaWVk", init.values.Certificate)
+	suite.Equal("k8s-aws-v1.presigned", init.values.Token)
+}
+
+func (suite *InitKubeTestSuite) TestPrepareWithAuthProviderMasksToken() {
+	original := authProviders["gke"]
+	defer func() { authProviders["gke"] = original }()
+	authProviders["gke"] = func(ctx context.Context, cluster *cloudCluster) error {
+		cluster.apiServer = "https://34.1.2.3"
+		cluster.token = "ya29.peanut-butter"
+		return nil
+	}
+
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	defer os.Remove(configFile.Name())
+	suite.Require().NoError(err)
+
+	suite.T().Setenv("PLUGIN_AUTH_PROVIDER", "gke")
+	stdout, stderr := &strings.Builder{}, &strings.Builder{}
+	cfg, err := env.NewConfig(stdout, stderr)
+	suite.Require().NoError(err)
+	init := NewInitKube(*cfg, "../../assets/kubeconfig.tpl", configFile.Name())
+	suite.Require().NoError(init.Prepare())
+
+	fmt.Fprintln(cfg.Stdout, "Authorization: Bearer ya29.peanut-butter")
+	fmt.Fprintln(cfg.Stderr, "Error: token ya29.peanut-butter rejected")
+	cfg.Flush()
+	suite.Equal("Authorization: Bearer (redacted)\n", stdout.String(), "the token should be masked in helm's output")
+	suite.Contains(stderr.String(), "Error: token (redacted) rejected")
+	suite.NotContains(stderr.String(), "peanut-butter")
+}
+
+func (suite *InitKubeTestSuite) TestPrepareWithUnknownAuthProvider() {
+	init := NewInitKube(env.Config{AuthProvider: "digitalocean"}, "conf.tpl", "conf.yml")
+	suite.EqualError(init.Prepare(), "unknown auth_provider 'digitalocean'; valid options are eks, gke and aks")
+}
+
+func (suite *InitKubeTestSuite) TestCleanupRemovesConfig() {
+	templateFile, err := tempfile("kubeconfig********.yml.tpl", "token: {{ .Token }}")
+	defer os.Remove(templateFile.Name())
+	suite.Require().Nil(err)
+
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	defer os.Remove(configFile.Name())
+	suite.Require().Nil(err)
+	suite.Require().NoError(os.Chmod(configFile.Name(), 0644))
+
+	cfg := env.Config{
+		APIServer: "Sysadmin",
+		KubeToken: "Aspire virtual currency",
+	}
+	init := NewInitKube(cfg, templateFile.Name(), configFile.Name())
+	suite.Require().NoError(init.Prepare())
+	suite.Require().NoError(init.Execute())
+
+	info, err := os.Stat(configFile.Name())
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm(), "the kubeconfig should only be readable by its owner")
+
+	suite.NoError(init.Cleanup())
+	suite.NoFileExists(configFile.Name())
+}
+
+func (suite *InitKubeTestSuite) TestCleanupWithoutPrepare() {
+	configFile, err := tempfile("kubeconfig********.yml", "not mine")
+	defer os.Remove(configFile.Name())
+	suite.Require().Nil(err)
+
+	init := NewInitKube(env.Config{}, "conf.tpl", configFile.Name())
+	suite.Error(init.Prepare())
+
+	suite.NoError(init.Cleanup())
+	suite.FileExists(configFile.Name(), "a kubeconfig that InitKube didn't write should be left alone")
+}
+
 func (suite *InitKubeTestSuite) TestPrepareParseError() {
 	templateFile, err := tempfile("kubeconfig********.yml.tpl", `{{ NonexistentFunction }}`)
 	defer os.Remove(templateFile.Name())
@@ -200,7 +419,13 @@ func (suite *InitKubeTestSuite) TestPrepareRequiredConfig() {
 
 	init.values.APIServer = "Sysadmin"
 	init.values.Token = ""
-	suite.Error(init.Prepare(), "Token should be required.")
+	suite.EqualError(init.Prepare(), "a token, token file, exec credential or client certificate is needed to deploy")
+
+	init.values.ClientCertificate = "Y2VydGlmaWVkIGZyZXNo"
+	suite.EqualError(init.Prepare(), "kube_client_certificate and kube_client_key must be provided together")
+
+	init.values.ClientKey = "a2V5IGxpbWU="
+	suite.NoError(init.Prepare(), "a client certificate should be enough without a token")
 }
 
 func (suite *InitKubeTestSuite) TestPrepareDefaultsServiceAccount() {
@@ -252,6 +477,208 @@ func (suite *InitKubeTestSuite) TestDebugOutput() {
 	suite.Contains(stderr.String(), fmt.Sprintf("writing kubeconfig file to %s\n", configFile.Name()))
 }
 
+const rawKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://kube.example.com
+  name: example
+contexts:
+- context:
+    cluster: example
+    user: ci
+  name: staging
+- context:
+    cluster: example
+    user: ci
+  name: production
+current-context: staging
+users:
+- name: ci
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: kubectl-login
+`
+
+func (suite *InitKubeTestSuite) TestPrepareExecuteKubeConfig() {
+	for name, kubeConfig := range map[string]string{
+		"raw":    rawKubeConfig,
+		"base64": base64.StdEncoding.EncodeToString([]byte(rawKubeConfig)),
+	} {
+		configFile, err := tempfile("kubeconfig********.yml", "")
+		suite.Require().Nil(err)
+		defer os.Remove(configFile.Name())
+
+		cfg := env.Config{
+			KubeConfig: kubeConfig,
+		}
+		init := NewInitKube(cfg, "/does/not/exist.tpl", configFile.Name())
+		suite.Require().NoError(init.Prepare(), "neither the template nor the api server and token should be needed (%s)", name)
+		suite.Require().NoError(init.Execute())
+
+		conf, err := os.ReadFile(configFile.Name())
+		suite.Require().NoError(err)
+		suite.Equal(rawKubeConfig, string(conf), "the %s kube_config should be written verbatim", name)
+	}
+}
+
+func (suite *InitKubeTestSuite) TestPrepareExecuteKubeContext() {
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	suite.Require().Nil(err)
+	defer os.Remove(configFile.Name())
+
+	cfg := env.Config{
+		KubeConfig:  rawKubeConfig,
+		KubeContext: "production",
+	}
+	init := NewInitKube(cfg, "/does/not/exist.tpl", configFile.Name())
+	suite.Require().NoError(init.Prepare())
+	suite.Require().NoError(init.Execute())
+
+	conf, err := os.ReadFile(configFile.Name())
+	suite.Require().NoError(err)
+
+	var written struct {
+		CurrentContext string `yaml:"current-context"`
+		Users          []struct {
+			Name string `yaml:"name"`
+		} `yaml:"users"`
+	}
+	suite.Require().NoError(yaml.Unmarshal(conf, &written))
+	suite.Equal("production", written.CurrentContext)
+	suite.Require().Len(written.Users, 1, "the rest of the kubeconfig should be unchanged")
+	suite.Equal("ci", written.Users[0].Name)
+}
+
+func (suite *InitKubeTestSuite) TestPrepareKubeConfigErrors() {
+	init := NewInitKube(env.Config{KubeConfig: rawKubeConfig, KubeContext: "development"}, "conf.tpl", "conf.yml")
+	suite.EqualError(init.Prepare(), "kube_context 'development' is not in the kube_config")
+
+	init = NewInitKube(env.Config{KubeConfig: "clusters: [: nope"}, "conf.tpl", "conf.yml")
+	err := init.Prepare()
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not parse kube_config")
+
+	init = NewInitKube(env.Config{KubeConfig: rawKubeConfig, AuthProvider: "eks"}, "conf.tpl", "conf.yml")
+	suite.EqualError(init.Prepare(), "auth_provider can't be used with kube_config")
+
+	init = NewInitKube(env.Config{APIServer: "Sysadmin", KubeToken: "Aspire", KubeContext: "production"}, "conf.tpl", "conf.yml")
+	suite.EqualError(init.Prepare(), "kube_context can only be used with kube_config or clusters")
+}
+
+func (suite *InitKubeTestSuite) TestExecuteGeneratesConfigWithClusters() {
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	suite.Require().NoError(err)
+	defer os.Remove(configFile.Name())
+
+	cfg := env.Config{
+		Namespace: "marshmallow",
+		Clusters: env.Clusters{
+			{Name: "staging", APIServer: "https://staging.kube.cluster", Token: "c3RhZ2luZw==", SkipTLSVerify: true},
+			{Name: "production", APIServer: "https://production.kube.cluster", Token: "cHJvZHVjdGlvbg==", Certificate: "Y2VydGlmaWVk"},
+		},
+		KubeContext: "production",
+	}
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", configFile.Name()) // the actual kubeconfig template
+	suite.Require().NoError(init.Prepare())
+	suite.Require().NoError(init.Execute())
+
+	contents, err := os.ReadFile(configFile.Name())
+	suite.Require().NoError(err)
+
+	strict := map[string]interface{}{}
+	suite.Require().NoError(yaml.UnmarshalStrict(contents, &strict))
+
+	var conf struct {
+		Clusters []struct {
+			Name    string `yaml:"name"`
+			Cluster struct {
+				Server                   string `yaml:"server"`
+				CertificateAuthorityData string `yaml:"certificate-authority-data"`
+				InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			} `yaml:"cluster"`
+		} `yaml:"clusters"`
+		Contexts []struct {
+			Name    string `yaml:"name"`
+			Context struct {
+				Cluster   string `yaml:"cluster"`
+				Namespace string `yaml:"namespace"`
+				User      string `yaml:"user"`
+			} `yaml:"context"`
+		} `yaml:"contexts"`
+		CurrentContext string `yaml:"current-context"`
+		Users          []struct {
+			Name string `yaml:"name"`
+			User struct {
+				Token string `yaml:"token"`
+			} `yaml:"user"`
+		} `yaml:"users"`
+	}
+	suite.Require().NoError(yaml.Unmarshal(contents, &conf))
+
+	suite.Require().Len(conf.Clusters, 2)
+	suite.Equal("staging", conf.Clusters[0].Name)
+	suite.Equal("https://staging.kube.cluster", conf.Clusters[0].Cluster.Server)
+	suite.True(conf.Clusters[0].Cluster.InsecureSkipTLSVerify)
+	suite.Equal("production", conf.Clusters[1].Name)
+	suite.Equal("https://production.kube.cluster", conf.Clusters[1].Cluster.Server)
+	suite.Equal("Y2VydGlmaWVk", conf.Clusters[1].Cluster.CertificateAuthorityData)
+
+	suite.Require().Len(conf.Contexts, 2)
+	for n, name := range []string{"staging", "production"} {
+		suite.Equal(name, conf.Contexts[n].Name)
+		suite.Equal(name, conf.Contexts[n].Context.Cluster)
+		suite.Equal(name, conf.Contexts[n].Context.User)
+		suite.Equal("marshmallow", conf.Contexts[n].Context.Namespace)
+	}
+	suite.Equal("production", conf.CurrentContext)
+
+	suite.Require().Len(conf.Users, 2)
+	suite.Equal("staging", conf.Users[0].Name)
+	suite.Equal("c3RhZ2luZw==", conf.Users[0].User.Token)
+	suite.Equal("production", conf.Users[1].Name)
+	suite.Equal("cHJvZHVjdGlvbg==", conf.Users[1].User.Token)
+}
+
+func (suite *InitKubeTestSuite) TestPrepareClustersDefaultsToFirstContext() {
+	configFile, err := tempfile("kubeconfig********.yml", "")
+	suite.Require().NoError(err)
+	defer os.Remove(configFile.Name())
+
+	cfg := env.Config{
+		Clusters: env.Clusters{
+			{Name: "staging", APIServer: "https://staging.kube.cluster", Token: "c3RhZ2luZw=="},
+			{Name: "production", APIServer: "https://production.kube.cluster", Token: "cHJvZHVjdGlvbg=="},
+		},
+	}
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", configFile.Name())
+	suite.Require().NoError(init.Prepare())
+	suite.Equal("staging", init.values.CurrentContext)
+}
+
+func (suite *InitKubeTestSuite) TestPrepareClustersErrors() {
+	valid := env.Cluster{Name: "staging", APIServer: "https://staging.kube.cluster", Token: "c3RhZ2luZw=="}
+	tests := []struct {
+		name string
+		cfg  env.Config
+		err  string
+	}{
+		{"no name", env.Config{Clusters: env.Clusters{{APIServer: "https://kube.cluster", Token: "token"}}}, "cluster 1 has no name"},
+		{"bad name", env.Config{Clusters: env.Clusters{{Name: "stag ing: yes", APIServer: "https://kube.cluster", Token: "token"}}},
+			"cluster name 'stag ing: yes' may only contain letters, digits, '.', '_' and '-'"},
+		{"duplicate", env.Config{Clusters: env.Clusters{valid, valid}}, "cluster 'staging' is listed more than once"},
+		{"no server", env.Config{Clusters: env.Clusters{{Name: "staging", Token: "token"}}}, "cluster 'staging' needs an api_server"},
+		{"no token", env.Config{Clusters: env.Clusters{{Name: "staging", APIServer: "https://kube.cluster"}}}, "cluster 'staging' needs a token"},
+		{"unknown context", env.Config{Clusters: env.Clusters{valid}, KubeContext: "production"}, "kube_context 'production' is not in the clusters"},
+		{"auth provider", env.Config{Clusters: env.Clusters{valid}, AuthProvider: "eks"}, "auth_provider can't be used with clusters"},
+	}
+	for _, test := range tests {
+		init := NewInitKube(test.cfg, "conf.tpl", "conf.yml")
+		suite.EqualError(init.Prepare(), test.err, test.name)
+	}
+}
+
 func tempfile(name, contents string) (*os.File, error) {
 	file, err := os.CreateTemp("", name)
 	if err != nil {
@@ -0,0 +1,23 @@
+package run
+
+// KubeRefresh is a step in a helm Plan that replaces the token in the kubeconfig written by an InitKube with a
+// new one from the auth_provider, so that a long series of releases doesn't outlast the token. It does nothing
+// if the InitKube has no auth_provider or its token is still fresh.
+type KubeRefresh struct {
+	init *InitKube
+}
+
+// NewKubeRefresh creates a KubeRefresh for the kubeconfig written by the given InitKube.
+func NewKubeRefresh(init *InitKube) *KubeRefresh {
+	return &KubeRefresh{init: init}
+}
+
+// Prepare does nothing, since the InitKube is prepared by its own step.
+func (r *KubeRefresh) Prepare() error {
+	return nil
+}
+
+// Execute refreshes the token if it's getting old.
+func (r *KubeRefresh) Execute() error {
+	return r.init.refresh()
+}
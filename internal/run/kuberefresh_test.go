@@ -0,0 +1,125 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type KubeRefreshTestSuite struct {
+	suite.Suite
+	originalProvider authProvider
+	originalNow      func() time.Time
+	clock            time.Time
+	tokens           int
+	configFile       string
+}
+
+func TestKubeRefreshTestSuite(t *testing.T) {
+	suite.Run(t, new(KubeRefreshTestSuite))
+}
+
+func (suite *KubeRefreshTestSuite) BeforeTest(_, _ string) {
+	suite.originalProvider, suite.originalNow = authProviders["eks"], authNow
+	suite.clock = time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	authNow = func() time.Time { return suite.clock }
+
+	suite.tokens = 0
+	authProviders["eks"] = func(ctx context.Context, cluster *cloudCluster) error {
+		suite.tokens++
+		cluster.apiServer = "https://peanut.eks.amazonaws.com"
+		cluster.token = fmt.Sprintf("k8s-aws-v1.token%d", suite.tokens)
+		return nil
+	}
+	suite.configFile = filepath.Join(suite.T().TempDir(), "config")
+}
+
+func (suite *KubeRefreshTestSuite) AfterTest(_, _ string) {
+	authProviders["eks"], authNow = suite.originalProvider, suite.originalNow
+}
+
+func (suite *KubeRefreshTestSuite) initKube(cfg env.Config) *InitKube {
+	init := NewInitKube(cfg, "../../assets/kubeconfig.tpl", suite.configFile) // the actual kubeconfig template
+	suite.Require().NoError(init.Prepare())
+	suite.Require().NoError(init.Execute())
+	return init
+}
+
+func (suite *KubeRefreshTestSuite) readConfig() string {
+	contents, err := os.ReadFile(suite.configFile)
+	suite.Require().NoError(err)
+	return string(contents)
+}
+
+func (suite *KubeRefreshTestSuite) TestExecuteRefreshesOldToken() {
+	init := suite.initKube(env.Config{AuthProvider: "eks", ClusterName: "peanut", ClusterRegion: "eu-west-1"})
+	suite.Contains(suite.readConfig(), "k8s-aws-v1.token1")
+	refresh := NewKubeRefresh(init)
+	suite.Require().NoError(refresh.Prepare())
+
+	suite.clock = suite.clock.Add(4 * time.Minute)
+	suite.Require().NoError(refresh.Execute())
+	suite.Equal(1, suite.tokens, "a fresh token should be kept")
+
+	suite.clock = suite.clock.Add(2 * time.Minute)
+	suite.Require().NoError(refresh.Execute())
+	suite.Equal(2, suite.tokens)
+	config := suite.readConfig()
+	suite.Contains(config, "k8s-aws-v1.token2")
+	suite.NotContains(config, "k8s-aws-v1.token1")
+	suite.Contains(config, "https://peanut.eks.amazonaws.com")
+
+	info, err := os.Stat(suite.configFile)
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm(), "the kubeconfig contains credentials")
+	entries, err := os.ReadDir(filepath.Dir(suite.configFile))
+	suite.Require().NoError(err)
+	suite.Len(entries, 1, "nothing should be left beside the kubeconfig")
+}
+
+func (suite *KubeRefreshTestSuite) TestExecuteWithoutAuthProvider() {
+	init := suite.initKube(env.Config{APIServer: "https://kube.example.com", KubeToken: "static"})
+	before := suite.readConfig()
+
+	suite.clock = suite.clock.Add(time.Hour)
+	suite.Require().NoError(NewKubeRefresh(init).Execute())
+	suite.Equal(before, suite.readConfig())
+}
+
+func (suite *KubeRefreshTestSuite) TestExecuteWithKubeConfig() {
+	init := suite.initKube(env.Config{KubeConfig: "apiVersion: v1\nkind: Config\n"})
+	before := suite.readConfig()
+	init.authProvider = "eks" // Prepare refuses the combination, but refresh shouldn't depend on that
+
+	suite.clock = suite.clock.Add(time.Hour)
+	suite.Require().NoError(NewKubeRefresh(init).Execute())
+	suite.Equal(before, suite.readConfig(), "only a kubeconfig from the template has a token to refresh")
+	suite.Equal(0, suite.tokens)
+}
+
+func (suite *KubeRefreshTestSuite) TestExecuteAfterCleanup() {
+	init := suite.initKube(env.Config{AuthProvider: "eks", ClusterName: "peanut", ClusterRegion: "eu-west-1"})
+	suite.Require().NoError(init.Cleanup())
+
+	suite.clock = suite.clock.Add(time.Hour)
+	suite.Require().NoError(NewKubeRefresh(init).Execute())
+	suite.NoFileExists(suite.configFile, "a removed kubeconfig shouldn't be written again")
+	suite.Equal(1, suite.tokens)
+}
+
+func (suite *KubeRefreshTestSuite) TestExecuteAuthProviderError() {
+	init := suite.initKube(env.Config{AuthProvider: "eks", ClusterName: "peanut", ClusterRegion: "eu-west-1"})
+	authProviders["eks"] = func(ctx context.Context, cluster *cloudCluster) error {
+		return fmt.Errorf("ExpiredToken")
+	}
+
+	suite.clock = suite.clock.Add(time.Hour)
+	suite.EqualError(NewKubeRefresh(init).Execute(), "eks auth_provider: ExpiredToken")
+	suite.Contains(suite.readConfig(), "k8s-aws-v1.token1", "the kubeconfig should be left alone")
+}
@@ -2,17 +2,27 @@ package run
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 )
 
-// Lint is an execution step that calls `helm lint` when executed.
+// Lint is an execution step that calls `helm lint` when executed. Charts in an OCI registry are
+// pulled into a temporary directory first, since `helm lint` only works on local charts.
 type Lint struct {
 	*config
 	chart        string
-	values       string
-	stringValues string
+	chartVersion string
+	values       []string
+	stringValues []string
+	fileValues   []string
+	jsonValues   []string
 	valuesFiles  []string
 	strict       bool
+	valuesWriter *valuesWriter
+	pullDir      string
+	pullCmd      cmd
 	cmd          cmd
 }
 
@@ -21,41 +31,79 @@ func NewLint(cfg env.Config) *Lint {
 	return &Lint{
 		config:       newConfig(cfg),
 		chart:        cfg.Chart,
+		chartVersion: cfg.ChartVersion,
 		values:       cfg.Values,
 		stringValues: cfg.StringValues,
+		fileValues:   cfg.FileValues,
+		jsonValues:   cfg.JSONValues,
 		valuesFiles:  cfg.ValuesFiles,
 		strict:       cfg.LintStrictly,
+		valuesWriter: newValuesWriter(cfg),
 	}
 }
 
 // Execute executes the `helm lint` command.
 func (l *Lint) Execute() error {
+	if l.pullCmd != nil {
+		if err := l.pullCmd.Run(); err != nil {
+			return fmt.Errorf("while pulling %s: %w", l.chart, err)
+		}
+	}
 	return l.cmd.Run()
 }
 
+// Command returns the helm command that the Lint step runs.
+func (l *Lint) Command() string {
+	if l.cmd == nil {
+		return ""
+	}
+	return l.cmd.String()
+}
+
+// Cleanup removes the chart pulled from an OCI registry and the interpolated values files, if any.
+func (l *Lint) Cleanup() error {
+	if err := l.valuesWriter.cleanup(); err != nil {
+		return err
+	}
+	if l.pullDir == "" {
+		return nil
+	}
+	return os.RemoveAll(l.pullDir)
+}
+
 // Prepare gets the Lint ready to execute.
 func (l *Lint) Prepare() error {
 	if l.chart == "" {
 		return fmt.Errorf("chart is required")
 	}
 
+	chart := l.chart
+	if isOCI(chart) {
+		if err := l.preparePull(); err != nil {
+			return err
+		}
+		chart = filepath.Join(l.pullDir, ociChartName(l.chart))
+	}
+
 	args := l.globalFlags()
 	args = append(args, "lint")
 
-	if l.values != "" {
-		args = append(args, "--set", l.values)
-	}
-	if l.stringValues != "" {
-		args = append(args, "--set-string", l.stringValues)
+	args = append(args, setFlags("--set", l.values)...)
+	args = append(args, setFlags("--set-string", l.stringValues)...)
+	args = append(args, setFlags("--set-file", l.fileValues)...)
+	args = append(args, setFlags("--set-json", l.jsonValues)...)
+	valuesFiles, err := l.valuesWriter.files(l.valuesFiles)
+	if err != nil {
+		return err
 	}
-	for _, vFile := range l.valuesFiles {
+	for _, vFile := range valuesFiles {
 		args = append(args, "--values", vFile)
 	}
 	if l.strict {
 		args = append(args, "--strict")
 	}
 
-	args = append(args, l.chart)
+	args = append(args, chart)
 
 	l.cmd = command(helmBin, args...)
 	l.cmd.Stdout(l.stdout)
@@ -67,3 +115,27 @@ func (l *Lint) Prepare() error {
 
 	return nil
 }
+
+func (l *Lint) preparePull() error {
+	var err error
+	l.pullDir, err = os.MkdirTemp("", "chart")
+	if err != nil {
+		return fmt.Errorf("failed to create directory for pulling chart: %w", err)
+	}
+
+	args := l.globalFlags()
+	args = append(args, "pull", l.chart, "--untar", "--untardir", l.pullDir)
+	if l.chartVersion != "" {
+		args = append(args, "--version", l.chartVersion)
+	}
+
+	l.pullCmd = command(helmBin, args...)
+	l.pullCmd.Stdout(l.stdout)
+	l.pullCmd.Stderr(l.stderr)
+
+	if l.debug {
+		fmt.Fprintf(l.stderr, "Generated command: '%s'\n", l.pullCmd.String())
+	}
+
+	return nil
+}
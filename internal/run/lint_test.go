@@ -1,6 +1,8 @@
 package run
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -35,16 +37,16 @@ func TestLintTestSuite(t *testing.T) {
 func (suite *LintTestSuite) TestNewLint() {
 	cfg := env.Config{
 		Chart:        "./flow",
-		Values:       "steadfastness,forthrightness",
-		StringValues: "tensile_strength,flexibility",
+		Values:       env.Values{"steadfastness", "forthrightness"},
+		StringValues: env.Values{"tensile_strength", "flexibility"},
 		ValuesFiles:  []string{"/root/price_inventory.yml"},
 		LintStrictly: true,
 	}
 	lint := NewLint(cfg)
 	suite.Require().NotNil(lint)
 	suite.Equal("./flow", lint.chart)
-	suite.Equal("steadfastness,forthrightness", lint.values)
-	suite.Equal("tensile_strength,flexibility", lint.stringValues)
+	suite.Equal([]string{"steadfastness", "forthrightness"}, lint.values)
+	suite.Equal([]string{"tensile_strength", "flexibility"}, lint.stringValues)
 	suite.Equal([]string{"/root/price_inventory.yml"}, lint.valuesFiles)
 	suite.Equal(true, lint.strict)
 	suite.NotNil(lint.config)
@@ -100,8 +102,10 @@ func (suite *LintTestSuite) TestPrepareWithLintFlags() {
 
 	cfg := env.Config{
 		Chart:        "./uk/top_40",
-		Values:       "width=5",
-		StringValues: "version=2.0",
+		Values:       env.Values{"width=5", "height=4"},
+		StringValues: env.Values{"version=2.0"},
+		FileValues:   env.Values{"notes=./notes.txt"},
+		JSONValues:   env.Values{`dimensions={"depth":3}`},
 		ValuesFiles:  []string{"/usr/local/underrides", "/usr/local/overrides"},
 		LintStrictly: true,
 	}
@@ -111,7 +115,10 @@ func (suite *LintTestSuite) TestPrepareWithLintFlags() {
 		suite.Equal(helmBin, path)
 		suite.Equal([]string{"lint",
 			"--set", "width=5",
+			"--set", "height=4",
 			"--set-string", "version=2.0",
+			"--set-file", "notes=./notes.txt",
+			"--set-json", `dimensions={"depth":3}`,
 			"--values", "/usr/local/underrides",
 			"--values", "/usr/local/overrides",
 			"--strict",
@@ -127,3 +134,98 @@ func (suite *LintTestSuite) TestPrepareWithLintFlags() {
 	err := l.Prepare()
 	suite.Require().Nil(err)
 }
+
+func (suite *LintTestSuite) TestPrepareStrictInterpolationFailure() {
+	defer suite.ctrl.Finish()
+	suite.T().Setenv("DB_PASSWORD", "") // restored after the test
+	os.Unsetenv("DB_PASSWORD")
+	valuesFile := filepath.Join(suite.T().TempDir(), "db.yml")
+	suite.Require().NoError(os.WriteFile(valuesFile, []byte("password: ${DB_PASSWORD}\n"), 0644))
+
+	l := NewLint(env.Config{
+		Chart:             "./uk/top_40",
+		ValuesFiles:       []string{valuesFile},
+		InterpolateFiles:  true,
+		InterpolateStrict: true,
+	})
+
+	err := l.Prepare()
+	suite.EqualError(err, "values file "+valuesFile+" refers to unset environment variables: DB_PASSWORD")
+	suite.NoError(l.Cleanup())
+}
+
+func (suite *LintTestSuite) TestPrepareWithValuesYAML() {
+	defer suite.ctrl.Finish()
+
+	l := NewLint(env.Config{
+		Chart:       "./uk/top_40",
+		ValuesFiles: []string{"/usr/local/underrides"},
+		ValuesYAML:  "chart:\n  positions: [1, 2, 3]\n",
+	})
+
+	var args []string
+	command = func(path string, a ...string) cmd {
+		args = a
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(l.Prepare())
+	suite.Require().Len(args, 6)
+	suite.Equal([]string{"lint", "--values", "/usr/local/underrides", "--values"}, args[:4])
+	suite.Equal("./uk/top_40", args[5])
+	contents, err := os.ReadFile(args[4])
+	suite.Require().NoError(err)
+	suite.Equal("chart:\n  positions: [1, 2, 3]\n", string(contents))
+
+	suite.Require().NoError(l.Cleanup())
+	suite.NoFileExists(args[4])
+}
+
+func (suite *LintTestSuite) TestPrepareAndExecuteOCIChart() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.Config{
+		Chart:        "oci://registry.example.com/charts/top_40:1.2.3",
+		ChartVersion: "1.2.3",
+		Namespace:    "uk",
+	}
+	l := NewLint(cfg)
+
+	pullCmd := NewMockcmd(suite.ctrl)
+	var pullArgs, lintArgs []string
+	command = func(path string, args ...string) cmd {
+		suite.Equal(helmBin, path)
+		if args[2] == "pull" {
+			pullArgs = args
+			return pullCmd
+		}
+		lintArgs = args
+		return suite.mockCmd
+	}
+
+	pullCmd.EXPECT().Stdout(gomock.Any())
+	pullCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(l.Prepare())
+	suite.Require().NotEqual("", l.pullDir)
+	suite.DirExists(l.pullDir)
+
+	suite.Equal([]string{"--namespace", "uk", "pull", "oci://registry.example.com/charts/top_40:1.2.3",
+		"--untar", "--untardir", l.pullDir,
+		"--version", "1.2.3"}, pullArgs)
+	suite.Equal([]string{"--namespace", "uk", "lint", filepath.Join(l.pullDir, "top_40")}, lintArgs)
+
+	gomock.InOrder(
+		pullCmd.EXPECT().Run(),
+		suite.mockCmd.EXPECT().Run(),
+	)
+	suite.Require().NoError(l.Execute())
+	suite.DirExists(l.pullDir)
+
+	suite.Require().NoError(l.Cleanup())
+	suite.NoDirExists(l.pullDir, "the pulled chart should be removed during cleanup")
+}
@@ -0,0 +1,288 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	yaml "gopkg.in/yaml.v2"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// preflightTimeout limits the time spent checking the cluster.
+const preflightTimeout = 30 * time.Second
+
+// preflightClient connects to the cluster using the kubeconfig, and returns the namespace it selects. It is a
+// variable so the tests can substitute a fake clientset.
+var preflightClient = func(kubeContext string) (kubernetes.Interface, string, error) {
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext, Timeout: "15s"},
+	)
+	restConfig, err := loader.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace, _, err := loader.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	return client, namespace, err
+}
+
+// Preflight is a step in a helm Plan that checks that a release can be installed before anything in the cluster
+// changes: the API server must be reachable, the namespace must exist (unless it will be created), and the
+// kubeconfig's user must be allowed to manage helm's release secrets and every kind of resource in the chart.
+type Preflight struct {
+	*config
+	release         string
+	createNamespace bool
+	force           bool
+	template        *Template
+	rendered        bytes.Buffer
+}
+
+// accessCheck is a permission to confirm with a SelfSubjectAccessReview.
+type accessCheck struct {
+	verb      string
+	group     string
+	resource  string
+	namespace string
+}
+
+func (a accessCheck) String() string {
+	resource := a.resource
+	if a.group != "" {
+		resource += "." + a.group
+	}
+	if a.namespace == "" {
+		return fmt.Sprintf("%s %s", a.verb, resource)
+	}
+	return fmt.Sprintf("%s %s in namespace '%s'", a.verb, resource, a.namespace)
+}
+
+// manifest is the part of a rendered resource that the permission checks need.
+type manifest struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+}
+
+// NewPreflight creates a Preflight using fields from the given Config. No validation is performed at this time.
+func NewPreflight(cfg env.Config) *Preflight {
+	cfg.TemplateOutput = ""
+	p := &Preflight{
+		config:          newConfig(cfg),
+		release:         cfg.Release,
+		createNamespace: cfg.CreateNamespace,
+		force:           cfg.Force,
+		template:        NewTemplate(cfg),
+	}
+	p.template.stdout = &p.rendered
+	return p
+}
+
+// Prepare gets the Preflight ready to execute.
+func (p *Preflight) Prepare() error {
+	return p.template.Prepare()
+}
+
+// Cleanup removes the files left behind by rendering the chart.
+func (p *Preflight) Cleanup() error {
+	return p.template.Cleanup()
+}
+
+// Execute connects to the cluster and checks the permissions needed to install the release.
+func (p *Preflight) Execute() error {
+	client, namespace, err := preflightClient(p.kubeContext)
+	if err != nil {
+		return fmt.Errorf("could not load kubeconfig: %w", err)
+	}
+	if p.namespace != "" {
+		namespace = p.namespace
+	}
+
+	version, err := client.Discovery().ServerVersion()
+	if err != nil {
+		return fmt.Errorf("could not reach the Kubernetes API server: %w", err)
+	}
+	if p.debug {
+		fmt.Fprintf(p.stderr, "connected to Kubernetes %s\n", version.GitVersion)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	var checks []accessCheck
+	exists, err := p.namespaceExists(ctx, client, namespace)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if !p.createNamespace {
+			return fmt.Errorf("namespace '%s' does not exist; set create_namespace to create it", namespace)
+		}
+		checks = append(checks, accessCheck{verb: "create", resource: "namespaces"})
+	}
+
+	// helm keeps each release's history in secrets in the release's namespace, and deletes the oldest ones to
+	// keep no more than history_max, which defaults to 10
+	for _, verb := range []string{"get", "list", "create", "update", "delete"} {
+		checks = append(checks, accessCheck{verb: verb, resource: "secrets", namespace: namespace})
+	}
+
+	if err := p.template.Execute(); err != nil {
+		// the upgrade may still succeed, e.g. with reuse_values, so this isn't fatal
+		fmt.Fprintf(p.stderr, "Warning: could not render the chart, so the permissions for its resources weren't checked: %s\n", err)
+	} else {
+		resourceChecks, err := p.resourceChecks(client, namespace)
+		if err != nil {
+			return err
+		}
+		checks = append(checks, resourceChecks...)
+	}
+
+	var missing []string
+	for _, check := range checks {
+		allowed, err := accessAllowed(ctx, client, check)
+		if err != nil {
+			return fmt.Errorf("could not check permission to %s: %w", check, err)
+		}
+		if p.debug {
+			fmt.Fprintf(p.stderr, "permission to %s: %t\n", check, allowed)
+		}
+		if !allowed {
+			missing = append(missing, check.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("release '%s' can't be installed because the Kubernetes user isn't allowed to: %s", p.release, strings.Join(missing, "; "))
+	}
+
+	return nil
+}
+
+// namespaceExists looks up the namespace. A user who may not read namespaces can still install into one, so
+// the namespace is assumed to exist when the lookup is forbidden.
+func (p *Preflight) namespaceExists(ctx context.Context, client kubernetes.Interface, namespace string) (bool, error) {
+	_, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		return true, nil
+	case apierrors.IsNotFound(err):
+		return false, nil
+	case apierrors.IsForbidden(err):
+		if p.debug {
+			fmt.Fprintf(p.stderr, "not allowed to read namespace %s; assuming it exists\n", namespace)
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("could not look up namespace '%s': %w", namespace, err)
+	}
+}
+
+// resourceChecks lists the permissions needed to install and upgrade each kind of resource in the rendered chart.
+func (p *Preflight) resourceChecks(client kubernetes.Interface, namespace string) ([]accessCheck, error) {
+	manifests, err := parseManifests(&p.rendered)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the rendered chart: %w", err)
+	}
+
+	groupResources, err := restmapper.GetAPIGroupResources(client.Discovery())
+	if err != nil {
+		return nil, fmt.Errorf("could not list the cluster's resource types: %w", err)
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
+
+	// helm creates new resources and patches existing ones, or replaces them with force_upgrade
+	verbs := []string{"get", "create", "patch"}
+	if p.force {
+		verbs = append(verbs, "update")
+	}
+
+	var checks []accessCheck
+	seen := map[accessCheck]bool{}
+	for _, m := range manifests {
+		gv, err := schema.ParseGroupVersion(m.APIVersion)
+		if err != nil {
+			return nil, fmt.Errorf("%s has an invalid apiVersion: %w", m.Kind, err)
+		}
+		mapping, err := mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: m.Kind}, gv.Version)
+		if meta.IsNoMatchError(err) {
+			// most likely a custom resource whose definition is installed along with the chart
+			fmt.Fprintf(p.stderr, "Warning: the cluster doesn't know %s %s, so the permissions for it weren't checked\n", m.APIVersion, m.Kind)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not find the resource type for %s %s: %w", m.APIVersion, m.Kind, err)
+		}
+
+		check := accessCheck{group: mapping.Resource.Group, resource: mapping.Resource.Resource}
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			check.namespace = namespace
+			if m.Metadata.Namespace != "" {
+				check.namespace = m.Metadata.Namespace
+			}
+		}
+		for _, verb := range verbs {
+			check.verb = verb
+			if !seen[check] {
+				seen[check] = true
+				checks = append(checks, check)
+			}
+		}
+	}
+	return checks, nil
+}
+
+// parseManifests reads the resources from `helm template` output, skipping empty documents.
+func parseManifests(r io.Reader) ([]manifest, error) {
+	var manifests []manifest
+	decoder := yaml.NewDecoder(r)
+	for {
+		var m manifest
+		err := decoder.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			return manifests, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.Kind != "" {
+			manifests = append(manifests, m)
+		}
+	}
+}
+
+func accessAllowed(ctx context.Context, client kubernetes.Interface, check accessCheck) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: check.namespace,
+				Verb:      check.verb,
+				Group:     check.group,
+				Resource:  check.resource,
+			},
+		},
+	}
+	review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
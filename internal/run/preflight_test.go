@@ -0,0 +1,316 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const preflightManifests = `---
+# Source: accounts/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: accounts
+---
+# Source: accounts/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: accounts
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: accounts-worker
+  namespace: workers
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: accounts-reader
+---
+`
+
+type PreflightTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	originalCommand func(string, ...string) cmd
+	originalClient  func(string) (kubernetes.Interface, string, error)
+	client          *fake.Clientset
+	kubeContext     string
+	manifests       string
+	denied          map[string]bool
+	checked         []string
+}
+
+func (suite *PreflightTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd { return suite.mockCmd }
+
+	suite.manifests = preflightManifests
+	suite.denied = map[string]bool{}
+	suite.checked = nil
+
+	suite.client = fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "accounts"}})
+	suite.client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "services", Kind: "Service", Namespaced: true},
+				{Name: "secrets", Kind: "Secret", Namespaced: true},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+		},
+		{
+			GroupVersion: "rbac.authorization.k8s.io/v1",
+			APIResources: []metav1.APIResource{{Name: "clusterroles", Kind: "ClusterRole", Namespaced: false}},
+		},
+	}
+	suite.client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		check := accessCheck{verb: attrs.Verb, group: attrs.Group, resource: attrs.Resource, namespace: attrs.Namespace}.String()
+		suite.checked = append(suite.checked, check)
+		review.Status.Allowed = !suite.denied[check]
+		return true, review, nil
+	})
+
+	suite.originalClient = preflightClient
+	preflightClient = func(kubeContext string) (kubernetes.Interface, string, error) {
+		suite.kubeContext = kubeContext
+		return suite.client, "default", nil
+	}
+}
+
+func (suite *PreflightTestSuite) AfterTest(_, _ string) {
+	suite.ctrl.Finish()
+	command = suite.originalCommand
+	preflightClient = suite.originalClient
+}
+
+func TestPreflightTestSuite(t *testing.T) {
+	suite.Run(t, new(PreflightTestSuite))
+}
+
+// expectTemplate sets up the mock `helm template` command to print the suite's manifests, or fail.
+func (suite *PreflightTestSuite) expectTemplate(runErr error) {
+	var stdout io.Writer
+	suite.mockCmd.EXPECT().String().AnyTimes()
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Stdout(gomock.Any()).Do(func(w io.Writer) { stdout = w })
+	suite.mockCmd.EXPECT().Run().DoAndReturn(func() error {
+		if runErr != nil {
+			return runErr
+		}
+		_, err := fmt.Fprint(stdout, suite.manifests)
+		return err
+	})
+}
+
+func (suite *PreflightTestSuite) TestNewPreflight() {
+	cfg := env.Config{
+		Chart:           "./charts/accounts",
+		Release:         "accounts",
+		Namespace:       "accounts",
+		KubeContext:     "production",
+		CreateNamespace: true,
+		Force:           true,
+		TemplateOutput:  "/tmp/manifests.yaml",
+	}
+	preflight := NewPreflight(cfg)
+
+	suite.Equal("accounts", preflight.release)
+	suite.Equal("accounts", preflight.namespace)
+	suite.Equal("production", preflight.kubeContext)
+	suite.True(preflight.createNamespace)
+	suite.True(preflight.force)
+	suite.Equal("./charts/accounts", preflight.template.chart)
+	suite.Equal("", preflight.template.outputFilename, "the preflight check shouldn't write the template output")
+}
+
+func (suite *PreflightTestSuite) TestPrepareRendersWithTemplateArgs() {
+	command = func(path string, args ...string) cmd {
+		suite.Equal(helmBin, path)
+		suite.Equal([]string{"--namespace", "accounts", "--kube-context", "production", "template",
+			"--values", "./prod.yml", "accounts", "./charts/accounts"}, args)
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	preflight := NewPreflight(env.Config{
+		Chart:       "./charts/accounts",
+		Release:     "accounts",
+		Namespace:   "accounts",
+		KubeContext: "production",
+		ValuesFiles: []string{"./prod.yml"},
+	})
+	suite.Require().NoError(preflight.Prepare())
+
+	suite.EqualError(NewPreflight(env.Config{Release: "accounts"}).Prepare(), "chart is required")
+}
+
+func (suite *PreflightTestSuite) TestExecuteChecksPermissions() {
+	suite.expectTemplate(nil)
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/accounts", Release: "accounts", Namespace: "accounts", KubeContext: "production"})
+	suite.Require().NoError(preflight.Prepare())
+	suite.Require().NoError(preflight.Execute())
+
+	suite.Equal("production", suite.kubeContext)
+	suite.Equal([]string{
+		"get secrets in namespace 'accounts'",
+		"list secrets in namespace 'accounts'",
+		"create secrets in namespace 'accounts'",
+		"update secrets in namespace 'accounts'",
+		"delete secrets in namespace 'accounts'",
+		"get services in namespace 'accounts'",
+		"create services in namespace 'accounts'",
+		"patch services in namespace 'accounts'",
+		"get deployments.apps in namespace 'accounts'",
+		"create deployments.apps in namespace 'accounts'",
+		"patch deployments.apps in namespace 'accounts'",
+		"get deployments.apps in namespace 'workers'",
+		"create deployments.apps in namespace 'workers'",
+		"patch deployments.apps in namespace 'workers'",
+		"get clusterroles.rbac.authorization.k8s.io",
+		"create clusterroles.rbac.authorization.k8s.io",
+		"patch clusterroles.rbac.authorization.k8s.io",
+	}, suite.checked)
+}
+
+func (suite *PreflightTestSuite) TestExecuteChecksUpdateWithForce() {
+	suite.manifests = "apiVersion: v1\nkind: Service\n"
+	suite.expectTemplate(nil)
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/accounts", Release: "accounts", Namespace: "accounts", Force: true})
+	suite.Require().NoError(preflight.Prepare())
+	suite.Require().NoError(preflight.Execute())
+	suite.Contains(suite.checked, "update services in namespace 'accounts'")
+}
+
+func (suite *PreflightTestSuite) TestExecuteReportsMissingPermissions() {
+	suite.expectTemplate(nil)
+	suite.denied["create secrets in namespace 'accounts'"] = true
+	suite.denied["patch deployments.apps in namespace 'workers'"] = true
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/accounts", Release: "accounts", Namespace: "accounts"})
+	suite.Require().NoError(preflight.Prepare())
+	suite.EqualError(preflight.Execute(), "release 'accounts' can't be installed because the Kubernetes user isn't allowed to: "+
+		"create secrets in namespace 'accounts'; patch deployments.apps in namespace 'workers'")
+}
+
+func (suite *PreflightTestSuite) TestExecuteUsesKubeconfigNamespace() {
+	suite.manifests = ""
+	suite.expectTemplate(nil)
+	suite.client.Tracker().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/accounts", Release: "accounts"})
+	suite.Require().NoError(preflight.Prepare())
+	suite.Require().NoError(preflight.Execute())
+	suite.Contains(suite.checked, "create secrets in namespace 'default'")
+}
+
+func (suite *PreflightTestSuite) TestExecuteMissingNamespace() {
+	suite.mockCmd.EXPECT().String().AnyTimes()
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/billing", Release: "billing", Namespace: "billing"})
+	suite.Require().NoError(preflight.Prepare())
+	suite.EqualError(preflight.Execute(), "namespace 'billing' does not exist; set create_namespace to create it")
+	suite.Empty(suite.checked, "nothing else should be checked")
+}
+
+func (suite *PreflightTestSuite) TestExecuteMissingNamespaceWithCreateNamespace() {
+	suite.manifests = ""
+	suite.expectTemplate(nil)
+	suite.denied["create namespaces"] = true
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/billing", Release: "billing", Namespace: "billing", CreateNamespace: true})
+	suite.Require().NoError(preflight.Prepare())
+	suite.EqualError(preflight.Execute(), "release 'billing' can't be installed because the Kubernetes user isn't allowed to: create namespaces")
+}
+
+func (suite *PreflightTestSuite) TestExecuteNamespaceForbidden() {
+	suite.manifests = ""
+	suite.expectTemplate(nil)
+	suite.client.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "billing", errors.New("no"))
+	})
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/billing", Release: "billing", Namespace: "billing"})
+	suite.Require().NoError(preflight.Prepare())
+	suite.NoError(preflight.Execute(), "a user who can't read namespaces may still install into one")
+}
+
+func (suite *PreflightTestSuite) TestExecuteWarnsAboutUnknownKinds() {
+	suite.manifests = "apiVersion: monitoring.coreos.com/v1\nkind: ServiceMonitor\n---\napiVersion: v1\nkind: Service\n"
+	suite.expectTemplate(nil)
+	stderr := &strings.Builder{}
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/accounts", Release: "accounts", Namespace: "accounts", Stderr: stderr})
+	suite.Require().NoError(preflight.Prepare())
+	suite.Require().NoError(preflight.Execute())
+	suite.Contains(stderr.String(), "Warning: the cluster doesn't know monitoring.coreos.com/v1 ServiceMonitor")
+	suite.Contains(suite.checked, "patch services in namespace 'accounts'")
+}
+
+func (suite *PreflightTestSuite) TestExecuteWarnsWhenRenderingFails() {
+	suite.expectTemplate(errors.New("exit status 1"))
+	stderr := &strings.Builder{}
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/accounts", Release: "accounts", Namespace: "accounts", Stderr: stderr})
+	suite.Require().NoError(preflight.Prepare())
+	suite.Require().NoError(preflight.Execute())
+	suite.Contains(stderr.String(), "Warning: could not render the chart")
+	suite.Len(suite.checked, 5, "the release storage permissions should still be checked")
+}
+
+func (suite *PreflightTestSuite) TestExecuteUnreachableServer() {
+	suite.mockCmd.EXPECT().String().AnyTimes()
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	preflightClient = func(string) (kubernetes.Interface, string, error) {
+		return nil, "", errors.New("no configuration has been provided")
+	}
+
+	preflight := NewPreflight(env.Config{Chart: "./charts/accounts", Release: "accounts"})
+	suite.Require().NoError(preflight.Prepare())
+	suite.EqualError(preflight.Execute(), "could not load kubeconfig: no configuration has been provided")
+}
+
+func (suite *PreflightTestSuite) TestParseManifests() {
+	manifests, err := parseManifests(strings.NewReader(preflightManifests))
+	suite.Require().NoError(err)
+	suite.Require().Len(manifests, 4, "empty documents should be skipped")
+	suite.Equal("v1", manifests[0].APIVersion)
+	suite.Equal("Service", manifests[0].Kind)
+	suite.Equal("workers", manifests[2].Metadata.Namespace)
+
+	_, err = parseManifests(strings.NewReader("kind: [nope"))
+	suite.Error(err)
+}
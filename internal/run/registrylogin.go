@@ -0,0 +1,91 @@
+package run
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+const ociScheme = "oci://"
+
+// isOCI reports whether a chart reference points to an OCI registry rather than a local path or a chart repository.
+func isOCI(chart string) bool {
+	return strings.HasPrefix(chart, ociScheme)
+}
+
+// ociChartName returns the name of the chart in an OCI reference, which is the last element of its path.
+func ociChartName(chart string) string {
+	name := path.Base(strings.TrimPrefix(chart, ociScheme))
+	return strings.SplitN(name, ":", 2)[0]
+}
+
+// RegistryLogin is an execution step that calls `helm registry login` when executed.
+type RegistryLogin struct {
+	*config
+	host     string
+	username string
+	password string
+	insecure bool
+	cmd      cmd
+}
+
+// NewRegistryLogin creates a RegistryLogin using fields from the given Config. No validation is performed at this time.
+func NewRegistryLogin(cfg env.Config) *RegistryLogin {
+	return &RegistryLogin{
+		config:   newConfig(cfg),
+		host:     cfg.RegistryLoginHost,
+		username: cfg.RegistryLoginUsername,
+		password: cfg.RegistryLoginPassword,
+		insecure: cfg.RegistryLoginInsecure,
+	}
+}
+
+// Execute executes the `helm registry login` command.
+func (r *RegistryLogin) Execute() error {
+	return r.cmd.Run()
+}
+
+// Command returns the helm command that the RegistryLogin step runs.
+func (r *RegistryLogin) Command() string {
+	if r.cmd == nil {
+		return ""
+	}
+	return r.cmd.String()
+}
+
+// Prepare gets the RegistryLogin ready to execute.
+func (r *RegistryLogin) Prepare() error {
+	if r.host == "" {
+		return fmt.Errorf("registry_login_host is required")
+	}
+	if r.username == "" {
+		return fmt.Errorf("registry_login_username is required")
+	}
+	if r.password == "" {
+		return fmt.Errorf("registry_login_password is required")
+	}
+
+	args := r.globalFlags()
+	args = append(args, "registry", "login")
+
+	// the password goes through stdin so it can't show up in a process listing or the debug output
+	args = append(args, "--username", r.username, "--password-stdin")
+	if r.insecure {
+		args = append(args, "--insecure")
+	}
+
+	args = append(args, strings.TrimPrefix(r.host, ociScheme))
+
+	r.cmd = command(helmBin, args...)
+	r.cmd.Stdin(strings.NewReader(r.password))
+	r.cmd.Stdout(r.stdout)
+	r.cmd.Stderr(r.stderr)
+
+	if r.debug {
+		fmt.Fprintf(r.stderr, "Generated command: '%s'\n", r.cmd.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package run
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryLoginTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	actualArgs      []string
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *RegistryLoginTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd {
+		suite.actualArgs = args
+		return suite.mockCmd
+	}
+}
+
+func (suite *RegistryLoginTestSuite) AfterTest(_, _ string) {
+	suite.ctrl.Finish()
+	command = suite.originalCommand
+}
+
+func TestRegistryLoginTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryLoginTestSuite))
+}
+
+func (suite *RegistryLoginTestSuite) TestNewRegistryLogin() {
+	cfg := env.Config{
+		RegistryLoginHost:     "registry.example.com",
+		RegistryLoginUsername: "minerva",
+		RegistryLoginPassword: "tabby cat",
+		RegistryLoginInsecure: true,
+	}
+	r := NewRegistryLogin(cfg)
+	suite.Equal("registry.example.com", r.host)
+	suite.Equal("minerva", r.username)
+	suite.Equal("tabby cat", r.password)
+	suite.Equal(true, r.insecure)
+	suite.NotNil(r.config)
+}
+
+func (suite *RegistryLoginTestSuite) TestPrepareAndExecute() {
+	stdout := strings.Builder{}
+	stderr := strings.Builder{}
+	cfg := env.Config{
+		RegistryLoginHost:     "oci://registry.example.com",
+		RegistryLoginUsername: "minerva",
+		RegistryLoginPassword: "tabby cat",
+		Stdout:                &stdout,
+		Stderr:                &stderr,
+	}
+	r := NewRegistryLogin(cfg)
+
+	var stdin io.Reader
+	suite.mockCmd.EXPECT().
+		Stdin(gomock.Any()).
+		Do(func(in io.Reader) { stdin = in })
+	suite.mockCmd.EXPECT().Stdout(&stdout)
+	suite.mockCmd.EXPECT().Stderr(&stderr)
+	suite.mockCmd.EXPECT().Run()
+
+	suite.Require().NoError(r.Prepare())
+	suite.Equal([]string{"registry", "login", "--username", "minerva", "--password-stdin", "registry.example.com"}, suite.actualArgs)
+
+	password, err := io.ReadAll(stdin)
+	suite.Require().NoError(err)
+	suite.Equal("tabby cat", string(password))
+
+	suite.NoError(r.Execute())
+}
+
+func (suite *RegistryLoginTestSuite) TestPrepareInsecureFlag() {
+	cfg := env.Config{
+		RegistryLoginHost:     "localhost:5000",
+		RegistryLoginUsername: "minerva",
+		RegistryLoginPassword: "tabby cat",
+		RegistryLoginInsecure: true,
+	}
+	r := NewRegistryLogin(cfg)
+
+	suite.mockCmd.EXPECT().Stdin(gomock.Any())
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(r.Prepare())
+	suite.Equal([]string{"registry", "login", "--username", "minerva", "--password-stdin", "--insecure", "localhost:5000"}, suite.actualArgs)
+}
+
+func (suite *RegistryLoginTestSuite) TestPrepareRequiredConfig() {
+	r := NewRegistryLogin(env.Config{
+		RegistryLoginUsername: "minerva",
+		RegistryLoginPassword: "tabby cat",
+	})
+	suite.EqualError(r.Prepare(), "registry_login_host is required")
+
+	r = NewRegistryLogin(env.Config{
+		RegistryLoginHost:     "registry.example.com",
+		RegistryLoginPassword: "tabby cat",
+	})
+	suite.EqualError(r.Prepare(), "registry_login_username is required")
+
+	r = NewRegistryLogin(env.Config{
+		RegistryLoginHost:     "registry.example.com",
+		RegistryLoginUsername: "minerva",
+	})
+	suite.EqualError(r.Prepare(), "registry_login_password is required")
+}
+
+func (suite *RegistryLoginTestSuite) TestPrepareDebugFlag() {
+	stderr := strings.Builder{}
+	cfg := env.Config{
+		RegistryLoginHost:     "registry.example.com",
+		RegistryLoginUsername: "minerva",
+		RegistryLoginPassword: "tabby cat",
+		Debug:                 true,
+		Stderr:                &stderr,
+	}
+	r := NewRegistryLogin(cfg)
+
+	command = func(path string, args ...string) cmd {
+		suite.mockCmd.EXPECT().
+			String().
+			Return(fmt.Sprintf("%s %s", path, strings.Join(args, " ")))
+
+		return suite.mockCmd
+	}
+
+	suite.mockCmd.EXPECT().Stdin(gomock.Any())
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(&stderr)
+
+	suite.Require().NoError(r.Prepare())
+
+	want := fmt.Sprintf("Generated command: '%s --debug registry login --username minerva --password-stdin registry.example.com'\n", helmBin)
+	suite.Equal(want, stderr.String())
+	suite.NotContains(stderr.String(), "tabby cat")
+}
+
+func (suite *RegistryLoginTestSuite) TestOCIChartName() {
+	suite.True(isOCI("oci://registry.example.com/charts/mychart"))
+	suite.False(isOCI("./charts/mychart"))
+	suite.False(isOCI("stable/mychart"))
+
+	suite.Equal("mychart", ociChartName("oci://registry.example.com/charts/mychart"))
+	suite.Equal("mychart", ociChartName("oci://registry.example.com/charts/mychart:1.0.0"))
+}
@@ -0,0 +1,102 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+// ReleaseInfo is the state of a release's latest revision.
+type ReleaseInfo struct {
+	Namespace    string
+	Status       string
+	Revision     int
+	Chart        string
+	ChartVersion string
+	AppVersion   string
+	Notes        string // the chart's rendered NOTES.txt
+}
+
+// ReleaseStatus looks up a release in the cluster with the Helm SDK, the same way as `helm status`.
+func ReleaseStatus(cfg env.Config) (ReleaseInfo, error) {
+	settings := cli.New()
+	settings.KubeContext = cfg.KubeContext
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = settings.Namespace()
+	}
+
+	actionCfg := new(action.Configuration)
+	if err := actionCfg.Init(settings.RESTClientGetter(), namespace, "secrets", func(string, ...interface{}) {}); err != nil {
+		return ReleaseInfo{}, err
+	}
+	return releaseStatus(actionCfg, cfg.Release)
+}
+
+func releaseStatus(actionCfg *action.Configuration, release string) (ReleaseInfo, error) {
+	rel, err := action.NewStatus(actionCfg).Run(release)
+	if err != nil {
+		return ReleaseInfo{}, err
+	}
+	info := ReleaseInfo{
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+	}
+	if rel.Info != nil {
+		info.Status = rel.Info.Status.String()
+		info.Notes = rel.Info.Notes
+	}
+	if rel.Chart != nil && rel.Chart.Metadata != nil {
+		info.Chart = rel.Chart.Metadata.Name
+		info.ChartVersion = rel.Chart.Metadata.Version
+		info.AppVersion = rel.Chart.Metadata.AppVersion
+	}
+	return info, nil
+}
+
+// releaseEnvLock keeps releases that are installed in parallel from interleaving their lines in the env file.
+var releaseEnvLock sync.Mutex
+
+var notEnvNameChars = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// writeReleaseEnv appends a release's information to a dotenv-style file, in variables prefixed with
+// HELM_ and the release's name. Values are double-quoted, with newlines and quotes escaped.
+func writeReleaseEnv(filename, release string, info ReleaseInfo) error {
+	prefix := "HELM_" + notEnvNameChars.ReplaceAllString(strings.ToUpper(release), "_") + "_"
+	vars := []struct {
+		name, value string
+	}{
+		{"REVISION", strconv.Itoa(info.Revision)},
+		{"STATUS", info.Status},
+		{"NAMESPACE", info.Namespace},
+		{"CHART", info.Chart},
+		{"CHART_VERSION", info.ChartVersion},
+		{"APP_VERSION", info.AppVersion},
+		{"NOTES", info.Notes},
+	}
+
+	var lines strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&lines, "%s%s=%s\n", prefix, v.name, strconv.Quote(v.value))
+	}
+
+	releaseEnvLock.Lock()
+	defer releaseEnvLock.Unlock()
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open release env file: %w", err)
+	}
+	if _, err := file.WriteString(lines.String()); err != nil {
+		file.Close()
+		return fmt.Errorf("could not write release env file: %w", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,79 @@
+package run
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joho/godotenv"
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+type ReleaseStatusTestSuite struct {
+	suite.Suite
+}
+
+func TestReleaseStatusTestSuite(t *testing.T) {
+	suite.Run(t, new(ReleaseStatusTestSuite))
+}
+
+func (suite *ReleaseStatusTestSuite) TestReleaseStatus() {
+	actionCfg := &action.Configuration{
+		Releases:   storage.Init(driver.NewMemory()),
+		KubeClient: &kubefake.PrintingKubeClient{Out: io.Discard},
+	}
+	for revision, status := range []release.Status{release.StatusSuperseded, release.StatusDeployed} {
+		suite.Require().NoError(actionCfg.Releases.Create(&release.Release{
+			Name:      "accounts",
+			Namespace: "payments",
+			Version:   revision + 1,
+			Info:      &release.Info{Status: status, Notes: "Ledgers are balanced."},
+			Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: "ledger", Version: "0.4.0", AppVersion: "1.16"}},
+		}))
+	}
+
+	info, err := releaseStatus(actionCfg, "accounts")
+	suite.Require().NoError(err)
+	suite.Equal(ReleaseInfo{
+		Namespace:    "payments",
+		Status:       "deployed",
+		Revision:     2,
+		Chart:        "ledger",
+		ChartVersion: "0.4.0",
+		AppVersion:   "1.16",
+		Notes:        "Ledgers are balanced.",
+	}, info)
+
+	_, err = releaseStatus(actionCfg, "billing")
+	suite.EqualError(err, "release: not found")
+}
+
+func (suite *ReleaseStatusTestSuite) TestWriteReleaseEnv() {
+	envFile := filepath.Join(suite.T().TempDir(), "output.env")
+	info := ReleaseInfo{Status: "deployed", Revision: 3, Notes: "Say \"hi\"\nto the ledger\n"}
+	suite.Require().NoError(writeReleaseEnv(envFile, "accounts.v2-api", info))
+
+	contents, err := os.ReadFile(envFile)
+	suite.Require().NoError(err)
+	suite.Equal(`HELM_ACCOUNTS_V2_API_REVISION="3"
+HELM_ACCOUNTS_V2_API_STATUS="deployed"
+HELM_ACCOUNTS_V2_API_NAMESPACE=""
+HELM_ACCOUNTS_V2_API_CHART=""
+HELM_ACCOUNTS_V2_API_CHART_VERSION=""
+HELM_ACCOUNTS_V2_API_APP_VERSION=""
+HELM_ACCOUNTS_V2_API_NOTES="Say \"hi\"\nto the ledger\n"
+`, string(contents))
+
+	exported, err := godotenv.Read(envFile)
+	suite.Require().NoError(err)
+	suite.Equal("Say \"hi\"\nto the ledger\n", exported["HELM_ACCOUNTS_V2_API_NOTES"])
+
+	suite.Error(writeReleaseEnv(filepath.Join(envFile, "nope"), "accounts", info))
+}
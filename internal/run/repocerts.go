@@ -2,18 +2,25 @@ package run
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"strings"
 
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 )
 
 type repoCerts struct {
 	*config
-	cert           string
-	certFilename   string
-	caCert         string
-	caCertFilename string
+	cert                  string
+	certFilename          string
+	key                   string
+	keyFilename           string
+	caCert                string
+	caCertFilename        string
+	insecureSkipTLSVerify bool
+	written               []string // files created by write, for cleanup to remove
 }
 
 func newRepoCerts(cfg env.Config) *repoCerts {
@@ -24,46 +31,79 @@ func newRepoCerts(cfg env.Config) *repoCerts {
 	}
 }
 
+// newRepoCertsFor returns the certificates for an entry in the `repos` setting. Anything the entry
+// doesn't specify falls back to the global repo_certificate and repo_ca_certificate.
+func newRepoCertsFor(cfg env.Config, repo env.Repo) *repoCerts {
+	rc := newRepoCerts(cfg)
+	if repo.Certificate != "" {
+		rc.cert = repo.Certificate
+	}
+	if repo.CACertificate != "" {
+		rc.caCert = repo.CACertificate
+	}
+	rc.key = repo.Key
+	rc.insecureSkipTLSVerify = repo.InsecureSkipTLSVerify
+
+	return rc
+}
+
 func (rc *repoCerts) write() error {
-	if rc.cert != "" {
-		file, err := os.CreateTemp("", "repo********.cert")
-		if err != nil {
-			return fmt.Errorf("failed to create certificate file: %w", err)
-		}
-		defer file.Close()
+	files := []struct {
+		kind, pattern, encoded string
+		filename               *string
+	}{
+		{"certificate", "repo********.cert", rc.cert, &rc.certFilename},
+		{"key", "repo********.key", rc.key, &rc.keyFilename},
+		{"CA certificate", "repo********.ca.cert", rc.caCert, &rc.caCertFilename},
+	}
 
-		rc.certFilename = file.Name()
-		rawCert, err := base64.StdEncoding.DecodeString(rc.cert)
-		if err != nil {
-			return fmt.Errorf("failed to base64-decode certificate string: %w", err)
-		}
-		if rc.debug {
-			fmt.Fprintf(rc.stderr, "writing repo certificate to %s\n", rc.certFilename)
+	for _, f := range files {
+		if f.encoded == "" {
+			continue
 		}
-		if _, err := file.Write(rawCert); err != nil {
-			return fmt.Errorf("failed to write certificate file: %w", err)
+		name, err := rc.writeFile(f.kind, f.pattern, f.encoded)
+		if err != nil {
+			return err
 		}
+		*f.filename = name
 	}
+	return nil
+}
 
-	if rc.caCert != "" {
-		file, err := os.CreateTemp("", "repo********.ca.cert")
-		if err != nil {
-			return fmt.Errorf("failed to create CA certificate file: %w", err)
-		}
-		defer file.Close()
+// writeFile decodes a base64-encoded value into a new temp file and returns its name.
+func (rc *repoCerts) writeFile(kind, pattern, encoded string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to base64-decode %s string: %w", kind, err)
+	}
 
-		rc.caCertFilename = file.Name()
-		rawCert, err := base64.StdEncoding.DecodeString(rc.caCert)
-		if err != nil {
-			return fmt.Errorf("failed to base64-decode CA certificate string: %w", err)
-		}
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s file: %w", kind, err)
+	}
+	defer file.Close()
+
+	if rc.debug {
+		fmt.Fprintf(rc.stderr, "writing repo %s to %s\n", strings.ToLower(kind), file.Name())
+	}
+	rc.written = append(rc.written, file.Name())
+	if _, err := file.Write(raw); err != nil {
+		return "", fmt.Errorf("failed to write %s file: %w", kind, err)
+	}
+	return file.Name(), nil
+}
+
+// cleanup removes the files created by write.
+func (rc *repoCerts) cleanup() error {
+	for _, filename := range rc.written {
 		if rc.debug {
-			fmt.Fprintf(rc.stderr, "writing repo ca certificate to %s\n", rc.caCertFilename)
+			fmt.Fprintf(rc.stderr, "removing %s\n", filename)
 		}
-		if _, err := file.Write(rawCert); err != nil {
-			return fmt.Errorf("failed to write CA certificate file: %w", err)
+		if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("could not remove %s: %w", filename, err)
 		}
 	}
+	rc.written = nil
 	return nil
 }
 
@@ -72,9 +112,15 @@ func (rc *repoCerts) flags() []string {
 	if rc.certFilename != "" {
 		flags = append(flags, "--cert-file", rc.certFilename)
 	}
+	if rc.keyFilename != "" {
+		flags = append(flags, "--key-file", rc.keyFilename)
+	}
 	if rc.caCertFilename != "" {
 		flags = append(flags, "--ca-file", rc.caCertFilename)
 	}
+	if rc.insecureSkipTLSVerify {
+		flags = append(flags, "--insecure-skip-tls-verify")
+	}
 
 	return flags
 }
@@ -29,6 +29,24 @@ func (suite *RepoCertsTestSuite) TestNewRepoCerts() {
 	suite.Equal("T3JlZ29uIFN0YXRlIExpY2Vuc3VyZSBib2FyZA==", rc.caCert)
 }
 
+func (suite *RepoCertsTestSuite) TestNewRepoCertsFor() {
+	cfg := env.Config{
+		RepoCertificate:   "Z2xvYmFsIGNlcnQ=",
+		RepoCACertificate: "Z2xvYmFsIGNhIGNlcnQ=",
+	}
+	rc := newRepoCertsFor(cfg, env.Repo{
+		Name:                  "northern_lights",
+		Key:                   "cmVwbyBrZXk=",
+		CACertificate:         "cmVwbyBjYSBjZXJ0",
+		InsecureSkipTLSVerify: true,
+	})
+	suite.Require().NotNil(rc)
+	suite.Equal("Z2xvYmFsIGNlcnQ=", rc.cert, "the global certificate should be the default")
+	suite.Equal("cmVwbyBrZXk=", rc.key)
+	suite.Equal("cmVwbyBjYSBjZXJ0", rc.caCert, "the repo's own certificate should take precedence")
+	suite.True(rc.insecureSkipTLSVerify)
+}
+
 func (suite *RepoCertsTestSuite) TestWrite() {
 	cfg := env.Config{
 		RepoCertificate:   "bGljZW5zZWQgYnkgdGhlIFN0YXRlIG9mIE9yZWdvbiB0byBwZXJmb3JtIHJlcG9zc2Vzc2lvbnM=",
@@ -51,6 +69,31 @@ func (suite *RepoCertsTestSuite) TestWrite() {
 	suite.Equal("Oregon State Licensure board", string(caCert))
 }
 
+func (suite *RepoCertsTestSuite) TestWriteKey() {
+	rc := newRepoCertsFor(env.Config{}, env.Repo{Key: "dGhlIGtleSB0byB0aGUgY2l0eQ=="})
+
+	suite.NoError(rc.write())
+	defer os.Remove(rc.keyFilename)
+	suite.Equal("", rc.certFilename)
+	suite.Equal("", rc.caCertFilename)
+
+	info, err := os.Stat(rc.keyFilename)
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	key, err := os.ReadFile(rc.keyFilename)
+	suite.Require().NoError(err)
+	suite.Equal("the key to the city", string(key))
+}
+
+func (suite *RepoCertsTestSuite) TestWriteBadEncoding() {
+	rc := newRepoCertsFor(env.Config{}, env.Repo{Key: "not base64!"})
+	err := rc.write()
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "failed to base64-decode key string")
+	suite.Equal("", rc.keyFilename)
+}
+
 func (suite *RepoCertsTestSuite) TestFlags() {
 	rc := newRepoCerts(env.Config{})
 	suite.Equal([]string{}, rc.flags())
@@ -58,6 +101,10 @@ func (suite *RepoCertsTestSuite) TestFlags() {
 	suite.Equal([]string{"--cert-file", "hurgityburgity"}, rc.flags())
 	rc.caCertFilename = "honglydongly"
 	suite.Equal([]string{"--cert-file", "hurgityburgity", "--ca-file", "honglydongly"}, rc.flags())
+	rc.keyFilename = "blinkyblonky"
+	rc.insecureSkipTLSVerify = true
+	suite.Equal([]string{"--cert-file", "hurgityburgity", "--key-file", "blinkyblonky",
+		"--ca-file", "honglydongly", "--insecure-skip-tls-verify"}, rc.flags())
 }
 
 func (suite *RepoCertsTestSuite) TestDebug() {
@@ -0,0 +1,100 @@
+package run
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+// Rollback is an execution step that calls `helm rollback` when executed.
+type Rollback struct {
+	*config
+	release  string
+	revision int
+
+	dryRun        bool
+	wait          bool
+	timeout       string
+	force         bool
+	cleanupOnFail bool
+	historyMax    int
+
+	cmd cmd
+}
+
+// NewRollback creates a Rollback using fields from the given Config. No validation is performed at this time.
+func NewRollback(cfg env.Config) *Rollback {
+	return &Rollback{
+		config:        newConfig(cfg),
+		release:       cfg.Release,
+		revision:      cfg.Revision,
+		dryRun:        cfg.DryRun,
+		wait:          cfg.Wait,
+		timeout:       cfg.Timeout,
+		force:         cfg.Force,
+		cleanupOnFail: cfg.CleanupOnFail,
+		historyMax:    cfg.HistoryMax,
+	}
+}
+
+// Execute executes the `helm rollback` command.
+func (r *Rollback) Execute() error {
+	return r.cmd.Run()
+}
+
+// Command returns the helm command that the Rollback step runs.
+func (r *Rollback) Command() string {
+	if r.cmd == nil {
+		return ""
+	}
+	return r.cmd.String()
+}
+
+// Prepare gets the Rollback ready to execute.
+func (r *Rollback) Prepare() error {
+	if r.release == "" {
+		return fmt.Errorf("release is required")
+	}
+	if r.revision < 0 {
+		return fmt.Errorf("revision must not be negative")
+	}
+
+	args := r.globalFlags()
+	args = append(args, "rollback")
+
+	if r.dryRun {
+		args = append(args, "--dry-run")
+	}
+	if r.wait {
+		args = append(args, "--wait")
+	}
+	if r.timeout != "" {
+		args = append(args, "--timeout", r.timeout)
+	}
+	if r.force {
+		args = append(args, "--force")
+	}
+	if r.cleanupOnFail {
+		args = append(args, "--cleanup-on-fail")
+	}
+
+	// always set --history-max since it defaults to non-zero value
+	args = append(args, fmt.Sprintf("--history-max=%d", r.historyMax))
+
+	args = append(args, r.release)
+	// helm rolls back to the previous revision when none is given
+	if r.revision > 0 {
+		args = append(args, strconv.Itoa(r.revision))
+	}
+
+	r.cmd = command(helmBin, args...)
+	r.cmd.Stdout(r.stdout)
+	r.cmd.Stderr(r.stderr)
+
+	if r.debug {
+		fmt.Fprintf(r.stderr, "Generated command: '%s'\n", r.cmd.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type RollbackTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	actualArgs      []string
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *RollbackTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd {
+		suite.actualArgs = args
+		return suite.mockCmd
+	}
+}
+
+func (suite *RollbackTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+}
+
+func TestRollbackTestSuite(t *testing.T) {
+	suite.Run(t, new(RollbackTestSuite))
+}
+
+func (suite *RollbackTestSuite) TestNewRollback() {
+	cfg := env.Config{
+		Release:       "toto_africa",
+		Revision:      3,
+		DryRun:        true,
+		Wait:          true,
+		Timeout:       "go sit in the corner",
+		Force:         true,
+		CleanupOnFail: true,
+		HistoryMax:    5,
+	}
+	r := NewRollback(cfg)
+	suite.Equal("toto_africa", r.release)
+	suite.Equal(3, r.revision)
+	suite.Equal(true, r.dryRun)
+	suite.Equal(true, r.wait)
+	suite.Equal("go sit in the corner", r.timeout)
+	suite.Equal(true, r.force)
+	suite.Equal(true, r.cleanupOnFail)
+	suite.Equal(5, r.historyMax)
+	suite.NotNil(r.config)
+}
+
+func (suite *RollbackTestSuite) TestPrepareAndExecute() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.Config{
+		Release:    "toto_africa",
+		HistoryMax: 10,
+	}
+	r := NewRollback(cfg)
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().
+		Run().
+		Times(1)
+
+	suite.Require().NoError(r.Prepare())
+	suite.Equal([]string{"rollback", "--history-max=10", "toto_africa"}, suite.actualArgs,
+		"the revision should be omitted so helm uses the previous one")
+	suite.Require().NoError(r.Execute())
+}
+
+func (suite *RollbackTestSuite) TestPrepareWithRollbackFlags() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.Config{
+		Namespace:     "eighties",
+		Release:       "toto_africa",
+		Revision:      42,
+		DryRun:        true,
+		Wait:          true,
+		Timeout:       "sit_in_the_corner",
+		Force:         true,
+		CleanupOnFail: true,
+		HistoryMax:    10,
+	}
+	r := NewRollback(cfg)
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(r.Prepare())
+	suite.Equal([]string{"--namespace", "eighties", "rollback",
+		"--dry-run",
+		"--wait",
+		"--timeout", "sit_in_the_corner",
+		"--force",
+		"--cleanup-on-fail",
+		"--history-max=10",
+		"toto_africa", "42"}, suite.actualArgs)
+}
+
+func (suite *RollbackTestSuite) TestPrepareRequiresRelease() {
+	// These aren't really expected, but allowing them gives clearer test-failure messages
+	suite.mockCmd.EXPECT().Stdout(gomock.Any()).AnyTimes()
+	suite.mockCmd.EXPECT().Stderr(gomock.Any()).AnyTimes()
+
+	r := NewRollback(env.Config{})
+	suite.EqualError(r.Prepare(), "release is required")
+}
+
+func (suite *RollbackTestSuite) TestPrepareRejectsNegativeRevision() {
+	r := NewRollback(env.Config{Release: "toto_africa", Revision: -1})
+	suite.EqualError(r.Prepare(), "revision must not be negative")
+}
+
+func (suite *RollbackTestSuite) TestPrepareDebugFlag() {
+	stdout := strings.Builder{}
+	stderr := strings.Builder{}
+
+	cfg := env.Config{
+		Release: "toto_africa",
+		Debug:   true,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	r := NewRollback(cfg)
+
+	command = func(path string, args ...string) cmd {
+		suite.mockCmd.EXPECT().
+			String().
+			Return(fmt.Sprintf("%s %s", path, strings.Join(args, " ")))
+
+		return suite.mockCmd
+	}
+
+	suite.mockCmd.EXPECT().Stdout(&stdout)
+	suite.mockCmd.EXPECT().Stderr(&stderr)
+
+	suite.Require().NoError(r.Prepare())
+
+	want := fmt.Sprintf("Generated command: '%s --debug rollback --history-max=0 toto_africa'\n", helmBin)
+	suite.Equal(want, stderr.String())
+}
@@ -0,0 +1,301 @@
+package run
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/crypto/openpgp"
+	pgparmor "golang.org/x/crypto/openpgp/armor"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// sopsValue matches a value encrypted by SOPS.
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsKeys are the private keys that can decrypt the data key of a file encrypted with SOPS.
+type sopsKeys struct {
+	age []age.Identity
+	pgp openpgp.EntityList
+}
+
+// sopsMetadata is the part of the `sops` section of an encrypted file that decryption needs.
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	PGP []struct {
+		Fingerprint string `yaml:"fp"`
+		Enc         string `yaml:"enc"`
+	} `yaml:"pgp"`
+	LastModified     string `yaml:"lastmodified"`
+	MAC              string `yaml:"mac"`
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+}
+
+// sopsDecryption holds the state of decrypting one file.
+type sopsDecryption struct {
+	dataKey          []byte
+	macOnlyEncrypted bool
+	mac              hash.Hash
+	secrets          []string
+}
+
+// newSOPSKeys parses the sops_age_key and sops_pgp_key settings. It returns nil if neither is set.
+func newSOPSKeys(ageKey, pgpKey, passphrase string) (*sopsKeys, error) {
+	if ageKey == "" && pgpKey == "" {
+		return nil, nil
+	}
+
+	keys := &sopsKeys{}
+	if ageKey != "" {
+		identities, err := age.ParseIdentities(strings.NewReader(ageKey))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse sops_age_key: %w", err)
+		}
+		keys.age = identities
+	}
+
+	if pgpKey != "" {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pgpKey))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse sops_pgp_key: %w", err)
+		}
+		// unlock the keys up front, since nobody is around to answer a prompt
+		for _, entity := range entities {
+			privateKeys := []*openpgp.Subkey{{PrivateKey: entity.PrivateKey}}
+			for i := range entity.Subkeys {
+				privateKeys = append(privateKeys, &entity.Subkeys[i])
+			}
+			for _, key := range privateKeys {
+				if key.PrivateKey == nil || !key.PrivateKey.Encrypted {
+					continue
+				}
+				if err := key.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, fmt.Errorf("could not unlock sops_pgp_key with sops_passphrase: %w", err)
+				}
+			}
+		}
+		keys.pgp = entities
+	}
+	return keys, nil
+}
+
+// decrypt decrypts a values file encrypted with SOPS, and returns it as YAML along with the strings that were
+// encrypted. A file without a `sops` section is returned as it is, with encrypted set to false. k may be nil
+// if no keys are configured, in which case an encrypted file is an error.
+func (k *sopsKeys) decrypt(contents []byte) (decrypted []byte, secrets []string, encrypted bool, err error) {
+	var tree yaml.MapSlice
+	if err := yaml.Unmarshal(contents, &tree); err != nil {
+		// not ours to report; helm will complain about the file if it's really invalid
+		return contents, nil, false, nil
+	}
+
+	metadataIndex := -1
+	for i, item := range tree {
+		if item.Key == "sops" {
+			metadataIndex = i
+		}
+	}
+	if metadataIndex < 0 {
+		return contents, nil, false, nil
+	}
+	if k == nil {
+		return nil, nil, true, errors.New("it is encrypted with SOPS, but neither sops_age_key nor sops_pgp_key is set")
+	}
+
+	var metadata sopsMetadata
+	rawMetadata, err := yaml.Marshal(tree[metadataIndex].Value)
+	if err == nil {
+		err = yaml.Unmarshal(rawMetadata, &metadata)
+	}
+	if err != nil || metadata.MAC == "" {
+		return nil, nil, true, fmt.Errorf("the sops section is invalid")
+	}
+	tree = append(tree[:metadataIndex:metadataIndex], tree[metadataIndex+1:]...)
+
+	dataKey, err := k.dataKey(metadata)
+	if err != nil {
+		return nil, nil, true, err
+	}
+
+	d := &sopsDecryption{dataKey: dataKey, macOnlyEncrypted: metadata.MACOnlyEncrypted, mac: sha512.New()}
+	decryptedTree, err := d.walk(tree, nil)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	if err := d.verifyMAC(metadata); err != nil {
+		return nil, nil, true, err
+	}
+
+	decrypted, err = yaml.Marshal(decryptedTree)
+	if err != nil {
+		return nil, nil, true, fmt.Errorf("could not encode the decrypted values: %w", err)
+	}
+	return decrypted, d.secrets, true, nil
+}
+
+// dataKey decrypts the key that the file's values are encrypted with, using whichever of the keys can.
+func (k *sopsKeys) dataKey(metadata sopsMetadata) ([]byte, error) {
+	if len(k.age) > 0 {
+		for _, recipient := range metadata.Age {
+			plaintext, err := age.Decrypt(armor.NewReader(strings.NewReader(recipient.Enc)), k.age...)
+			if err != nil {
+				continue
+			}
+			return io.ReadAll(plaintext)
+		}
+	}
+
+	if len(k.pgp) > 0 {
+		for _, recipient := range metadata.PGP {
+			block, err := pgparmor.Decode(strings.NewReader(recipient.Enc))
+			if err != nil {
+				continue
+			}
+			message, err := openpgp.ReadMessage(block.Body, k.pgp, nil, nil)
+			if err != nil {
+				continue
+			}
+			return io.ReadAll(message.UnverifiedBody)
+		}
+	}
+
+	return nil, errors.New("none of the keys in sops_age_key or sops_pgp_key can decrypt it")
+}
+
+// walk decrypts every encrypted value in the tree and adds every value to the MAC, in the same order as SOPS.
+// Each value's key path is authenticated along with it, so encrypted values can't be moved around the file.
+func (d *sopsDecryption) walk(value interface{}, path []string) (interface{}, error) {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			decrypted, err := d.walk(item.Value, append(path[:len(path):len(path)], fmt.Sprint(item.Key)))
+			if err != nil {
+				return nil, err
+			}
+			v[i].Value = decrypted
+		}
+		return v, nil
+	case []interface{}:
+		// list items share their parent's path
+		for i, item := range v {
+			decrypted, err := d.walk(item, path)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = decrypted
+		}
+		return v, nil
+	case string:
+		if match := sopsValue.FindStringSubmatch(v); match != nil {
+			decrypted, err := d.decryptValue(match, strings.Join(path, ":")+":")
+			if err != nil {
+				return nil, fmt.Errorf("could not decrypt %s: %w", strings.Join(path, "."), err)
+			}
+			d.mac.Write(sopsBytes(decrypted))
+			// numbers and booleans would mask too much of the output to be worth it
+			if s, ok := decrypted.(string); ok {
+				d.secrets = append(d.secrets, s)
+			}
+			return decrypted, nil
+		}
+	}
+
+	if !d.macOnlyEncrypted {
+		d.mac.Write(sopsBytes(value))
+	}
+	return value, nil
+}
+
+// decryptValue decrypts one value with the data key, and converts it back to its original type.
+func (d *sopsDecryption) decryptValue(match []string, additionalData string) (interface{}, error) {
+	var parts [3][]byte
+	for i, encoded := range match[1:4] {
+		part, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = part
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(d.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+
+	switch valueType := match[4]; valueType {
+	case "str", "bytes":
+		return string(plaintext), nil
+	case "int":
+		return strconv.Atoi(string(plaintext))
+	case "float":
+		return strconv.ParseFloat(string(plaintext), 64)
+	case "bool":
+		return strconv.ParseBool(strings.ToLower(string(plaintext)))
+	default:
+		return nil, fmt.Errorf("unknown type %s", valueType)
+	}
+}
+
+// verifyMAC checks the file's MAC against the values, to make sure the file hasn't been tampered with.
+func (d *sopsDecryption) verifyMAC(metadata sopsMetadata) error {
+	match := sopsValue.FindStringSubmatch(metadata.MAC)
+	if match == nil {
+		return errors.New("the sops section has an invalid MAC")
+	}
+	lastModified, err := time.Parse(time.RFC3339, metadata.LastModified)
+	if err != nil {
+		return fmt.Errorf("the sops section has an invalid lastmodified: %w", err)
+	}
+	expected, err := d.decryptValue(match, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("could not decrypt the MAC: %w", err)
+	}
+
+	if actual := fmt.Sprintf("%X", d.mac.Sum(nil)); actual != expected {
+		return errors.New("the MAC doesn't match the values, so the file may have been tampered with")
+	}
+	return nil
+}
+
+// sopsBytes is the representation of a value that SOPS uses to compute the MAC.
+func sopsBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(v)
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		// SOPS inherited Python's capitalized booleans
+		if v {
+			return []byte("True")
+		}
+		return []byte("False")
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,365 @@
+package run
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	pgparmor "golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const sopsTestValues = `database:
+  password: correct-horse
+  port: 5432
+  ratio: 0.75
+  tls: true
+  host_unencrypted: db.example.com
+ingress:
+  hosts:
+  - at40.example.com
+  - top40.example.com
+`
+
+type SOPSTestSuite struct {
+	suite.Suite
+}
+
+func TestSOPSTestSuite(t *testing.T) {
+	suite.Run(t, new(SOPSTestSuite))
+}
+
+// sopsEncrypter encrypts values files the way SOPS does, so the tests don't need the sops binary.
+type sopsEncrypter struct {
+	dataKey          []byte
+	age              []age.Recipient
+	pgp              openpgp.EntityList
+	lastModified     string
+	macOnlyEncrypted bool
+}
+
+func newSOPSEncrypter(t *testing.T) *sopsEncrypter {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	return &sopsEncrypter{dataKey: dataKey, lastModified: "2026-10-18T09:00:00Z"}
+}
+
+// encrypt encrypts the values in the YAML document, except those whose keys end in _unencrypted.
+func (e *sopsEncrypter) encrypt(t *testing.T, values string) string {
+	var tree yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(values), &tree); err != nil {
+		t.Fatal(err)
+	}
+	mac := sha512.New()
+	e.encryptTree(tree, nil, false, mac)
+
+	metadata := yaml.MapSlice{
+		{Key: "lastmodified", Value: e.lastModified},
+		{Key: "mac", Value: e.encryptValue(fmt.Sprintf("%X", mac.Sum(nil)), e.lastModified)},
+		{Key: "mac_only_encrypted", Value: e.macOnlyEncrypted},
+	}
+	var ageKeys []yaml.MapSlice
+	for _, recipient := range e.age {
+		buf := &bytes.Buffer{}
+		armored := armor.NewWriter(buf)
+		w, err := age.Encrypt(armored, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.dataKey)
+		w.Close()
+		armored.Close()
+		ageKeys = append(ageKeys, yaml.MapSlice{{Key: "recipient", Value: fmt.Sprint(recipient)}, {Key: "enc", Value: buf.String()}})
+	}
+	var pgpKeys []yaml.MapSlice
+	for _, entity := range e.pgp {
+		buf := &bytes.Buffer{}
+		armored, err := pgparmor.Encode(buf, "PGP MESSAGE", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := openpgp.Encrypt(armored, openpgp.EntityList{entity}, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.dataKey)
+		w.Close()
+		armored.Close()
+		pgpKeys = append(pgpKeys, yaml.MapSlice{{Key: "fp", Value: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)}, {Key: "enc", Value: buf.String()}})
+	}
+	metadata = append(metadata, yaml.MapItem{Key: "age", Value: ageKeys}, yaml.MapItem{Key: "pgp", Value: pgpKeys})
+
+	encrypted, err := yaml.Marshal(append(tree, yaml.MapItem{Key: "sops", Value: metadata}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encrypted)
+}
+
+func (e *sopsEncrypter) encryptTree(value interface{}, path []string, unencrypted bool, mac hash.Hash) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			key := fmt.Sprint(item.Key)
+			v[i].Value = e.encryptTree(item.Value, append(path[:len(path):len(path)], key), strings.HasSuffix(key, "_unencrypted"), mac)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = e.encryptTree(item, path, unencrypted, mac)
+		}
+		return v
+	}
+
+	if unencrypted {
+		if !e.macOnlyEncrypted {
+			mac.Write(sopsBytes(value))
+		}
+		return value
+	}
+	mac.Write(sopsBytes(value))
+	return e.encryptValue(value, strings.Join(path, ":")+":")
+}
+
+func (e *sopsEncrypter) encryptValue(value interface{}, additionalData string) string {
+	valueType := map[string]string{"string": "str", "int": "int", "float64": "float", "bool": "bool"}[fmt.Sprintf("%T", value)]
+	iv := make([]byte, 32)
+	rand.Read(iv)
+	block, _ := aes.NewCipher(e.dataKey)
+	gcm, _ := cipher.NewGCMWithNonceSize(block, len(iv))
+	sealed := gcm.Seal(nil, iv, sopsBytes(value), []byte(additionalData))
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	encode := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", encode(data), encode(iv), encode(tag), valueType)
+}
+
+// armoredPGPKey returns the entity's private key as sops_pgp_key expects it.
+func armoredPGPKey(t *testing.T, entity *openpgp.Entity) string {
+	buf := &bytes.Buffer{}
+	armored, err := pgparmor.Encode(buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(armored, nil); err != nil {
+		t.Fatal(err)
+	}
+	armored.Close()
+	return buf.String()
+}
+
+// readFixture returns the contents of a file in testdata/sops. The encrypted files there were made with the sops
+// binary itself, which the tests don't otherwise need; see the README there.
+func readFixture(t *testing.T, name string) string {
+	contents, err := os.ReadFile(filepath.Join("testdata", "sops", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func (suite *SOPSTestSuite) TestNoKeys() {
+	keys, err := newSOPSKeys("", "", "hunter2")
+	suite.NoError(err)
+	suite.Nil(keys)
+}
+
+func (suite *SOPSTestSuite) TestInvalidKeys() {
+	_, err := newSOPSKeys("AGE-SECRET-KEY-NOPE", "", "")
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not parse sops_age_key")
+
+	_, err = newSOPSKeys("", "not a key", "")
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not parse sops_pgp_key")
+}
+
+func (suite *SOPSTestSuite) TestDecryptWithAgeKey() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{identity.Recipient()}
+	encrypted := e.encrypt(suite.T(), sopsTestValues)
+	suite.Require().NotContains(encrypted, "correct-horse")
+	suite.Require().Contains(encrypted, "db.example.com", "values marked _unencrypted should stay readable")
+
+	keys, err := newSOPSKeys(identity.String(), "", "")
+	suite.Require().NoError(err)
+	decrypted, secrets, ok, err := keys.decrypt([]byte(encrypted))
+	suite.Require().NoError(err)
+	suite.True(ok)
+	suite.Equal(sopsTestValues, string(decrypted))
+	suite.ElementsMatch([]string{"correct-horse", "at40.example.com", "top40.example.com"}, secrets)
+}
+
+func (suite *SOPSTestSuite) TestDecryptWithPGPKey() {
+	entity, err := openpgp.NewEntity("Durin", "", "durin@khazad-dum.test", &packet.Config{DefaultHash: crypto.SHA256})
+	suite.Require().NoError(err)
+	other, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{other.Recipient()}
+	e.pgp = openpgp.EntityList{entity}
+
+	keys, err := newSOPSKeys("", armoredPGPKey(suite.T(), entity), "")
+	suite.Require().NoError(err)
+	decrypted, _, ok, err := keys.decrypt([]byte(e.encrypt(suite.T(), sopsTestValues)))
+	suite.Require().NoError(err)
+	suite.True(ok)
+	suite.Equal(sopsTestValues, string(decrypted))
+}
+
+func (suite *SOPSTestSuite) TestDecryptWithLockedPGPKey() {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(readFixture(suite.T(), "pgp.asc")))
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.pgp = entities
+	encrypted := e.encrypt(suite.T(), sopsTestValues)
+
+	_, err = newSOPSKeys("", readFixture(suite.T(), "pgp.asc"), "speak mellon")
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not unlock sops_pgp_key with sops_passphrase")
+
+	keys, err := newSOPSKeys("", readFixture(suite.T(), "pgp.asc"), "speak friend")
+	suite.Require().NoError(err)
+	decrypted, _, _, err := keys.decrypt([]byte(encrypted))
+	suite.Require().NoError(err)
+	suite.Equal(sopsTestValues, string(decrypted))
+}
+
+func (suite *SOPSTestSuite) TestDecryptWithoutMatchingKey() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	other, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{other.Recipient()}
+
+	keys, err := newSOPSKeys(identity.String(), "", "")
+	suite.Require().NoError(err)
+	_, _, ok, err := keys.decrypt([]byte(e.encrypt(suite.T(), sopsTestValues)))
+	suite.True(ok)
+	suite.EqualError(err, "none of the keys in sops_age_key or sops_pgp_key can decrypt it")
+}
+
+func (suite *SOPSTestSuite) TestDecryptTamperedFile() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	keys, err := newSOPSKeys(identity.String(), "", "")
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{identity.Recipient()}
+	encrypted := e.encrypt(suite.T(), sopsTestValues)
+
+	tampered := strings.Replace(encrypted, "db.example.com", "evil.example.com", 1)
+	_, _, _, err = keys.decrypt([]byte(tampered))
+	suite.EqualError(err, "the MAC doesn't match the values, so the file may have been tampered with")
+
+	// an encrypted value moved to another key fails to decrypt, since its path is authenticated
+	var tree yaml.MapSlice
+	suite.Require().NoError(yaml.Unmarshal([]byte(encrypted), &tree))
+	database := tree[0].Value.(yaml.MapSlice)
+	database[0].Value, database[1].Value = database[1].Value, database[0].Value
+	moved, err := yaml.Marshal(tree)
+	suite.Require().NoError(err)
+	_, _, _, err = keys.decrypt(moved)
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not decrypt database.password")
+}
+
+func (suite *SOPSTestSuite) TestMACOnlyEncrypted() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	keys, err := newSOPSKeys(identity.String(), "", "")
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{identity.Recipient()}
+	e.macOnlyEncrypted = true
+
+	tampered := strings.Replace(e.encrypt(suite.T(), sopsTestValues), "db.example.com", "db2.example.com", 1)
+	decrypted, _, _, err := keys.decrypt([]byte(tampered))
+	suite.Require().NoError(err, "only encrypted values are covered by the MAC")
+	suite.Contains(string(decrypted), "host_unencrypted: db2.example.com")
+}
+
+func (suite *SOPSTestSuite) TestDecryptUnencryptedFile() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	keys, err := newSOPSKeys(identity.String(), "", "")
+	suite.Require().NoError(err)
+
+	for _, contents := range []string{sopsTestValues, "", "- a list\n", "\tnot: yaml\n"} {
+		decrypted, secrets, ok, err := keys.decrypt([]byte(contents))
+		suite.Require().NoError(err, contents)
+		suite.False(ok, contents)
+		suite.Empty(secrets)
+		suite.Equal(contents, string(decrypted))
+	}
+
+	_, _, ok, err := keys.decrypt([]byte("password: hunter2\nsops:\n  version: 3.7.3\n"))
+	suite.True(ok)
+	suite.EqualError(err, "the sops section is invalid")
+}
+
+func (suite *SOPSTestSuite) TestDecryptWithoutKeys() {
+	var keys *sopsKeys
+	decrypted, _, ok, err := keys.decrypt([]byte(sopsTestValues))
+	suite.Require().NoError(err)
+	suite.False(ok)
+	suite.Equal(sopsTestValues, string(decrypted), "a file that isn't encrypted needs no keys")
+
+	e := newSOPSEncrypter(suite.T())
+	_, _, ok, err = keys.decrypt([]byte(e.encrypt(suite.T(), sopsTestValues)))
+	suite.True(ok)
+	suite.EqualError(err, "it is encrypted with SOPS, but neither sops_age_key nor sops_pgp_key is set")
+}
+
+func (suite *SOPSTestSuite) TestDecryptFilesFromSOPS() {
+	var expected interface{}
+	suite.Require().NoError(yaml.Unmarshal([]byte(readFixture(suite.T(), "secrets.yml")), &expected))
+
+	for fixture, keys := range map[string][3]string{
+		"secrets.age.yml":       {readFixture(suite.T(), "age.key"), "", ""},
+		"secrets.age-regex.yml": {readFixture(suite.T(), "age.key"), "", ""},
+		"secrets.pgp.yml":       {"", readFixture(suite.T(), "pgp.asc"), "speak friend"},
+	} {
+		sopsKeys, err := newSOPSKeys(keys[0], keys[1], keys[2])
+		suite.Require().NoError(err)
+
+		decrypted, secrets, ok, err := sopsKeys.decrypt([]byte(readFixture(suite.T(), fixture)))
+		suite.Require().NoError(err, fixture)
+		suite.True(ok, fixture)
+		suite.Contains(secrets, "correct-horse", fixture)
+		suite.Contains(secrets, "at40.example.com", fixture)
+
+		var actual interface{}
+		suite.Require().NoError(yaml.Unmarshal(decrypted, &actual))
+		suite.Equal(expected, actual, fixture)
+	}
+}
+
+func (suite *SOPSTestSuite) TestDecryptTamperedFileFromSOPS() {
+	keys, err := newSOPSKeys(readFixture(suite.T(), "age.key"), "", "")
+	suite.Require().NoError(err)
+
+	tampered := strings.Replace(readFixture(suite.T(), "secrets.age.yml"), "db.example.com", "evil.example.com", 1)
+	_, _, _, err = keys.decrypt([]byte(tampered))
+	suite.EqualError(err, "the MAC doesn't match the values, so the file may have been tampered with")
+}
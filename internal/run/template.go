@@ -0,0 +1,132 @@
+package run
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+// Template is an execution step that calls `helm template` when executed.
+type Template struct {
+	*config
+	chart   string
+	release string
+
+	chartVersion   string
+	values         []string
+	stringValues   []string
+	fileValues     []string
+	jsonValues     []string
+	valuesFiles    []string
+	skipCrds       bool
+	noHooks        bool // leave out hooks and tests, which `helm get manifest` doesn't show either
+	certs          *repoCerts
+	outputFilename string
+	outputFile     io.WriteCloser
+	valuesWriter   *valuesWriter
+
+	cmd cmd
+}
+
+// NewTemplate creates a Template using fields from the given Config. No validation is performed at this time.
+func NewTemplate(cfg env.Config) *Template {
+	return &Template{
+		config:         newConfig(cfg),
+		chart:          cfg.Chart,
+		release:        cfg.Release,
+		chartVersion:   cfg.ChartVersion,
+		values:         cfg.Values,
+		stringValues:   cfg.StringValues,
+		fileValues:     cfg.FileValues,
+		jsonValues:     cfg.JSONValues,
+		valuesFiles:    cfg.ValuesFiles,
+		skipCrds:       cfg.SkipCrds,
+		certs:          newRepoCerts(cfg),
+		outputFilename: cfg.TemplateOutput,
+		valuesWriter:   newValuesWriter(cfg),
+	}
+}
+
+// Execute executes the `helm template` command.
+func (t *Template) Execute() error {
+	if t.outputFile != nil {
+		defer t.outputFile.Close()
+	}
+	return t.cmd.Run()
+}
+
+// Command returns the helm command that the Template step runs.
+func (t *Template) Command() string {
+	if t.cmd == nil {
+		return ""
+	}
+	return t.cmd.String()
+}
+
+// Cleanup removes the interpolated values files, if any.
+func (t *Template) Cleanup() error {
+	return t.valuesWriter.cleanup()
+}
+
+// Prepare gets the Template ready to execute.
+func (t *Template) Prepare() error {
+	if t.chart == "" {
+		return fmt.Errorf("chart is required")
+	}
+	if t.release == "" {
+		return fmt.Errorf("release is required")
+	}
+
+	args := t.globalFlags()
+	args = append(args, "template")
+
+	if t.chartVersion != "" {
+		args = append(args, "--version", t.chartVersion)
+	}
+	args = append(args, setFlags("--set", t.values)...)
+	args = append(args, setFlags("--set-string", t.stringValues)...)
+	args = append(args, setFlags("--set-file", t.fileValues)...)
+	args = append(args, setFlags("--set-json", t.jsonValues)...)
+	if t.skipCrds {
+		args = append(args, "--skip-crds")
+	}
+	if t.noHooks {
+		args = append(args, "--no-hooks", "--skip-tests")
+	}
+	valuesFiles, err := t.valuesWriter.files(t.valuesFiles)
+	if err != nil {
+		return err
+	}
+	for _, vFile := range valuesFiles {
+		args = append(args, "--values", vFile)
+	}
+	args = append(args, t.certs.flags()...)
+
+	args = append(args, t.release, t.chart)
+
+	var stdout io.Writer = t.stdout
+	if t.outputFilename != "" {
+		if t.debug {
+			fmt.Fprintf(t.stderr, "writing rendered manifests to %s\n", t.outputFilename)
+		}
+
+		file, err := os.Create(t.outputFilename)
+		if err != nil {
+			return fmt.Errorf("could not open template output file for writing: %w", err)
+		}
+		t.outputFile = file
+		stdout = file
+	}
+
+	t.cmd = command(helmBin, args...)
+	t.cmd.Stdout(stdout)
+	t.cmd.Stderr(t.stderr)
+
+	if t.debug {
+		fmt.Fprintf(t.stderr, "Generated command: '%s'\n", t.cmd.String())
+	}
+
+	return nil
+}
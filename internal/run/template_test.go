@@ -0,0 +1,232 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type TemplateTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *TemplateTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd { return suite.mockCmd }
+}
+
+func (suite *TemplateTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+}
+
+func TestTemplateTestSuite(t *testing.T) {
+	suite.Run(t, new(TemplateTestSuite))
+}
+
+func (suite *TemplateTestSuite) TestNewTemplate() {
+	cfg := env.Config{
+		Chart:          "billboard_hot_100",
+		Release:        "lizzo_good_as_hell",
+		ChartVersion:   "clean",
+		Values:         env.Values{"steadfastness", "forthrightness"},
+		StringValues:   env.Values{"tensile_strength", "flexibility"},
+		ValuesFiles:    []string{"/root/price_inventory.yml"},
+		SkipCrds:       true,
+		TemplateOutput: "/tmp/manifests.yaml",
+	}
+
+	tmpl := NewTemplate(cfg)
+
+	suite.Equal("billboard_hot_100", tmpl.chart)
+	suite.Equal("lizzo_good_as_hell", tmpl.release)
+	suite.Equal("clean", tmpl.chartVersion)
+	suite.Equal([]string{"steadfastness", "forthrightness"}, tmpl.values)
+	suite.Equal([]string{"tensile_strength", "flexibility"}, tmpl.stringValues)
+	suite.Equal([]string{"/root/price_inventory.yml"}, tmpl.valuesFiles)
+	suite.Equal(true, tmpl.skipCrds)
+	suite.Equal("/tmp/manifests.yaml", tmpl.outputFilename)
+	suite.NotNil(tmpl.config)
+	suite.NotNil(tmpl.certs)
+}
+
+func (suite *TemplateTestSuite) TestPrepareAndExecute() {
+	defer suite.ctrl.Finish()
+
+	stdout := strings.Builder{}
+	cfg := env.Config{
+		Chart:   "at40",
+		Release: "dua_lipa_dont_start_now",
+		Stdout:  &stdout,
+	}
+
+	tmpl := NewTemplate(cfg)
+
+	command = func(path string, args ...string) cmd {
+		suite.Equal(helmBin, path)
+		suite.Equal([]string{"template", "dua_lipa_dont_start_now", "at40"}, args)
+
+		return suite.mockCmd
+	}
+
+	suite.mockCmd.EXPECT().
+		Stdout(&stdout)
+	suite.mockCmd.EXPECT().
+		Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().
+		Run().
+		Times(1)
+
+	suite.Require().NoError(tmpl.Prepare())
+	suite.Require().NoError(tmpl.Execute())
+}
+
+func (suite *TemplateTestSuite) TestPrepareWithTemplateFlags() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.Config{
+		Namespace:    "melt",
+		Chart:        "hot_ac",
+		Release:      "maroon_5_memories",
+		ChartVersion: "radio_edit",
+		Values:       env.Values{"age=35"},
+		StringValues: env.Values{"height=5ft10in", "weight=70kg"},
+		FileValues:   env.Values{"bio=./bio.txt"},
+		JSONValues:   env.Values{`stats={"wins":3}`},
+		ValuesFiles:  []string{"/usr/local/stats", "/usr/local/grades"},
+		SkipCrds:     true,
+	}
+
+	tmpl := NewTemplate(cfg)
+	// inject a ca cert filename so repoCerts won't create any files that we'd have to clean up
+	tmpl.certs.caCertFilename = "local_ca.cert"
+
+	command = func(path string, args ...string) cmd {
+		suite.Equal(helmBin, path)
+		suite.Equal([]string{"--namespace", "melt", "template",
+			"--version", "radio_edit",
+			"--set", "age=35",
+			"--set-string", "height=5ft10in",
+			"--set-string", "weight=70kg",
+			"--set-file", "bio=./bio.txt",
+			"--set-json", `stats={"wins":3}`,
+			"--skip-crds",
+			"--values", "/usr/local/stats",
+			"--values", "/usr/local/grades",
+			"--ca-file", "local_ca.cert",
+			"maroon_5_memories", "hot_ac"}, args)
+
+		return suite.mockCmd
+	}
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(tmpl.Prepare())
+}
+
+func (suite *TemplateTestSuite) TestPrepareWithOutputFile() {
+	defer suite.ctrl.Finish()
+
+	outputFile, err := tempfile("manifests********.yaml", "stale manifests")
+	defer os.Remove(outputFile.Name())
+	suite.Require().NoError(err)
+
+	cfg := env.Config{
+		Chart:          "at40",
+		Release:        "harry_styles_adore_you",
+		TemplateOutput: outputFile.Name(),
+	}
+	tmpl := NewTemplate(cfg)
+
+	suite.mockCmd.EXPECT().
+		Stdout(gomock.Any()).
+		Do(func(w interface{}) {
+			suite.IsType(&os.File{}, w)
+		})
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run()
+
+	suite.Require().NoError(tmpl.Prepare())
+	suite.Require().NoError(tmpl.Execute())
+
+	contents, err := os.ReadFile(outputFile.Name())
+	suite.Require().NoError(err)
+	suite.Equal("", string(contents), "the output file should be truncated")
+}
+
+func (suite *TemplateTestSuite) TestPrepareCannotOpenOutputFile() {
+	cfg := env.Config{
+		Chart:          "at40",
+		Release:        "harry_styles_adore_you",
+		TemplateOutput: "/usr/foreign/exclude/manifests.yaml",
+	}
+	tmpl := NewTemplate(cfg)
+
+	err := tmpl.Prepare()
+	suite.Error(err)
+	suite.Regexp("could not open template output file for writing: .* no such file or directory", err)
+}
+
+func (suite *TemplateTestSuite) TestRequiresChartAndRelease() {
+	// These aren't really expected, but allowing them gives clearer test-failure messages
+	suite.mockCmd.EXPECT().Stdout(gomock.Any()).AnyTimes()
+	suite.mockCmd.EXPECT().Stderr(gomock.Any()).AnyTimes()
+
+	tmpl := NewTemplate(env.Config{})
+	tmpl.release = "seth_everman_unskippable_cutscene"
+
+	err := tmpl.Prepare()
+	suite.EqualError(err, "chart is required", "Chart should be mandatory")
+
+	tmpl.release = ""
+	tmpl.chart = "billboard_top_zero"
+
+	err = tmpl.Prepare()
+	suite.EqualError(err, "release is required", "Release should be mandatory")
+}
+
+func (suite *TemplateTestSuite) TestPrepareDebugFlag() {
+	stdout := strings.Builder{}
+	stderr := strings.Builder{}
+
+	cfg := env.Config{
+		Chart:   "at40",
+		Release: "lewis_capaldi_someone_you_loved",
+		Debug:   true,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+
+	tmpl := NewTemplate(cfg)
+
+	command = func(path string, args ...string) cmd {
+		suite.mockCmd.EXPECT().
+			String().
+			Return(fmt.Sprintf("%s %s", path, strings.Join(args, " ")))
+
+		return suite.mockCmd
+	}
+
+	suite.mockCmd.EXPECT().Stdout(&stdout)
+	suite.mockCmd.EXPECT().Stderr(&stderr)
+
+	suite.Require().NoError(tmpl.Prepare())
+
+	want := fmt.Sprintf(
+		"Generated command: '%s --debug template lewis_capaldi_someone_you_loved at40'\n",
+		helmBin,
+	)
+	suite.Equal(want, stderr.String())
+	suite.Equal("", stdout.String())
+}
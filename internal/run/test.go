@@ -0,0 +1,73 @@
+package run
+
+import (
+	"fmt"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+)
+
+// Test is an execution step that calls `helm test` when executed.
+type Test struct {
+	*config
+	release string
+	timeout string
+	logs    bool
+	filters []string
+	cmd     cmd
+}
+
+// NewTest creates a Test using fields from the given Config. No validation is performed at this time.
+func NewTest(cfg env.Config) *Test {
+	return &Test{
+		config:  newConfig(cfg),
+		release: cfg.Release,
+		timeout: cfg.TestTimeout,
+		logs:    cfg.TestLogs,
+		filters: cfg.TestFilter,
+	}
+}
+
+// Execute executes the `helm test` command.
+func (t *Test) Execute() error {
+	return t.cmd.Run()
+}
+
+// Command returns the helm command that the Test step runs.
+func (t *Test) Command() string {
+	if t.cmd == nil {
+		return ""
+	}
+	return t.cmd.String()
+}
+
+// Prepare gets the Test ready to execute.
+func (t *Test) Prepare() error {
+	if t.release == "" {
+		return fmt.Errorf("release is required")
+	}
+
+	args := t.globalFlags()
+	args = append(args, "test")
+
+	if t.timeout != "" {
+		args = append(args, "--timeout", t.timeout)
+	}
+	if t.logs {
+		args = append(args, "--logs")
+	}
+	for _, filter := range t.filters {
+		args = append(args, "--filter", filter)
+	}
+
+	args = append(args, t.release)
+
+	t.cmd = command(helmBin, args...)
+	t.cmd.Stdout(t.stdout)
+	t.cmd.Stderr(t.stderr)
+
+	if t.debug {
+		fmt.Fprintf(t.stderr, "Generated command: '%s'\n", t.cmd.String())
+	}
+
+	return nil
+}
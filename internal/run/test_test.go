@@ -0,0 +1,138 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestTestSuite struct {
+	suite.Suite
+	ctrl            *gomock.Controller
+	mockCmd         *Mockcmd
+	actualArgs      []string
+	originalCommand func(string, ...string) cmd
+}
+
+func (suite *TestTestSuite) BeforeTest(_, _ string) {
+	suite.ctrl = gomock.NewController(suite.T())
+	suite.mockCmd = NewMockcmd(suite.ctrl)
+
+	suite.originalCommand = command
+	command = func(path string, args ...string) cmd {
+		suite.actualArgs = args
+		return suite.mockCmd
+	}
+}
+
+func (suite *TestTestSuite) AfterTest(_, _ string) {
+	command = suite.originalCommand
+}
+
+func TestTestTestSuite(t *testing.T) {
+	suite.Run(t, new(TestTestSuite))
+}
+
+func (suite *TestTestSuite) TestNewTest() {
+	cfg := env.Config{
+		Release:     "queen_under_pressure",
+		TestTimeout: "5m",
+		TestLogs:    true,
+		TestFilter:  []string{"name=smoke"},
+	}
+	test := NewTest(cfg)
+	suite.Equal("queen_under_pressure", test.release)
+	suite.Equal("5m", test.timeout)
+	suite.Equal(true, test.logs)
+	suite.Equal([]string{"name=smoke"}, test.filters)
+	suite.NotNil(test.config)
+}
+
+func (suite *TestTestSuite) TestPrepareAndExecute() {
+	defer suite.ctrl.Finish()
+
+	stdout := strings.Builder{}
+	stderr := strings.Builder{}
+	cfg := env.Config{
+		Release: "queen_under_pressure",
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	test := NewTest(cfg)
+
+	suite.mockCmd.EXPECT().Stdout(&stdout)
+	suite.mockCmd.EXPECT().Stderr(&stderr)
+	suite.mockCmd.EXPECT().
+		Run().
+		Times(1)
+
+	suite.Require().NoError(test.Prepare())
+	suite.Equal([]string{"test", "queen_under_pressure"}, suite.actualArgs)
+	suite.Require().NoError(test.Execute())
+}
+
+func (suite *TestTestSuite) TestPrepareWithTestFlags() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.Config{
+		Namespace:   "rhapsody",
+		Release:     "queen_under_pressure",
+		TestTimeout: "90s",
+		TestLogs:    true,
+		TestFilter:  []string{"name=smoke", "!name=soak"},
+	}
+	test := NewTest(cfg)
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(test.Prepare())
+	suite.Equal([]string{"--namespace", "rhapsody", "test",
+		"--timeout", "90s",
+		"--logs",
+		"--filter", "name=smoke",
+		"--filter", "!name=soak",
+		"queen_under_pressure"}, suite.actualArgs)
+}
+
+func (suite *TestTestSuite) TestPrepareRequiresRelease() {
+	// These aren't really expected, but allowing them gives clearer test-failure messages
+	suite.mockCmd.EXPECT().Stdout(gomock.Any()).AnyTimes()
+	suite.mockCmd.EXPECT().Stderr(gomock.Any()).AnyTimes()
+
+	test := NewTest(env.Config{})
+	suite.EqualError(test.Prepare(), "release is required")
+}
+
+func (suite *TestTestSuite) TestPrepareDebugFlag() {
+	stdout := strings.Builder{}
+	stderr := strings.Builder{}
+
+	cfg := env.Config{
+		Release: "queen_under_pressure",
+		Debug:   true,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	test := NewTest(cfg)
+
+	command = func(path string, args ...string) cmd {
+		suite.mockCmd.EXPECT().
+			String().
+			Return(fmt.Sprintf("%s %s", path, strings.Join(args, " ")))
+
+		return suite.mockCmd
+	}
+
+	suite.mockCmd.EXPECT().Stdout(&stdout)
+	suite.mockCmd.EXPECT().Stderr(&stderr)
+
+	suite.Require().NoError(test.Prepare())
+
+	want := fmt.Sprintf("Generated command: '%s --debug test queen_under_pressure'\n", helmBin)
+	suite.Equal(want, stderr.String())
+}
@@ -29,6 +29,14 @@ func (u *Uninstall) Execute() error {
 	return u.cmd.Run()
 }
 
+// Command returns the helm command that the Uninstall step runs.
+func (u *Uninstall) Command() string {
+	if u.cmd == nil {
+		return ""
+	}
+	return u.cmd.String()
+}
+
 // Prepare gets the Uninstall ready to execute.
 func (u *Uninstall) Prepare() error {
 	if u.release == "" {
@@ -2,6 +2,7 @@ package run
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 )
@@ -15,8 +16,10 @@ type Upgrade struct {
 	chartVersion    string
 	dryRun          bool
 	wait            bool
-	values          string
-	stringValues    string
+	values          []string
+	stringValues    []string
+	fileValues      []string
+	jsonValues      []string
 	valuesFiles     []string
 	reuseValues     bool
 	timeout         string
@@ -27,10 +30,15 @@ type Upgrade struct {
 	certs           *repoCerts
 	createNamespace bool
 	skipCrds        bool
+	releaseEnvFile  string
+	valuesWriter    *valuesWriter
 
 	cmd cmd
 }
 
+// lookupRelease is a variable so the tests can substitute a stand-in for the cluster.
+var lookupRelease = ReleaseStatus
+
 // NewUpgrade creates an Upgrade using fields from the given Config. No validation is performed at this time.
 func NewUpgrade(cfg env.Config) *Upgrade {
 	return &Upgrade{
@@ -42,6 +50,8 @@ func NewUpgrade(cfg env.Config) *Upgrade {
 		wait:            cfg.Wait,
 		values:          cfg.Values,
 		stringValues:    cfg.StringValues,
+		fileValues:      cfg.FileValues,
+		jsonValues:      cfg.JSONValues,
 		valuesFiles:     cfg.ValuesFiles,
 		reuseValues:     cfg.ReuseValues,
 		timeout:         cfg.Timeout,
@@ -52,12 +62,61 @@ func NewUpgrade(cfg env.Config) *Upgrade {
 		certs:           newRepoCerts(cfg),
 		createNamespace: cfg.CreateNamespace,
 		skipCrds:        cfg.SkipCrds,
+		releaseEnvFile:  cfg.ReleaseEnvFile,
+		valuesWriter:    newValuesWriter(cfg),
 	}
 }
 
-// Execute executes the `helm upgrade` command.
+// Execute executes the `helm upgrade` command, then summarizes the release it installed.
 func (u *Upgrade) Execute() error {
-	return u.cmd.Run()
+	if err := u.cmd.Run(); err != nil {
+		return err
+	}
+	if u.dryRun {
+		return nil
+	}
+	return u.summarize()
+}
+
+// summarize prints the release's revision, status, chart and notes, and exports them to the release_env_file
+// if one is set. Since the upgrade itself succeeded, failing to look up the release is only a warning, unless
+// later steps are relying on the env file.
+func (u *Upgrade) summarize() error {
+	info, err := lookupRelease(env.Config{Release: u.release, Namespace: u.namespace, KubeContext: u.kubeContext})
+	if err != nil {
+		if u.releaseEnvFile != "" {
+			return fmt.Errorf("could not look up release %s after upgrading: %w", u.release, err)
+		}
+		fmt.Fprintf(u.stderr, "Warning: could not look up release %s after upgrading: %s\n", u.release, err)
+		return nil
+	}
+
+	fmt.Fprintf(u.stdout, "Release %s: revision %d, status %s, chart %s-%s, app version %s\n",
+		u.release, info.Revision, info.Status, info.Chart, info.ChartVersion, info.AppVersion)
+	if info.Notes != "" {
+		fmt.Fprintf(u.stdout, "NOTES:\n%s\n", strings.TrimRight(info.Notes, "\n"))
+	}
+
+	if u.releaseEnvFile != "" {
+		if u.debug {
+			fmt.Fprintf(u.stderr, "writing release information to %s\n", u.releaseEnvFile)
+		}
+		return writeReleaseEnv(u.releaseEnvFile, u.release, info)
+	}
+	return nil
+}
+
+// Command returns the helm command that the Upgrade step runs.
+func (u *Upgrade) Command() string {
+	if u.cmd == nil {
+		return ""
+	}
+	return u.cmd.String()
+}
+
+// Cleanup removes the interpolated values files, if any.
+func (u *Upgrade) Cleanup() error {
+	return u.valuesWriter.cleanup()
 }
 
 // Prepare gets the Upgrade ready to execute.
@@ -96,19 +155,21 @@ func (u *Upgrade) Prepare() error {
 	if u.cleanupOnFail {
 		args = append(args, "--cleanup-on-fail")
 	}
-	if u.values != "" {
-		args = append(args, "--set", u.values)
-	}
-	if u.stringValues != "" {
-		args = append(args, "--set-string", u.stringValues)
-	}
+	args = append(args, setFlags("--set", u.values)...)
+	args = append(args, setFlags("--set-string", u.stringValues)...)
+	args = append(args, setFlags("--set-file", u.fileValues)...)
+	args = append(args, setFlags("--set-json", u.jsonValues)...)
 	if u.createNamespace {
 		args = append(args, "--create-namespace")
 	}
 	if u.skipCrds {
 		args = append(args, "--skip-crds")
 	}
-	for _, vFile := range u.valuesFiles {
+	valuesFiles, err := u.valuesWriter.files(u.valuesFiles)
+	if err != nil {
+		return err
+	}
+	for _, vFile := range valuesFiles {
 		args = append(args, "--values", vFile)
 	}
 	args = append(args, u.certs.flags()...)
@@ -1,20 +1,27 @@
 package run
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"filippo.io/age"
 	"github.com/golang/mock/gomock"
+	"github.com/joho/godotenv"
 	"github.com/mongodb-forks/drone-helm3/internal/env"
 	"github.com/stretchr/testify/suite"
 )
 
 type UpgradeTestSuite struct {
 	suite.Suite
-	ctrl            *gomock.Controller
-	mockCmd         *Mockcmd
-	originalCommand func(string, ...string) cmd
+	ctrl                  *gomock.Controller
+	mockCmd               *Mockcmd
+	originalCommand       func(string, ...string) cmd
+	originalLookupRelease func(env.Config) (ReleaseInfo, error)
+	lookedUp              []env.Config
 }
 
 func (suite *UpgradeTestSuite) BeforeTest(_, _ string) {
@@ -23,10 +30,26 @@ func (suite *UpgradeTestSuite) BeforeTest(_, _ string) {
 
 	suite.originalCommand = command
 	command = func(path string, args ...string) cmd { return suite.mockCmd }
+
+	suite.lookedUp = nil
+	suite.originalLookupRelease = lookupRelease
+	lookupRelease = func(cfg env.Config) (ReleaseInfo, error) {
+		suite.lookedUp = append(suite.lookedUp, cfg)
+		return ReleaseInfo{
+			Namespace:    "top40",
+			Status:       "deployed",
+			Revision:     7,
+			Chart:        "at40",
+			ChartVersion: "1.2.3",
+			AppVersion:   "2019",
+			Notes:        "Thanks for listening!\nVisit https://at40.example.com\n",
+		}, nil
+	}
 }
 
 func (suite *UpgradeTestSuite) AfterTest(_, _ string) {
 	command = suite.originalCommand
+	lookupRelease = suite.originalLookupRelease
 }
 
 func TestUpgradeTestSuite(t *testing.T) {
@@ -38,8 +61,8 @@ func (suite *UpgradeTestSuite) TestNewUpgrade() {
 	cfg.ChartVersion = "seventeen"
 	cfg.DryRun = true
 	cfg.Wait = true
-	cfg.Values = "steadfastness,forthrightness"
-	cfg.StringValues = "tensile_strength,flexibility"
+	cfg.Values = env.Values{"steadfastness", "forthrightness"}
+	cfg.StringValues = env.Values{"tensile_strength", "flexibility"}
 	cfg.ValuesFiles = []string{"/root/price_inventory.yml"}
 	cfg.ReuseValues = true
 	cfg.Timeout = "go sit in the corner"
@@ -56,8 +79,8 @@ func (suite *UpgradeTestSuite) TestNewUpgrade() {
 	suite.Equal(cfg.ChartVersion, up.chartVersion)
 	suite.Equal(true, up.dryRun)
 	suite.Equal(cfg.Wait, up.wait)
-	suite.Equal("steadfastness,forthrightness", up.values)
-	suite.Equal("tensile_strength,flexibility", up.stringValues)
+	suite.Equal([]string{"steadfastness", "forthrightness"}, up.values)
+	suite.Equal([]string{"tensile_strength", "flexibility"}, up.stringValues)
 	suite.Equal([]string{"/root/price_inventory.yml"}, up.valuesFiles)
 	suite.Equal(cfg.ReuseValues, up.reuseValues)
 	suite.Equal(cfg.Timeout, up.timeout)
@@ -98,6 +121,102 @@ func (suite *UpgradeTestSuite) TestPrepareAndExecute() {
 	suite.Require().Nil(err)
 }
 
+func (suite *UpgradeTestSuite) TestExecuteSummarizesRelease() {
+	defer suite.ctrl.Finish()
+
+	stdout := &strings.Builder{}
+	envFile := filepath.Join(suite.T().TempDir(), "output.env")
+	cfg := env.Config{
+		Chart:          "at40",
+		Release:        "jonas_brothers_only_human",
+		Namespace:      "top40",
+		KubeContext:    "production",
+		ReleaseEnvFile: envFile,
+		Stdout:         stdout,
+		Stderr:         &strings.Builder{},
+	}
+	u := NewUpgrade(cfg)
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run()
+
+	suite.Require().NoError(u.Prepare())
+	suite.Require().NoError(u.Execute())
+
+	suite.Require().Len(suite.lookedUp, 1)
+	suite.Equal(env.Config{Release: "jonas_brothers_only_human", Namespace: "top40", KubeContext: "production"}, suite.lookedUp[0])
+	suite.Equal("Release jonas_brothers_only_human: revision 7, status deployed, chart at40-1.2.3, app version 2019\n"+
+		"NOTES:\nThanks for listening!\nVisit https://at40.example.com\n", stdout.String())
+
+	exported, err := godotenv.Read(envFile)
+	suite.Require().NoError(err)
+	suite.Equal(map[string]string{
+		"HELM_JONAS_BROTHERS_ONLY_HUMAN_REVISION":      "7",
+		"HELM_JONAS_BROTHERS_ONLY_HUMAN_STATUS":        "deployed",
+		"HELM_JONAS_BROTHERS_ONLY_HUMAN_NAMESPACE":     "top40",
+		"HELM_JONAS_BROTHERS_ONLY_HUMAN_CHART":         "at40",
+		"HELM_JONAS_BROTHERS_ONLY_HUMAN_CHART_VERSION": "1.2.3",
+		"HELM_JONAS_BROTHERS_ONLY_HUMAN_APP_VERSION":   "2019",
+		"HELM_JONAS_BROTHERS_ONLY_HUMAN_NOTES":         "Thanks for listening!\nVisit https://at40.example.com\n",
+	}, exported)
+}
+
+func (suite *UpgradeTestSuite) TestExecuteAppendsToReleaseEnvFile() {
+	defer suite.ctrl.Finish()
+
+	envFile := filepath.Join(suite.T().TempDir(), "output.env")
+	suite.Require().NoError(os.WriteFile(envFile, []byte("EARLIER_STEP=\"kept\"\n"), 0644))
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run()
+
+	u := NewUpgrade(env.Config{Chart: "at40", Release: "lizzo-juice", ReleaseEnvFile: envFile, Stdout: &strings.Builder{}})
+	suite.Require().NoError(u.Prepare())
+	suite.Require().NoError(u.Execute())
+
+	exported, err := godotenv.Read(envFile)
+	suite.Require().NoError(err)
+	suite.Equal("kept", exported["EARLIER_STEP"])
+	suite.Equal("7", exported["HELM_LIZZO_JUICE_REVISION"])
+}
+
+func (suite *UpgradeTestSuite) TestExecuteDryRunSkipsSummary() {
+	defer suite.ctrl.Finish()
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+	suite.mockCmd.EXPECT().Run()
+
+	u := NewUpgrade(env.Config{Chart: "at40", Release: "lizzo_juice", DryRun: true})
+	suite.Require().NoError(u.Prepare())
+	suite.Require().NoError(u.Execute())
+	suite.Empty(suite.lookedUp, "a dry run doesn't install a release to look up")
+}
+
+func (suite *UpgradeTestSuite) TestExecuteLookupFailure() {
+	defer suite.ctrl.Finish()
+
+	lookupRelease = func(cfg env.Config) (ReleaseInfo, error) {
+		return ReleaseInfo{}, errors.New("release: not found")
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any()).AnyTimes()
+	suite.mockCmd.EXPECT().Stderr(gomock.Any()).AnyTimes()
+	suite.mockCmd.EXPECT().Run().Times(2)
+
+	stderr := &strings.Builder{}
+	u := NewUpgrade(env.Config{Chart: "at40", Release: "lizzo_juice", Stderr: stderr})
+	suite.Require().NoError(u.Prepare())
+	suite.NoError(u.Execute(), "the upgrade itself succeeded")
+	suite.Equal("Warning: could not look up release lizzo_juice after upgrading: release: not found\n", stderr.String())
+
+	u = NewUpgrade(env.Config{Chart: "at40", Release: "lizzo_juice", ReleaseEnvFile: filepath.Join(suite.T().TempDir(), "output.env")})
+	suite.Require().NoError(u.Prepare())
+	suite.EqualError(u.Execute(), "could not look up release lizzo_juice after upgrading: release: not found",
+		"later steps can't rely on the env file if it wasn't written")
+}
+
 func (suite *UpgradeTestSuite) TestPrepareNamespaceFlag() {
 	defer suite.ctrl.Finish()
 
@@ -131,8 +250,10 @@ func (suite *UpgradeTestSuite) TestPrepareWithUpgradeFlags() {
 	cfg.ChartVersion = "radio_edit"
 	cfg.DryRun = true
 	cfg.Wait = true
-	cfg.Values = "age=35"
-	cfg.StringValues = "height=5ft10in"
+	cfg.Values = env.Values{"age=35", "hobbies={darts,chess}"}
+	cfg.StringValues = env.Values{"height=5ft10in"}
+	cfg.FileValues = env.Values{"bio=./bio.txt"}
+	cfg.JSONValues = env.Values{`stats={"wins":3,"losses":1}`}
 	cfg.ValuesFiles = []string{"/usr/local/stats", "/usr/local/grades"}
 	cfg.ReuseValues = true
 	cfg.Timeout = "sit_in_the_corner"
@@ -156,7 +277,10 @@ func (suite *UpgradeTestSuite) TestPrepareWithUpgradeFlags() {
 			"--atomic",
 			"--cleanup-on-fail",
 			"--set", "age=35",
+			"--set", "hobbies={darts,chess}",
 			"--set-string", "height=5ft10in",
+			"--set-file", "bio=./bio.txt",
+			"--set-json", `stats={"wins":3,"losses":1}`,
 			"--values", "/usr/local/stats",
 			"--values", "/usr/local/grades",
 			"--ca-file", "local_ca.cert",
@@ -251,3 +375,127 @@ func (suite *UpgradeTestSuite) TestPrepareSkipCrdsFlag() {
 	err := u.Prepare()
 	suite.Require().Nil(err)
 }
+
+func (suite *UpgradeTestSuite) TestPrepareInterpolatesValuesFiles() {
+	defer suite.ctrl.Finish()
+	suite.T().Setenv("DB_PASSWORD", "correct-horse")
+	valuesFile := filepath.Join(suite.T().TempDir(), "db.yml")
+	suite.Require().NoError(os.WriteFile(valuesFile, []byte("password: ${DB_PASSWORD}\n"), 0644))
+
+	cfg := env.NewTestConfig(suite.T())
+	cfg.Chart = "at40"
+	cfg.Release = "cabbages_smell_great"
+	cfg.ValuesFiles = []string{valuesFile}
+	cfg.InterpolateFiles = true
+
+	u := NewUpgrade(*cfg)
+
+	var interpolated string
+	command = func(path string, args ...string) cmd {
+		suite.Require().Equal("--values", args[2])
+		interpolated = args[3]
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(u.Prepare())
+	suite.NotEqual(valuesFile, interpolated)
+	contents, err := os.ReadFile(interpolated)
+	suite.Require().NoError(err)
+	suite.Equal("password: correct-horse\n", string(contents))
+
+	suite.Require().NoError(u.Cleanup())
+	suite.NoFileExists(interpolated)
+}
+
+func (suite *UpgradeTestSuite) TestPrepareDecryptsValuesFiles() {
+	defer suite.ctrl.Finish()
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{identity.Recipient()}
+	valuesFile := filepath.Join(suite.T().TempDir(), "secrets.yml")
+	suite.Require().NoError(os.WriteFile(valuesFile, []byte(e.encrypt(suite.T(), "password: correct-horse\n")), 0644))
+
+	cfg := env.NewTestConfig(suite.T())
+	cfg.Chart = "at40"
+	cfg.Release = "cabbages_smell_great"
+	cfg.ValuesFiles = []string{valuesFile}
+	cfg.SopsAgeKey = identity.String()
+
+	u := NewUpgrade(*cfg)
+
+	var decrypted string
+	command = func(path string, args ...string) cmd {
+		suite.Require().Equal("--values", args[2])
+		decrypted = args[3]
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(u.Prepare())
+	suite.NotEqual(valuesFile, decrypted)
+	contents, err := os.ReadFile(decrypted)
+	suite.Require().NoError(err)
+	suite.Equal("password: correct-horse\n", string(contents))
+
+	suite.Require().NoError(u.Cleanup())
+	suite.NoFileExists(decrypted)
+}
+
+func (suite *UpgradeTestSuite) TestPrepareWithValuesYAML() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.NewTestConfig(suite.T())
+	cfg.Chart = "at40"
+	cfg.Release = "cabbages_smell_great"
+	cfg.ValuesFiles = []string{"/usr/local/stats"}
+	cfg.ValuesYAML = "chart:\n  positions: [1, 2, 3]\n"
+
+	u := NewUpgrade(*cfg)
+
+	var args []string
+	command = func(path string, a ...string) cmd {
+		args = a
+		return suite.mockCmd
+	}
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(u.Prepare())
+	suite.Require().Len(args, 9)
+	suite.Equal([]string{"upgrade", "--install", "--values", "/usr/local/stats", "--values"}, args[:5])
+	suite.Equal([]string{"--history-max=10", "cabbages_smell_great", "at40"}, args[6:])
+	contents, err := os.ReadFile(args[5])
+	suite.Require().NoError(err)
+	suite.Equal("chart:\n  positions: [1, 2, 3]\n", string(contents))
+
+	suite.Require().NoError(u.Cleanup())
+	suite.NoFileExists(args[5])
+}
+
+func (suite *UpgradeTestSuite) TestPrepareOCIChart() {
+	defer suite.ctrl.Finish()
+
+	cfg := env.NewTestConfig(suite.T())
+	cfg.Chart = "oci://registry.example.com/charts/at40"
+	cfg.ChartVersion = "1.2.3"
+	cfg.Release = "olivia_rodrigo_drivers_license"
+
+	u := NewUpgrade(*cfg)
+
+	command = func(path string, args ...string) cmd {
+		suite.Equal(helmBin, path)
+		suite.Equal([]string{"upgrade", "--install", "--version", "1.2.3", "--history-max=10",
+			"olivia_rodrigo_drivers_license", "oci://registry.example.com/charts/at40"}, args)
+
+		return suite.mockCmd
+	}
+
+	suite.mockCmd.EXPECT().Stdout(gomock.Any())
+	suite.mockCmd.EXPECT().Stderr(gomock.Any())
+
+	suite.Require().NoError(u.Prepare())
+}
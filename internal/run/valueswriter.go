@@ -0,0 +1,156 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// valuesWriter writes the values files that helm reads in place of, or as well as, the values_files: decrypted
+// copies of values_files encrypted with SOPS, copies with environment variables substituted for the
+// interpolate_values_files setting, and the values_yaml block. Since the files may contain secrets, each one is a temp file that only its owner can read.
+type valuesWriter struct {
+	*config
+	interpolate bool
+	strict      bool
+	valuesYAML  string
+	sopsAgeKey  string
+	sopsPGPKey  string
+	passphrase  string
+	written     []string // files created by files, for cleanup to remove
+}
+
+func newValuesWriter(cfg env.Config) *valuesWriter {
+	return &valuesWriter{
+		config:      newConfig(cfg),
+		interpolate: cfg.InterpolateFiles,
+		strict:      cfg.InterpolateStrict,
+		valuesYAML:  cfg.ValuesYAML,
+		sopsAgeKey:  cfg.SopsAgeKey,
+		sopsPGPKey:  cfg.SopsPGPKey,
+		passphrase:  cfg.SopsPassphrase,
+	}
+}
+
+// files returns the files to pass to --values: the given files themselves, or decrypted or interpolated copies
+// of them, followed by the values_yaml block if there is one.
+func (vw *valuesWriter) files(valuesFiles []string) ([]string, error) {
+	if vw == nil {
+		return valuesFiles, nil
+	}
+
+	keys, err := newSOPSKeys(vw.sopsAgeKey, vw.sopsPGPKey, vw.passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	// every file is checked for encryption, so that one isn't installed as ciphertext when the key is missing
+	files := make([]string, 0, len(valuesFiles)+1)
+	for _, filename := range valuesFiles {
+		prepared, err := vw.prepareFile(filename, keys)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, prepared)
+	}
+
+	if strings.TrimSpace(vw.valuesYAML) != "" {
+		var values map[string]interface{}
+		if err := yaml.Unmarshal([]byte(vw.valuesYAML), &values); err != nil {
+			return nil, fmt.Errorf("values_yaml must be a YAML map of values: %w", err)
+		}
+		filename, err := vw.write("values_yaml", vw.valuesYAML)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files[:len(files):len(files)], filename)
+	}
+	return files, nil
+}
+
+// prepareFile decrypts a values file if it's encrypted with SOPS and substitutes environment variables into it if
+// interpolate_values_files is set. It returns the name of the copy, or of the file itself if it needed neither.
+func (vw *valuesWriter) prepareFile(filename string, keys *sopsKeys) (string, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		if !vw.interpolate {
+			// leave it to helm, which can also read values files from a URL
+			return filename, nil
+		}
+		return "", fmt.Errorf("could not read values file: %w", err)
+	}
+
+	var descriptions []string
+	decrypted, secrets, encrypted, err := keys.decrypt(contents)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt values file %s: %w", filename, err)
+	}
+	if encrypted {
+		env.AddSecrets(vw.stdout, secrets)
+		env.AddSecrets(vw.stderr, secrets)
+		contents = decrypted
+		descriptions = append(descriptions, "decrypted")
+	}
+
+	if vw.interpolate {
+		expanded, _, missing := env.ExpandValuesFile(string(contents))
+		if len(missing) > 0 && vw.strict {
+			return "", fmt.Errorf("values file %s refers to unset environment variables: %s", filename, strings.Join(missing, ", "))
+		}
+		if vw.debug {
+			for _, name := range missing {
+				fmt.Fprintf(vw.stderr, "$%s not present in environment, replaced with \"\" in %s\n", name, filename)
+			}
+		}
+		contents = []byte(expanded)
+		descriptions = append(descriptions, "interpolated")
+	}
+
+	if len(descriptions) == 0 {
+		return filename, nil
+	}
+	return vw.write(strings.Join(descriptions, ", ")+" "+filename, string(contents))
+}
+
+// write puts the contents in a new temp file and returns its name.
+func (vw *valuesWriter) write(description, contents string) (string, error) {
+	file, err := os.CreateTemp("", "values********.yml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create values file: %w", err)
+	}
+	vw.written = append(vw.written, file.Name())
+	if vw.debug {
+		fmt.Fprintf(vw.stderr, "writing %s to %s\n", description, file.Name())
+	}
+
+	_, err = file.WriteString(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write values file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// cleanup removes the files created by files.
+func (vw *valuesWriter) cleanup() error {
+	if vw == nil {
+		return nil
+	}
+	for _, filename := range vw.written {
+		if vw.debug {
+			fmt.Fprintf(vw.stderr, "removing %s\n", filename)
+		}
+		if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("could not remove %s: %w", filename, err)
+		}
+	}
+	vw.written = nil
+	return nil
+}
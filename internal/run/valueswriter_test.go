@@ -0,0 +1,212 @@
+package run
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/mongodb-forks/drone-helm3/internal/env"
+	"github.com/stretchr/testify/suite"
+)
+
+type ValuesWriterTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestValuesWriterTestSuite(t *testing.T) {
+	suite.Run(t, new(ValuesWriterTestSuite))
+}
+
+func (suite *ValuesWriterTestSuite) BeforeTest(_, _ string) {
+	suite.dir = suite.T().TempDir()
+	suite.T().Setenv("DB_PASSWORD", "correct-horse")
+	suite.T().Setenv("DB_HOST", "") // restored after the test
+	os.Unsetenv("DB_HOST")
+}
+
+func (suite *ValuesWriterTestSuite) writeValues(name, contents string) string {
+	filename := filepath.Join(suite.dir, name)
+	suite.Require().NoError(os.WriteFile(filename, []byte(contents), 0644))
+	return filename
+}
+
+func (suite *ValuesWriterTestSuite) TestInterpolate() {
+	values := suite.writeValues("db.yml", "db:\n  password: ${DB_PASSWORD}\n  host: ${DB_HOST:-localhost}\n  user: ${DB_USER}\n")
+	vw := newValuesWriter(env.Config{InterpolateFiles: true})
+
+	files, err := vw.files([]string{values})
+	suite.Require().NoError(err)
+	suite.Require().Len(files, 1)
+	suite.NotEqual(values, files[0])
+
+	contents, err := os.ReadFile(files[0])
+	suite.Require().NoError(err)
+	suite.Equal("db:\n  password: correct-horse\n  host: localhost\n  user: \n", string(contents))
+
+	info, err := os.Stat(files[0])
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm(), "the interpolated file may contain secrets")
+
+	suite.Require().NoError(vw.cleanup())
+	suite.NoFileExists(files[0])
+}
+
+func (suite *ValuesWriterTestSuite) TestInterpolateDisabled() {
+	vw := newValuesWriter(env.Config{})
+	files, err := vw.files([]string{"/usr/local/stats"})
+	suite.Require().NoError(err)
+	suite.Equal([]string{"/usr/local/stats"}, files)
+
+	var unset *valuesWriter
+	files, err = unset.files([]string{"/usr/local/stats"})
+	suite.Require().NoError(err)
+	suite.Equal([]string{"/usr/local/stats"}, files)
+	suite.NoError(unset.cleanup())
+}
+
+func (suite *ValuesWriterTestSuite) TestInterpolateStrict() {
+	values := suite.writeValues("db.yml", "password: ${DB_PASSWORD}\nhost: ${DB_HOST}\nuser: ${DB_USER:-app}\n")
+	vw := newValuesWriter(env.Config{InterpolateFiles: true, InterpolateStrict: true})
+
+	_, err := vw.files([]string{values})
+	suite.EqualError(err, "values file "+values+" refers to unset environment variables: DB_HOST")
+}
+
+func (suite *ValuesWriterTestSuite) TestInterpolateMissingFile() {
+	vw := newValuesWriter(env.Config{InterpolateFiles: true})
+	_, err := vw.files([]string{filepath.Join(suite.dir, "missing.yml")})
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "could not read values file")
+}
+
+func (suite *ValuesWriterTestSuite) TestInterpolateDebugOutput() {
+	values := suite.writeValues("db.yml", "host: ${DB_HOST}\n")
+	stderr := &strings.Builder{}
+	vw := newValuesWriter(env.Config{InterpolateFiles: true, Debug: true, Stderr: stderr})
+
+	_, err := vw.files([]string{values})
+	suite.Require().NoError(err)
+	suite.NoError(vw.cleanup())
+	suite.Contains(stderr.String(), `$DB_HOST not present in environment, replaced with "" in `+values)
+	suite.Contains(stderr.String(), "writing interpolated "+values+" to ")
+}
+
+func (suite *ValuesWriterTestSuite) TestValuesYAML() {
+	values := suite.writeValues("db.yml", "password: ${DB_PASSWORD}\n")
+	valuesYAML := "ingress:\n  hosts:\n    - name: at40.example.com\n      paths: [/]\n"
+	vw := newValuesWriter(env.Config{ValuesYAML: valuesYAML})
+
+	files, err := vw.files([]string{values})
+	suite.Require().NoError(err)
+	suite.Require().Len(files, 2)
+	suite.Equal(values, files[0], "values_yaml should come after the values_files")
+
+	contents, err := os.ReadFile(files[1])
+	suite.Require().NoError(err)
+	suite.Equal(valuesYAML, string(contents))
+
+	suite.Require().NoError(vw.cleanup())
+	suite.NoFileExists(files[1])
+	suite.FileExists(values, "the values_files themselves should be left alone")
+}
+
+func (suite *ValuesWriterTestSuite) TestValuesYAMLFromSettingsMap() {
+	// drone passes a map in the settings block as JSON
+	vw := newValuesWriter(env.Config{ValuesYAML: `{"ingress":{"hosts":[{"name":"at40.example.com"}]}}`})
+	files, err := vw.files(nil)
+	suite.Require().NoError(err)
+	suite.Len(files, 1)
+	suite.NoError(vw.cleanup())
+}
+
+func (suite *ValuesWriterTestSuite) TestInvalidValuesYAML() {
+	for _, valuesYAML := range []string{"ingress:\n\thosts: []\n", "- just\n- a list\n", "a string"} {
+		vw := newValuesWriter(env.Config{ValuesYAML: valuesYAML})
+		_, err := vw.files(nil)
+		suite.Require().Error(err, valuesYAML)
+		suite.Contains(err.Error(), "values_yaml must be a YAML map of values")
+		suite.Empty(vw.written, "nothing should be written for invalid values_yaml")
+	}
+}
+
+func (suite *ValuesWriterTestSuite) TestDecrypt() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{identity.Recipient()}
+	encrypted := suite.writeValues("secrets.yml", e.encrypt(suite.T(), "db:\n  password: correct-horse\n  host: ${DB_HOST:-localhost}\n"))
+	plain := suite.writeValues("plain.yml", "replicas: 3\n")
+
+	suite.T().Setenv("PLUGIN_SOPS_AGE_KEY", identity.String())
+	stderr := &strings.Builder{}
+	cfg, err := env.NewConfig(&strings.Builder{}, stderr)
+	suite.Require().NoError(err)
+	cfg.InterpolateFiles = true
+	cfg.Debug = true
+	vw := newValuesWriter(*cfg)
+
+	files, err := vw.files([]string{encrypted, plain})
+	suite.Require().NoError(err)
+	suite.Require().Len(files, 2)
+	suite.NotEqual(encrypted, files[0])
+
+	contents, err := os.ReadFile(files[0])
+	suite.Require().NoError(err)
+	suite.Equal("db:\n  password: correct-horse\n  host: localhost\n", string(contents), "the file should be decrypted, then interpolated")
+	info, err := os.Stat(files[0])
+	suite.Require().NoError(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm(), "the decrypted file contains secrets")
+	suite.Contains(stderr.String(), "writing decrypted, interpolated "+encrypted+" to ")
+
+	fmt.Fprintln(cfg.Stderr, "Error: password correct-horse rejected")
+	cfg.Flush()
+	suite.Contains(stderr.String(), "Error: password (redacted) rejected", "decrypted values should be masked in helm's output")
+
+	suite.Require().NoError(vw.cleanup())
+	suite.NoFileExists(files[0])
+	suite.NoFileExists(files[1])
+}
+
+func (suite *ValuesWriterTestSuite) TestDecryptLeavesPlainFilesAlone() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	plain := suite.writeValues("plain.yml", "replicas: 3\n")
+	vw := newValuesWriter(env.Config{SopsAgeKey: identity.String()})
+
+	files, err := vw.files([]string{plain})
+	suite.Require().NoError(err)
+	suite.Equal([]string{plain}, files)
+	suite.Empty(vw.written)
+}
+
+func (suite *ValuesWriterTestSuite) TestDecryptWithoutMatchingKey() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{identity.Recipient()}
+	encrypted := suite.writeValues("secrets.yml", e.encrypt(suite.T(), "password: correct-horse\n"))
+
+	other, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	vw := newValuesWriter(env.Config{SopsAgeKey: other.String()})
+	_, err = vw.files([]string{encrypted})
+	suite.EqualError(err, "could not decrypt values file "+encrypted+": none of the keys in sops_age_key or sops_pgp_key can decrypt it")
+	suite.Empty(vw.written)
+}
+
+func (suite *ValuesWriterTestSuite) TestEncryptedFileWithoutKey() {
+	identity, err := age.GenerateX25519Identity()
+	suite.Require().NoError(err)
+	e := newSOPSEncrypter(suite.T())
+	e.age = []age.Recipient{identity.Recipient()}
+	encrypted := suite.writeValues("secrets.yml", e.encrypt(suite.T(), "password: correct-horse\n"))
+
+	// e.g. a from_secret whose secret is missing, which drone passes as an empty string
+	vw := newValuesWriter(env.Config{SopsAgeKey: ""})
+	_, err = vw.files([]string{encrypted})
+	suite.EqualError(err, "could not decrypt values file "+encrypted+": it is encrypted with SOPS, but neither sops_age_key nor sops_pgp_key is set")
+}